@@ -0,0 +1,275 @@
+package blob
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/InsZVA/saver/record"
+)
+
+var (
+	errBrokenPointer = errors.New("blob指针已损坏")
+	errBrokenBlob    = errors.New("blob文件可能已损坏")
+)
+
+// PointerSize 编码之后的Pointer长度
+const PointerSize = 24
+
+// Pointer 指向blob文件中的一个value
+type Pointer struct {
+	FileNum uint64
+	// 记录在blob文件中的偏移
+	Offset uint64
+	// value的长度
+	Length uint64
+}
+
+func (p Pointer) Encode() []byte {
+	b := make([]byte, PointerSize)
+	binary.LittleEndian.PutUint64(b, p.FileNum)
+	binary.LittleEndian.PutUint64(b[8:], p.Offset)
+	binary.LittleEndian.PutUint64(b[16:], p.Length)
+	return b
+}
+
+func DecodePointer(b []byte) (Pointer, error) {
+	if len(b) != PointerSize {
+		return Pointer{}, errBrokenPointer
+	}
+	return Pointer{
+		FileNum: binary.LittleEndian.Uint64(b),
+		Offset:  binary.LittleEndian.Uint64(b[8:]),
+		Length:  binary.LittleEndian.Uint64(b[16:]),
+	}, nil
+}
+
+// FileName 返回编号为fileNum的blob文件在dirname下的文件名
+func FileName(dirname string, fileNum uint64) string {
+	return filepath.Join(dirname, fmt.Sprintf("%06d.blob", fileNum))
+}
+
+/*
+blob文件使用record的格式，每条记录为一个blob：
+[KeyLength32, key...][value...]
+保存key是为了在GC时判断blob是否仍然被引用
+*/
+func encodeBlob(key, value []byte) []byte {
+	b := make([]byte, 4+len(key)+len(value))
+	binary.LittleEndian.PutUint32(b, uint32(len(key)))
+	copy(b[4:], key)
+	copy(b[4+len(key):], value)
+	return b
+}
+
+func decodeBlob(b []byte) ([]byte, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, errBrokenBlob
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	if n < 0 || 4+n > len(b) {
+		return nil, nil, errBrokenBlob
+	}
+	return b[4 : 4+n], b[4+n:], nil
+}
+
+// Writer 向一个新的blob文件中追加value
+type Writer struct {
+	fileNum uint64
+	writer  *record.Writer
+	size    uint64
+}
+
+// Create 在dirname下创建编号为fileNum的blob文件
+func Create(dirname string, fileNum uint64) (*Writer, error) {
+	f, err := os.Create(FileName(dirname, fileNum))
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		fileNum: fileNum,
+		writer:  record.NewWriter(f),
+	}, nil
+}
+
+// Add 写入一个blob，返回指向它的指针
+func (w *Writer) Add(key, value []byte) (Pointer, error) {
+	offset, err := w.writer.Write(encodeBlob(key, value))
+	if err != nil {
+		return Pointer{}, err
+	}
+	w.size += uint64(len(value))
+	return Pointer{FileNum: w.fileNum, Offset: uint64(offset), Length: uint64(len(value))}, nil
+}
+
+func (w *Writer) FileNum() uint64 {
+	return w.fileNum
+}
+
+// Size 已经写入的value的总长度
+func (w *Writer) Size() uint64 {
+	return w.size
+}
+
+// Sync 把已经写入的blob同步到磁盘
+func (w *Writer) Sync() error {
+	return w.writer.Sync()
+}
+
+// Close 将剩余的数据写入磁盘，Close之后指针才能被读取
+func (w *Writer) Close() error {
+	return w.writer.Close()
+}
+
+// Reader 按照指针读取dirname下的blob文件，可以被多个goroutine同时使用
+// 打开的文件数超过maxOpenFiles时按LRU关闭，正在被读取的文件在读取结束之后才会关闭
+type Reader struct {
+	dirname string
+	maxOpen int
+	mu      sync.Mutex
+	lru     list.List
+	files   map[uint64]*openFile
+}
+
+type openFile struct {
+	fileNum uint64
+	f       *os.File
+	// 在Reader中时，Reader自身持有一个引用
+	refs int
+	elem *list.Element
+}
+
+func NewReader(dirname string, maxOpenFiles int) *Reader {
+	if maxOpenFiles < 1 {
+		maxOpenFiles = 1
+	}
+	return &Reader{
+		dirname: dirname,
+		maxOpen: maxOpenFiles,
+		files:   make(map[uint64]*openFile),
+	}
+}
+
+// acquire 返回打开的文件，使用完之后必须调用release
+func (r *Reader) acquire(fileNum uint64) (*openFile, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.files[fileNum]; ok {
+		e.refs++
+		r.lru.MoveToFront(e.elem)
+		return e, nil
+	}
+	f, err := os.Open(FileName(r.dirname, fileNum))
+	if err != nil {
+		return nil, err
+	}
+	e := &openFile{fileNum: fileNum, f: f, refs: 2}
+	e.elem = r.lru.PushFront(e)
+	r.files[fileNum] = e
+	for len(r.files) > r.maxOpen {
+		r.remove(r.lru.Back().Value.(*openFile))
+	}
+	return e, nil
+}
+
+func (r *Reader) release(e *openFile) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unref(e)
+}
+
+// remove 把文件移出Reader并释放Reader持有的引用，调用时需要持有锁
+func (r *Reader) remove(e *openFile) {
+	r.lru.Remove(e.elem)
+	delete(r.files, e.fileNum)
+	r.unref(e)
+}
+
+func (r *Reader) unref(e *openFile) {
+	e.refs--
+	if e.refs == 0 {
+		e.f.Close()
+	}
+}
+
+// Get 读取指针指向的value
+func (r *Reader) Get(p Pointer) ([]byte, error) {
+	e, err := r.acquire(p.FileNum)
+	if err != nil {
+		return nil, err
+	}
+	defer r.release(e)
+	b, err := record.NewReaderAt(e.f, int64(p.Offset)).Read()
+	if err != nil {
+		return nil, err
+	}
+	_, value, err := decodeBlob(b)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(value)) != p.Length {
+		return nil, errBrokenPointer
+	}
+	return value, nil
+}
+
+// Collect 把fileNum中isLive返回true的blob复制到dst中，返回旧指针到新指针的映射
+// 调用者需要用这个映射更新SSTable中的指针，之后才能调用Remove删除旧文件
+func (r *Reader) Collect(fileNum uint64, dst *Writer, isLive func(key []byte, p Pointer) (bool, error)) (map[Pointer]Pointer, error) {
+	e, err := r.acquire(fileNum)
+	if err != nil {
+		return nil, err
+	}
+	defer r.release(e)
+	remap := make(map[Pointer]Pointer)
+	reader := record.NewReaderAt(e.f, 0)
+	for {
+		b, err := reader.Read()
+		if err == io.EOF {
+			return remap, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		key, value, err := decodeBlob(b)
+		if err != nil {
+			return nil, err
+		}
+		p := Pointer{FileNum: fileNum, Offset: uint64(reader.Offset()), Length: uint64(len(value))}
+		live, err := isLive(key, p)
+		if err != nil {
+			return nil, err
+		}
+		if !live {
+			continue
+		}
+		if remap[p], err = dst.Add(key, value); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Remove 关闭并删除一个blob文件，必须在没有任何指针指向它之后调用
+func (r *Reader) Remove(fileNum uint64) error {
+	r.mu.Lock()
+	if e, ok := r.files[fileNum]; ok {
+		r.remove(e)
+	}
+	r.mu.Unlock()
+	return os.Remove(FileName(r.dirname, fileNum))
+}
+
+// Close 关闭所有文件，正在被读取的文件在读取结束之后关闭
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.files {
+		r.remove(e)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package blob
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/InsZVA/saver/util"
+)
+
+func TestPointerEncode(t *testing.T) {
+	p := Pointer{FileNum: 1, Offset: 2, Length: 3}
+	q, err := DecodePointer(p.Encode())
+	if err != nil || q != p {
+		t.Error("指针编码错误", q, err)
+	}
+	if _, err = DecodePointer([]byte{1, 2, 3}); err != errBrokenPointer {
+		t.Error("损坏的指针没有返回错误", err)
+	}
+}
+
+func TestBlobGetAndCollect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saver_blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := Create(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := [][]byte{}
+	vals := [][]byte{}
+	ptrs := []Pointer{}
+	for i := 0; i < 20; i++ {
+		keys = append(keys, util.RandomSlice(16))
+		vals = append(vals, util.RandomSlice(10*1024+i*5*1024))
+		p, err := w.Add(keys[i], vals[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ptrs = append(ptrs, p)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(dir, 10)
+	defer r.Close()
+	for i := range ptrs {
+		val, err := r.Get(ptrs[i])
+		if err != nil || !bytes.Equal(val, vals[i]) {
+			t.Error(i, "blob读取错误", err)
+		}
+	}
+
+	// 只有偶数下标的blob仍然存活
+	dst, err := Create(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remap, err := r.Collect(1, dst, func(key []byte, p Pointer) (bool, error) {
+		for i := range ptrs {
+			if ptrs[i] == p {
+				if !bytes.Equal(keys[i], key) {
+					t.Error(i, "GC时的key错误")
+				}
+				return i%2 == 0, nil
+			}
+		}
+		t.Error("GC时出现了未知的指针", p)
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(remap) != len(ptrs)/2 {
+		t.Error("存活的blob数量错误", len(remap))
+	}
+	if err = r.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	for i := range ptrs {
+		newP, ok := remap[ptrs[i]]
+		if ok != (i%2 == 0) {
+			t.Error(i, "GC结果错误")
+			continue
+		}
+		if !ok {
+			continue
+		}
+		val, err := r.Get(newP)
+		if err != nil || !bytes.Equal(val, vals[i]) || newP.FileNum != 2 {
+			t.Error(i, "GC之后blob读取错误", err)
+		}
+	}
+}
+
+func TestReaderMaxOpenFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saver_blob_open")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ptrs := []Pointer{}
+	vals := [][]byte{}
+	for fileNum := uint64(1); fileNum <= 4; fileNum++ {
+		w, err := Create(dir, fileNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		val := util.RandomSlice(1024)
+		p, err := w.Add([]byte("key"), val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		ptrs = append(ptrs, p)
+		vals = append(vals, val)
+	}
+
+	r := NewReader(dir, 2)
+	defer r.Close()
+	for n := 0; n < 3; n++ {
+		for i := range ptrs {
+			val, err := r.Get(ptrs[i])
+			if err != nil || !bytes.Equal(val, vals[i]) {
+				t.Error(i, "blob读取错误", err)
+			}
+			r.mu.Lock()
+			if len(r.files) > 2 || r.lru.Len() != len(r.files) {
+				t.Error("打开的文件数超过了限制", len(r.files))
+			}
+			r.mu.Unlock()
+		}
+	}
+	if err := r.Remove(4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Get(ptrs[3]); err == nil {
+		t.Error("删除的文件仍然可以读取")
+	}
+}
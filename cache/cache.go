@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache 多个SSTable共享的LRU块缓存，以(文件编号, 块偏移)作为键
+// 文件编号不会被重复使用，文件关闭之后它的块仍然有效，在文件被删除时用EvictFile删除
+// 容量按字节计算，被固定(Pin)的块不会被淘汰，但是仍然占用容量
+type Cache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	// 只包含未被固定的块，Front为最近使用的块
+	lru list.List
+	// 按文件编号索引的块，EvictFile只需要遍历这个文件的块
+	files  map[uint64]map[uint64]*entry
+	count  int
+	hits   int64
+	misses int64
+}
+
+type blockKey struct {
+	fileNum uint64
+	offset  uint64
+}
+
+type entry struct {
+	key   blockKey
+	value []byte
+	// 固定的次数，为0时才会被淘汰
+	pins int
+	// 在lru中的位置，固定的块为nil
+	elem *list.Element
+}
+
+// Stats 缓存的统计信息
+type Stats struct {
+	Hits     int64
+	Misses   int64
+	Size     int64
+	Capacity int64
+	Count    int
+}
+
+func New(capacity int64) *Cache {
+	return &Cache{
+		capacity: capacity,
+		files:    make(map[uint64]map[uint64]*entry),
+	}
+}
+
+// Get 查找一个块，返回的切片不能被修改
+func (c *Cache) Get(fileNum, offset uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.files[fileNum][offset]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	if e.elem != nil {
+		c.lru.MoveToFront(e.elem)
+	}
+	return e.value, true
+}
+
+// Set 插入一个块，插入后调用者不能再修改value
+func (c *Cache) Set(fileNum, offset uint64, value []byte) {
+	c.set(blockKey{fileNum, offset}, value, false)
+}
+
+// SetPinned 插入一个固定的块，用于索引等常驻的块，每次SetPinned都要对应一次Unpin，全部Unpin之前都不会被淘汰
+// 同一个文件可能被打开多次，每次打开都固定同一个块
+func (c *Cache) SetPinned(fileNum, offset uint64, value []byte) {
+	c.set(blockKey{fileNum, offset}, value, true)
+}
+
+func (c *Cache) set(key blockKey, value []byte, pin bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	blocks := c.files[key.fileNum]
+	if blocks == nil {
+		blocks = make(map[uint64]*entry)
+		c.files[key.fileNum] = blocks
+	}
+	e, ok := blocks[key.offset]
+	if ok {
+		c.size += int64(len(value)) - int64(len(e.value))
+		e.value = value
+	} else {
+		e = &entry{key: key, value: value}
+		blocks[key.offset] = e
+		c.count++
+		c.size += int64(len(value))
+	}
+	if pin {
+		e.pins++
+		if e.elem != nil {
+			c.lru.Remove(e.elem)
+			e.elem = nil
+		}
+	} else if e.elem != nil {
+		c.lru.MoveToFront(e.elem)
+	} else if e.pins == 0 {
+		e.elem = c.lru.PushFront(e)
+	}
+	c.evict()
+}
+
+// Unpin 取消一次块的固定，所有固定都取消之后可以被正常淘汰
+func (c *Cache) Unpin(fileNum, offset uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.files[fileNum][offset]
+	if !ok || e.pins == 0 {
+		return
+	}
+	e.pins--
+	if e.pins == 0 {
+		e.elem = c.lru.PushFront(e)
+		c.evict()
+	}
+}
+
+// EvictFile 删除一个文件的所有块，包括固定的块，在文件被删除时调用
+func (c *Cache) EvictFile(fileNum uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.files[fileNum] {
+		c.remove(e)
+	}
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{
+		Hits:     c.hits,
+		Misses:   c.misses,
+		Size:     c.size,
+		Capacity: c.capacity,
+		Count:    c.count,
+	}
+}
+
+func (c *Cache) remove(e *entry) {
+	if e.elem != nil {
+		c.lru.Remove(e.elem)
+	}
+	blocks := c.files[e.key.fileNum]
+	delete(blocks, e.key.offset)
+	if len(blocks) == 0 {
+		delete(c.files, e.key.fileNum)
+	}
+	c.count--
+	c.size -= int64(len(e.value))
+}
+
+// 从最久未使用的块开始淘汰，直到容量满足要求或者只剩下固定的块
+func (c *Cache) evict() {
+	for c.size > c.capacity && c.lru.Len() > 0 {
+		c.remove(c.lru.Back().Value.(*entry))
+	}
+}
@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCacheGetSet(t *testing.T) {
+	c := New(100)
+	if _, ok := c.Get(1, 0); ok {
+		t.Error("空缓存命中")
+	}
+	c.Set(1, 0, []byte{1, 2, 3})
+	c.Set(2, 0, []byte{4, 5, 6})
+	b, ok := c.Get(1, 0)
+	if !ok || !bytes.Equal(b, []byte{1, 2, 3}) {
+		t.Error("(1, 0)查找错误")
+	}
+	if _, ok = c.Get(1, 3); ok {
+		t.Error("(1, 3)不应该命中")
+	}
+	// 覆盖写入
+	c.Set(1, 0, []byte{7})
+	b, ok = c.Get(1, 0)
+	if !ok || !bytes.Equal(b, []byte{7}) {
+		t.Error("覆盖写入错误")
+	}
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Size != 4 || stats.Count != 2 || stats.Capacity != 100 {
+		t.Error("统计信息错误", stats)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	c := New(30)
+	c.Set(1, 0, make([]byte, 10))
+	c.Set(1, 10, make([]byte, 10))
+	c.Set(1, 20, make([]byte, 10))
+	// 访问(1, 0)使其成为最近使用
+	c.Get(1, 0)
+	c.Set(1, 30, make([]byte, 10))
+	if _, ok := c.Get(1, 10); ok {
+		t.Error("最久未使用的块没有被淘汰")
+	}
+	for _, offset := range []uint64{0, 20, 30} {
+		if _, ok := c.Get(1, offset); !ok {
+			t.Error(offset, "被错误淘汰")
+		}
+	}
+	if c.Stats().Size != 30 {
+		t.Error("容量统计错误", c.Stats().Size)
+	}
+}
+
+func TestCachePin(t *testing.T) {
+	c := New(20)
+	c.SetPinned(1, 0, make([]byte, 15))
+	c.Set(2, 0, make([]byte, 10))
+	if _, ok := c.Get(1, 0); !ok {
+		t.Error("固定的块被淘汰")
+	}
+	if _, ok := c.Get(2, 0); ok {
+		t.Error("超出容量的块没有被淘汰")
+	}
+	// 固定的块超出容量时仍然保留
+	c.SetPinned(1, 15, make([]byte, 15))
+	if _, ok := c.Get(1, 15); !ok {
+		t.Error("固定的块被淘汰")
+	}
+	c.Unpin(1, 0)
+	if _, ok := c.Get(1, 0); ok {
+		t.Error("取消固定后超出容量的块没有被淘汰")
+	}
+	c.Set(2, 0, make([]byte, 1))
+	c.EvictFile(1)
+	if _, ok := c.Get(1, 15); ok {
+		t.Error("EvictFile没有删除固定的块")
+	}
+	if _, ok := c.Get(2, 0); !ok {
+		t.Error("EvictFile删除了其他文件的块")
+	}
+	if c.Stats().Size != 1 {
+		t.Error("容量统计错误", c.Stats().Size)
+	}
+}
+
+func TestCachePinCount(t *testing.T) {
+	c := New(10)
+	// 同一个块被固定两次，两次Unpin之后才能被淘汰
+	c.SetPinned(1, 0, make([]byte, 15))
+	c.SetPinned(1, 0, make([]byte, 15))
+	c.Unpin(1, 0)
+	c.Set(2, 0, make([]byte, 1))
+	if _, ok := c.Get(1, 0); !ok {
+		t.Error("仍被固定的块被淘汰")
+	}
+	c.Unpin(1, 0)
+	if _, ok := c.Get(1, 0); ok {
+		t.Error("取消所有固定后超出容量的块没有被淘汰")
+	}
+	// EvictFile只删除这个文件的块
+	c.Set(2, 0, []byte{1})
+	c.Set(1, 0, []byte{1})
+	c.Set(1, 1, []byte{2})
+	c.EvictFile(1)
+	if _, ok := c.Get(2, 0); !ok {
+		t.Error("EvictFile删除了其他文件的块")
+	}
+	if stats := c.Stats(); stats.Count != 1 || stats.Size != 1 {
+		t.Error("统计信息错误", stats)
+	}
+}
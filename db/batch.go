@@ -0,0 +1,158 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/InsZVA/saver/table"
+)
+
+var errBrokenBatch = errors.New("batch已损坏")
+
+/*
+Batch的编码，同时也是日志中每条记录的格式:
+[seq64][count32]
+[kind8][keyLength32][key...][valLength32][val...]
+...
+seq为第一个操作的序列号，之后的操作依次加1，范围删除的key为Start，value为End
+kind的最高位为1时操作属于非默认的列族，kind之后是[columnFamily32]
+*/
+const batchHeaderSize = 12
+
+const batchColumnFamilyFlag = 0x80
+
+// Batch 一组原子写入的操作，写入时按顺序分配连续的序列号
+type Batch struct {
+	data []byte
+}
+
+func (b *Batch) add(cf uint32, kind table.Kind, key, val []byte) {
+	if len(b.data) == 0 {
+		b.data = make([]byte, batchHeaderSize)
+	}
+	var tmp [4]byte
+	if cf == defaultColumnFamilyID {
+		b.data = append(b.data, byte(kind))
+	} else {
+		binary.LittleEndian.PutUint32(tmp[:], cf)
+		b.data = append(append(b.data, byte(kind)|batchColumnFamilyFlag), tmp[:]...)
+	}
+	binary.LittleEndian.PutUint32(tmp[:], uint32(len(key)))
+	b.data = append(b.data, tmp[:]...)
+	b.data = append(b.data, key...)
+	binary.LittleEndian.PutUint32(tmp[:], uint32(len(val)))
+	b.data = append(b.data, tmp[:]...)
+	b.data = append(b.data, val...)
+	binary.LittleEndian.PutUint32(b.data[8:], binary.LittleEndian.Uint32(b.data[8:])+1)
+}
+
+func (b *Batch) Put(key, val []byte) {
+	b.add(defaultColumnFamilyID, table.KindSet, key, val)
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.add(defaultColumnFamilyID, table.KindDelete, key, nil)
+}
+
+// DeleteRange 删除[start, end)内的所有key
+func (b *Batch) DeleteRange(start, end []byte) {
+	b.add(defaultColumnFamilyID, table.KindRangeDelete, start, end)
+}
+
+// PutWithExpiry 写入key，到expiry时过期
+func (b *Batch) PutWithExpiry(key, val []byte, expiry time.Time) {
+	b.add(defaultColumnFamilyID, table.KindSetWithTTL, key, table.EncodeExpiry(val, expiry))
+}
+
+// PutCFWithExpiry 在列族cf中写入key，到expiry时过期
+func (b *Batch) PutCFWithExpiry(cf *ColumnFamily, key, val []byte, expiry time.Time) {
+	b.add(cf.id, table.KindSetWithTTL, key, table.EncodeExpiry(val, expiry))
+}
+
+// PutCF 在列族cf中写入key
+func (b *Batch) PutCF(cf *ColumnFamily, key, val []byte) {
+	b.add(cf.id, table.KindSet, key, val)
+}
+
+func (b *Batch) DeleteCF(cf *ColumnFamily, key []byte) {
+	b.add(cf.id, table.KindDelete, key, nil)
+}
+
+// DeleteRangeCF 删除列族cf中[start, end)内的所有key
+func (b *Batch) DeleteRangeCF(cf *ColumnFamily, start, end []byte) {
+	b.add(cf.id, table.KindRangeDelete, start, end)
+}
+
+// Count batch中的操作数
+func (b *Batch) Count() int {
+	if len(b.data) < batchHeaderSize {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32(b.data[8:]))
+}
+
+func (b *Batch) Reset() {
+	b.data = b.data[:0]
+}
+
+func (b *Batch) setSeq(seq uint64) {
+	binary.LittleEndian.PutUint64(b.data, seq)
+}
+
+func (b *Batch) seq() uint64 {
+	return binary.LittleEndian.Uint64(b.data)
+}
+
+// batchReader 依次解码batch中的操作
+type batchReader struct {
+	data []byte
+	seq  uint64
+	// 最近一次next返回的操作所属的列族
+	cf uint32
+}
+
+func newBatchReader(data []byte) (*batchReader, error) {
+	if len(data) < batchHeaderSize {
+		return nil, errBrokenBatch
+	}
+	return &batchReader{
+		data: data[batchHeaderSize:],
+		seq:  binary.LittleEndian.Uint64(data),
+	}, nil
+}
+
+// next 返回下一个操作及其序列号，没有更多操作时ok为false
+func (r *batchReader) next() (kind table.Kind, key, val []byte, seq uint64, ok bool, err error) {
+	if len(r.data) == 0 {
+		return 0, nil, nil, 0, false, nil
+	}
+	kind, r.cf, r.data = table.Kind(r.data[0]), defaultColumnFamilyID, r.data[1:]
+	if kind&batchColumnFamilyFlag != 0 {
+		if len(r.data) < 4 {
+			return 0, nil, nil, 0, false, errBrokenBatch
+		}
+		kind &^= batchColumnFamilyFlag
+		r.cf, r.data = binary.LittleEndian.Uint32(r.data), r.data[4:]
+	}
+	if key, r.data, err = decodeBatchSlice(r.data); err != nil {
+		return 0, nil, nil, 0, false, err
+	}
+	if val, r.data, err = decodeBatchSlice(r.data); err != nil {
+		return 0, nil, nil, 0, false, err
+	}
+	seq = r.seq
+	r.seq++
+	return kind, key, val, seq, true, nil
+}
+
+func decodeBatchSlice(b []byte) ([]byte, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, errBrokenBatch
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	if n < 0 || 4+n > len(b) {
+		return nil, nil, errBrokenBatch
+	}
+	return b[4 : 4+n], b[4+n:], nil
+}
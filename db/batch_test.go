@@ -0,0 +1,70 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/InsZVA/saver/table"
+)
+
+func TestBatch(t *testing.T) {
+	b := &Batch{}
+	if b.Count() != 0 {
+		t.Error("空batch的Count错误")
+	}
+	b.Put([]byte("a"), []byte("1"))
+	b.Delete([]byte("b"))
+	b.DeleteRange([]byte("c"), []byte("d"))
+	b.Put([]byte(""), nil)
+	b.DeleteRangeCF(&ColumnFamily{id: 3}, []byte("e"), []byte("f"))
+	b.PutCF(&ColumnFamily{id: 1}, []byte("g"), []byte("2"))
+	if b.Count() != 6 {
+		t.Fatal("Count错误", b.Count())
+	}
+	b.setSeq(100)
+	r, err := newBatchReader(b.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []struct {
+		cf       uint32
+		kind     table.Kind
+		key, val string
+	}{
+		{0, table.KindSet, "a", "1"},
+		{0, table.KindDelete, "b", ""},
+		{0, table.KindRangeDelete, "c", "d"},
+		{0, table.KindSet, "", ""},
+		{3, table.KindRangeDelete, "e", "f"},
+		{1, table.KindSet, "g", "2"},
+	}
+	for i, e := range expect {
+		kind, key, val, seq, ok, err := r.next()
+		if err != nil || !ok {
+			t.Fatal("解码错误", i, err)
+		}
+		if r.cf != e.cf || kind != e.kind || string(key) != e.key || string(val) != e.val || seq != uint64(100+i) {
+			t.Error("解码结果错误", i, r.cf, kind, string(key), string(val), seq)
+		}
+	}
+	if _, _, _, _, ok, err := r.next(); ok || err != nil {
+		t.Error("解码完成之后不应该还有操作", err)
+	}
+
+	if _, err = newBatchReader(b.data[:5]); err != errBrokenBatch {
+		t.Error("损坏的batch没有返回错误", err)
+	}
+	r, _ = newBatchReader(b.data[:len(b.data)-1])
+	for {
+		_, _, _, _, ok, err := r.next()
+		if err == errBrokenBatch {
+			break
+		}
+		if !ok {
+			t.Fatal("截断的batch没有返回错误")
+		}
+	}
+	b.Reset()
+	if b.Count() != 0 {
+		t.Error("Reset之后Count错误")
+	}
+}
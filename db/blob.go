@@ -0,0 +1,255 @@
+package db
+
+import (
+	"os"
+	"sort"
+
+	"github.com/InsZVA/saver/blob"
+	"github.com/InsZVA/saver/sstable"
+	"github.com/InsZVA/saver/table"
+)
+
+// blobGC 一次blob GC：回收的blob文件以及引用它们的SSTable
+type blobGC struct {
+	// 需要回收的blob文件
+	blobs map[uint64]bool
+	// 引用了blobs的文件，以及为它们的新版本分配的文件编号
+	inputs []blobGCInput
+	// 存活的value复制到的新blob文件
+	blobFileNum uint64
+}
+
+type blobGCInput struct {
+	cf      *ColumnFamily
+	level   int
+	meta    *fileMetadata
+	fileNum uint64
+	// 更新指针之后的文件
+	output *fileMetadata
+}
+
+// CollectBlobGarbage 回收blob文件中不再被引用的value占用的空间
+// 仍被引用的value占文件大小的比例低于BlobGCRatio的blob文件中，仍被引用的value复制到一个新的blob文件，
+// 引用它们的SSTable改写指针之后替换原来的文件；旧的blob文件在没有迭代器引用之后删除
+// 执行期间不进行compaction
+func (d *DB) CollectBlobGarbage() error {
+	d.mu.Lock()
+	d.waitForCompaction()
+	if d.closed {
+		d.mu.Unlock()
+		return errDBClosed
+	}
+	if d.bgErr != nil {
+		d.mu.Unlock()
+		return d.bgErr
+	}
+	gc := d.pickBlobGC()
+	if gc == nil {
+		d.mu.Unlock()
+		return nil
+	}
+	d.compacting = true
+	d.mu.Unlock()
+
+	err := d.runBlobGC(gc)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil {
+		err = d.applyBlobGC(gc)
+	}
+	d.deleteObsoleteFiles()
+	d.compacting = false
+	d.compactionCond.Broadcast()
+	d.maybeScheduleCompaction()
+	return err
+}
+
+// pickBlobGC 选出需要回收的blob文件，没有时返回nil，调用时必须持有d.mu
+// 只有当前version中的文件引用的value算作存活，旧version中的文件在释放之后就不再需要它们
+func (d *DB) pickBlobGC() *blobGC {
+	live := make(map[uint64]uint64)
+	for _, cf := range d.vs.familyList() {
+		for _, files := range cf.current.levels {
+			for _, f := range files {
+				for blobNum, size := range f.blobRefs {
+					live[blobNum] += size
+				}
+			}
+		}
+	}
+	gc := &blobGC{blobs: make(map[uint64]bool)}
+	for blobNum, size := range live {
+		info, err := os.Stat(blob.FileName(d.dirname, blobNum))
+		if err != nil || info.Size() == 0 {
+			continue
+		}
+		if float64(size)/float64(info.Size()) < d.opts.BlobGCRatio {
+			gc.blobs[blobNum] = true
+		}
+	}
+	if len(gc.blobs) == 0 {
+		return nil
+	}
+	for _, cf := range d.vs.familyList() {
+		for level, files := range cf.current.levels {
+			for _, f := range files {
+				for blobNum := range f.blobRefs {
+					if gc.blobs[blobNum] {
+						gc.inputs = append(gc.inputs, blobGCInput{cf: cf, level: level, meta: f, fileNum: d.vs.newFileNum()})
+						break
+					}
+				}
+			}
+		}
+	}
+	gc.blobFileNum = d.vs.newFileNum()
+	return gc
+}
+
+// runBlobGC 复制存活的value并改写引用它们的文件，不持有d.mu，失败时删除创建的文件
+func (d *DB) runBlobGC(gc *blobGC) error {
+	err := d.rewriteBlobs(gc)
+	if err != nil {
+		os.Remove(blob.FileName(d.dirname, gc.blobFileNum))
+		for _, in := range gc.inputs {
+			d.tc.Evict(in.fileNum)
+			os.Remove(sstable.TableFileName(d.dirname, in.fileNum))
+		}
+	}
+	return err
+}
+
+func (d *DB) rewriteBlobs(gc *blobGC) error {
+	// 当前version中的文件指向的value都是存活的，包括为快照保留的旧版本
+	livePointers := make(map[blob.Pointer]bool)
+	for _, in := range gc.inputs {
+		if err := d.collectPointers(in.meta.fileNum, gc.blobs, livePointers); err != nil {
+			return err
+		}
+	}
+	dst, err := blob.Create(d.dirname, gc.blobFileNum)
+	if err != nil {
+		return err
+	}
+	blobNums := make([]uint64, 0, len(gc.blobs))
+	for blobNum := range gc.blobs {
+		blobNums = append(blobNums, blobNum)
+	}
+	sort.Slice(blobNums, func(i, j int) bool {
+		return blobNums[i] < blobNums[j]
+	})
+	remap := make(map[blob.Pointer]blob.Pointer)
+	for _, blobNum := range blobNums {
+		var m map[blob.Pointer]blob.Pointer
+		m, err = d.blobs.Collect(blobNum, dst, func(key []byte, p blob.Pointer) (bool, error) {
+			return livePointers[p], nil
+		})
+		if err != nil {
+			break
+		}
+		for old, p := range m {
+			remap[old] = p
+		}
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	for i := range gc.inputs {
+		in := &gc.inputs[i]
+		if in.output, err = d.rewriteBlobPointers(in, remap); err != nil {
+			return err
+		}
+	}
+	return syncDir(d.dirname)
+}
+
+// collectPointers 把文件中指向blobs的指针加入live
+func (d *DB) collectPointers(fileNum uint64, blobs map[uint64]bool, live map[blob.Pointer]bool) error {
+	h, err := d.tc.Acquire(fileNum)
+	if err != nil {
+		return err
+	}
+	defer h.Release()
+	it := h.Reader().NewIterator(&sstable.IterOptions{KeepCovered: true})
+	for it.First(); it.Valid(); it.Next() {
+		if it.Key().Kind() != table.KindBlobIndex {
+			continue
+		}
+		p, err := blob.DecodePointer(it.RawValue())
+		if err != nil {
+			it.Close()
+			return err
+		}
+		if blobs[p.FileNum] {
+			live[p] = true
+		}
+	}
+	return it.Close()
+}
+
+// rewriteBlobPointers 按remap改写in.meta中的指针，写入编号为in.fileNum的新文件
+func (d *DB) rewriteBlobPointers(in *blobGCInput, remap map[blob.Pointer]blob.Pointer) (*fileMetadata, error) {
+	h, err := d.tc.Acquire(in.meta.fileNum)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Release()
+	sst, err := sstable.CreateSSTable(sstable.TableFileName(d.dirname, in.fileNum))
+	if err != nil {
+		return nil, err
+	}
+	err = h.Reader().RewriteBlobPointers(sst.NewWriterWithOptions(in.cf.opts.writerOptions()), remap)
+	if err == nil {
+		err = sst.Sync()
+	}
+	if cerr := sst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.tableMeta(in.fileNum)
+}
+
+// applyBlobGC 每个列族用改写之后的文件替换原来的文件，调用时必须持有d.mu
+// 执行期间被删除的列族以及没有生效的edit的输出直接删除，没有任何edit生效时新的blob文件也删除
+func (d *DB) applyBlobGC(gc *blobGC) error {
+	edits := make(map[*ColumnFamily]*versionEdit)
+	var families []*ColumnFamily
+	for _, in := range gc.inputs {
+		edit := edits[in.cf]
+		if edit == nil {
+			edit = &versionEdit{cf: in.cf.id}
+			edits[in.cf] = edit
+			families = append(families, in.cf)
+		}
+		edit.deleteFile(in.level, in.meta.fileNum)
+		edit.addFile(in.level, in.output)
+	}
+	applied := false
+	var err error
+	for _, cf := range families {
+		if err == nil && !cf.dropped {
+			if err = d.vs.logAndApply(edits[cf]); err == nil {
+				applied = true
+				continue
+			}
+			d.bgErr = err
+		}
+		for _, nf := range edits[cf].added {
+			d.tc.Evict(nf.meta.fileNum)
+			os.Remove(sstable.TableFileName(d.dirname, nf.meta.fileNum))
+		}
+	}
+	if !applied {
+		os.Remove(blob.FileName(d.dirname, gc.blobFileNum))
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/InsZVA/saver/blob"
+)
+
+func blobFiles(t *testing.T, dirname string) []string {
+	names, err := filepath.Glob(filepath.Join(dirname, "*.blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestBlobGC(t *testing.T) {
+	dirname := "/tmp/saver_db_blob"
+	opts := &Options{L0CompactionTrigger: 2, BlobThreshold: 100}
+	d := openTestDB(t, dirname, opts)
+
+	key := func(i int) string {
+		return fmt.Sprintf("key%02d", i)
+	}
+	value := func(i, round int) string {
+		return fmt.Sprintf("%d-%d", i, round) + string(bytes.Repeat([]byte{'v'}, 1024))
+	}
+	check := func(round func(i int) int) {
+		for i := 0; i < 20; i++ {
+			expectGet(t, d, key(i), value(i, round(i)), true)
+		}
+		it, err := d.NewIterator(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for it.First(); it.Valid(); it.Next() {
+			if string(it.Key()) != key(n) || string(it.Value()) != value(n, round(n)) {
+				t.Errorf("迭代器第%d条错误: %s", n, it.Key())
+			}
+			n++
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n != 20 {
+			t.Errorf("迭代器返回了%d条，应该为20", n)
+		}
+	}
+	first := func(i int) int { return 0 }
+	latest := func(i int) int {
+		if i < 18 {
+			return 1
+		}
+		return 0
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := d.Put([]byte(key(i)), []byte(value(i, 0))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(blobFiles(t, dirname)); n != 1 {
+		t.Fatalf("flush之后有%d个blob文件，应该为1", n)
+	}
+	check(first)
+
+	// 第二次flush触发compaction，旧版本被丢弃，指针原样复制，不产生新的blob文件
+	for i := 0; i < 18; i++ {
+		if err := d.Put([]byte(key(i)), []byte(value(i, 1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	d.waitForCompaction()
+	if n := len(d.defaultCF.current.levels[0]); n != 0 {
+		t.Errorf("L0没有被compact: %d", n)
+	}
+	d.mu.Unlock()
+	before := blobFiles(t, dirname)
+	if len(before) != 2 {
+		t.Fatalf("compaction之后有%d个blob文件，应该为2", len(before))
+	}
+	check(latest)
+
+	// 第一个blob文件只有2个value仍被引用，GC之后在迭代器关闭之前仍然保留
+	it, err := d.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CollectBlobGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(before[0]); err != nil {
+		t.Error("迭代器引用的blob文件被删除了", err)
+	}
+	n := 0
+	for it.First(); it.Valid(); it.Next() {
+		if string(it.Value()) != value(n, latest(n)) {
+			t.Errorf("GC之后迭代器第%d条错误", n)
+		}
+		n++
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(before[0]); !os.IsNotExist(err) {
+		t.Error("回收的blob文件没有被删除", err)
+	}
+	if after := blobFiles(t, dirname); len(after) != 2 || after[0] != before[1] {
+		t.Errorf("GC之后的blob文件错误: %v", after)
+	}
+	check(latest)
+	// 没有可以回收的文件时什么都不做
+	if err := d.CollectBlobGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if after := blobFiles(t, dirname); len(after) != 2 {
+		t.Errorf("第二次GC之后的blob文件错误: %v", after)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开之后仍然能读到value，没有被引用的blob文件被删除
+	orphan := blob.FileName(dirname, 999999)
+	if err := ioutil.WriteFile(orphan, []byte("orphan"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err = Open(dirname, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	check(latest)
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("没有被引用的blob文件没有被删除", err)
+	}
+}
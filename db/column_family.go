@@ -0,0 +1,180 @@
+package db
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/InsZVA/saver/table"
+)
+
+var (
+	errColumnFamilyName    = errors.New("列族名不能为空")
+	errColumnFamilyExists  = errors.New("列族已经存在")
+	errColumnFamilyDropped = errors.New("列族已经被删除")
+	errColumnFamilyDB      = errors.New("列族不属于这个数据库")
+	errDropDefaultFamily   = errors.New("不能删除默认列族")
+)
+
+// DefaultColumnFamilyName 默认列族的名字，不指定列族的读写都使用默认列族
+const DefaultColumnFamilyName = "default"
+
+const defaultColumnFamilyID = 0
+
+// ColumnFamily 列族：数据库中一个独立的key空间，有自己的内存表、level树和选项
+// 所有列族共用一个日志、文件编号和序列号，一个batch可以原子地写入多个列族
+type ColumnFamily struct {
+	id   uint32
+	name string
+	opts Options
+
+	// 以下字段由DB.mu保护
+	mem *table.SkipList
+	// mem的大小
+	memSize int
+	// 比logNum老的日志中这个列族的记录都已经写入了SSTable
+	logNum  uint64
+	current *version
+	// 每层下一次compaction开始的位置，依次轮流compact每层的所有文件
+	compactPointer [numLevels][]byte
+	dropped        bool
+}
+
+func newColumnFamily(id uint32, name string) *ColumnFamily {
+	return &ColumnFamily{
+		id:      id,
+		name:    name,
+		mem:     table.NewSkipList(),
+		current: &version{},
+	}
+}
+
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+func (cf *ColumnFamily) memEmpty() bool {
+	return memTableEmpty(cf.mem)
+}
+
+// resetMem 内存表写入L0之后换成空的内存表
+func (cf *ColumnFamily) resetMem() {
+	cf.mem, cf.memSize = table.NewSkipList(), 0
+}
+
+// familyList 所有的列族，按编号排列
+func (vs *versionSet) familyList() []*ColumnFamily {
+	families := make([]*ColumnFamily, 0, len(vs.families))
+	for _, cf := range vs.families {
+		families = append(families, cf)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].id < families[j].id
+	})
+	return families
+}
+
+func (vs *versionSet) familyByName(name string) *ColumnFamily {
+	for _, cf := range vs.families {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+// minLogNum 所有列族中最小的logNum，更老的日志都不再需要
+func (vs *versionSet) minLogNum() uint64 {
+	var min uint64
+	for _, cf := range vs.families {
+		if min == 0 || cf.logNum < min {
+			min = cf.logNum
+		}
+	}
+	return min
+}
+
+// DefaultColumnFamily 默认列族，不能被删除
+func (d *DB) DefaultColumnFamily() *ColumnFamily {
+	return d.defaultCF
+}
+
+// ColumnFamily 按名字查找列族，不存在时返回nil
+func (d *DB) ColumnFamily(name string) *ColumnFamily {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.vs.familyByName(name)
+}
+
+// CreateColumnFamily 创建一个新的列族，opts为nil时使用数据库的选项
+// 列族的选项不记录在MANIFEST中，重新打开数据库时通过Options.ColumnFamilyOptions指定
+func (d *DB) CreateColumnFamily(name string, opts *Options) (*ColumnFamily, error) {
+	if name == "" {
+		return nil, errColumnFamilyName
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, errDBClosed
+	}
+	if d.bgErr != nil {
+		return nil, d.bgErr
+	}
+	if d.vs.familyByName(name) != nil {
+		return nil, errColumnFamilyExists
+	}
+	// 编号不重复使用，已删除的列族在日志中遗留的记录不会被当作新列族的记录
+	edit := &versionEdit{cf: d.vs.maxColumnFamily + 1, newFamily: name}
+	// 之前的日志中没有这个列族的记录
+	edit.setLogNum(d.logNum)
+	if err := d.vs.logAndApply(edit); err != nil {
+		return nil, err
+	}
+	cf := d.vs.families[edit.cf]
+	cf.opts = d.familyOptions(opts)
+	return cf, nil
+}
+
+// familyOptions 列族使用的选项，opts为nil时使用数据库的选项
+func (d *DB) familyOptions(opts *Options) Options {
+	if opts == nil {
+		return d.opts
+	}
+	return opts.withDefaults()
+}
+
+// DropColumnFamily 删除列族及其所有数据，之后不能再用cf读写
+// 已经创建的迭代器仍然可以读取，列族的文件在迭代器和快照释放之后删除
+func (d *DB) DropColumnFamily(cf *ColumnFamily) error {
+	if cf.id == defaultColumnFamilyID {
+		return errDropDefaultFamily
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.checkFamily(cf); err != nil {
+		return err
+	}
+	if d.bgErr != nil {
+		return d.bgErr
+	}
+	edit := &versionEdit{cf: cf.id, dropFamily: true}
+	if err := d.vs.logAndApply(edit); err != nil {
+		return err
+	}
+	d.deleteObsoleteFiles()
+	d.deleteObsoleteLogs()
+	return nil
+}
+
+// checkFamily 检查cf可以读写，调用时必须持有d.mu
+func (d *DB) checkFamily(cf *ColumnFamily) error {
+	if d.closed {
+		return errDBClosed
+	}
+	if cf.dropped {
+		return errColumnFamilyDropped
+	}
+	if d.vs.families[cf.id] != cf {
+		return errColumnFamilyDB
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/InsZVA/saver/sstable"
+)
+
+func expectGetCF(t *testing.T, d *DB, cf *ColumnFamily, key string, val string, found bool) {
+	v, ok, err := d.GetCF(cf, []byte(key), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != found || (ok && string(v) != val) {
+		t.Errorf("%s中Get(%s)错误: %s %v，应该为%s %v", cf.Name(), key, v, ok, val, found)
+	}
+}
+
+// logFiles 目录中日志文件的编号
+func logFiles(t *testing.T, dirname string) []uint64 {
+	infos, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nums []uint64
+	for _, info := range infos {
+		var num uint64
+		if parseFileName(info.Name(), "%06d.log", &num) {
+			nums = append(nums, num)
+		}
+	}
+	return nums
+}
+
+func TestColumnFamilies(t *testing.T) {
+	dirname := "/tmp/saver_db_cf"
+	d := openTestDB(t, dirname, &Options{L0CompactionTrigger: 100})
+	defer func() { d.Close() }()
+	if d.DefaultColumnFamily().Name() != DefaultColumnFamilyName || d.ColumnFamily(DefaultColumnFamilyName) != d.DefaultColumnFamily() {
+		t.Fatal("默认列族错误")
+	}
+	usersOpts := &Options{CompactionStyle: CompactionStyleUniversal, BlockSize: 512}
+	users, err := d.CreateColumnFamily("users", usersOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateColumnFamily("users", nil); err != errColumnFamilyExists {
+		t.Error("重复创建列族应该失败", err)
+	}
+	if _, err := d.CreateColumnFamily("", nil); err != errColumnFamilyName {
+		t.Error("列族名不能为空", err)
+	}
+	if d.ColumnFamily("users") != users || d.ColumnFamily("none") != nil {
+		t.Error("按名字查找列族错误")
+	}
+
+	// 一个batch原子地写入多个列族，同一个key在不同的列族中互不影响
+	b := &Batch{}
+	b.Put([]byte("a"), []byte("default"))
+	b.PutCF(users, []byte("a"), []byte("users"))
+	b.PutCF(users, []byte("b"), []byte("users"))
+	if err := d.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	d.DeleteCF(users, []byte("b"))
+	d.PutCF(users, []byte("c"), []byte("users"))
+	expectGet(t, d, "a", "default", true)
+	expectGet(t, d, "c", "", false)
+	expectGetCF(t, d, users, "a", "users", true)
+	expectGetCF(t, d, users, "b", "", false)
+	it, err := d.NewIteratorCF(users, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectScan(t, it, []string{"a", "c"}, map[string]string{"a": "users", "c": "users"})
+	it.Close()
+
+	// 只flush一个列族时，其他列族的记录还在之前的日志中，日志不能删除
+	logs := logFiles(t, dirname)
+	if err := d.FlushCF(users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users.current.levels[0]) != 1 || len(d.defaultCF.current.levels[0]) != 0 {
+		t.Fatal("只应该flush users")
+	}
+	if got := logFiles(t, dirname); len(got) != 2 || got[0] != logs[0] {
+		t.Error("默认列族还需要之前的日志", logs, got)
+	}
+	if err := d.DeleteRangeCF(users, []byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	expectGetCF(t, d, users, "a", "", false)
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := logFiles(t, dirname); len(got) != 1 || got[0] == logs[0] {
+		t.Error("所有列族flush之后旧的日志应该被删除", got)
+	}
+	// users的文件使用列族自己的块大小，同样的数据分成更多的块，索引更大
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		d.Put(key, key)
+		d.PutCF(users, key, key)
+	}
+	d.Flush()
+	indexSize := func(cf *ColumnFamily) uint64 {
+		h, err := d.tc.Acquire(cf.current.levels[0][0].fileNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Release()
+		return h.Reader().Properties().IndexSize
+	}
+	if small, large := indexSize(users), indexSize(d.defaultCF); small <= large {
+		t.Error("列族的块大小没有生效", small, large)
+	}
+
+	// 重新打开之后列族和数据都在，选项通过ColumnFamilyOptions指定
+	d.PutCF(users, []byte("d"), []byte("log"))
+	d.Close()
+	d, err = Open(dirname, &Options{ColumnFamilyOptions: map[string]*Options{"users": usersOpts}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users = d.ColumnFamily("users")
+	if users == nil || users.opts.CompactionStyle != CompactionStyleUniversal || users.opts.BlockSize != 512 {
+		t.Fatal("重新打开之后列族错误", users)
+	}
+	if d.defaultCF.opts.CompactionStyle != CompactionStyleLeveled {
+		t.Error("默认列族的选项错误")
+	}
+	expectGet(t, d, "a", "default", true)
+	expectGetCF(t, d, users, "a", "", false)
+	expectGetCF(t, d, users, "c", "users", true)
+	expectGetCF(t, d, users, "d", "log", true)
+}
+
+func TestDropColumnFamily(t *testing.T) {
+	dirname := "/tmp/saver_db_cf_drop"
+	d := openTestDB(t, dirname, nil)
+	defer func() { d.Close() }()
+	if err := d.DropColumnFamily(d.DefaultColumnFamily()); err != errDropDefaultFamily {
+		t.Error("不能删除默认列族", err)
+	}
+	cf, _ := d.CreateColumnFamily("tmp", nil)
+	d.PutCF(cf, []byte("a"), []byte("1"))
+	d.FlushCF(cf)
+	d.PutCF(cf, []byte("b"), []byte("2"))
+	d.Put([]byte("a"), []byte("default"))
+	fileNum := cf.current.levels[0][0].fileNum
+	it, err := d.NewIteratorCF(cf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.DropColumnFamily(cf); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DropColumnFamily(cf); err != errColumnFamilyDropped {
+		t.Error("重复删除应该失败", err)
+	}
+	if err := d.PutCF(cf, []byte("a"), nil); err != errColumnFamilyDropped {
+		t.Error("删除之后不能写入", err)
+	}
+	if _, _, err := d.GetCF(cf, []byte("a"), nil); err != errColumnFamilyDropped {
+		t.Error("删除之后不能读取", err)
+	}
+	// 删除之前创建的迭代器仍然可以读取
+	expectScan(t, it, []string{"a", "b"}, map[string]string{"a": "1", "b": "2"})
+	path := sstable.TableFileName(dirname, fileNum)
+	if _, err := os.Stat(path); err != nil {
+		t.Error("迭代器释放之前文件不能删除", err)
+	}
+	it.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("被删除的列族的文件没有删除", err)
+	}
+
+	// 同名的新列族使用新的编号，日志中被删除的列族的记录不会恢复到新列族中
+	d.Close()
+	if d, err = Open(dirname, nil); err != nil {
+		t.Fatal(err)
+	}
+	if d.ColumnFamily("tmp") != nil {
+		t.Fatal("重新打开之后被删除的列族还在")
+	}
+	cf2, err := d.CreateColumnFamily("tmp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf2.id <= cf.id {
+		t.Error("列族编号被重复使用", cf2.id, cf.id)
+	}
+	expectGetCF(t, d, cf2, "b", "", false)
+	expectGet(t, d, "a", "default", true)
+}
+
+func TestColumnFamilyRecover(t *testing.T) {
+	dirname := "/tmp/saver_db_cf_recover"
+	d := openTestDB(t, dirname, &Options{MaxManifestFileSize: 1})
+	defer d.Close()
+	a, _ := d.CreateColumnFamily("a", nil)
+	c, _ := d.CreateColumnFamily("c", nil)
+	d.PutCF(a, []byte("k"), []byte("a1"))
+	d.PutCF(c, []byte("k"), []byte("c1"))
+	d.FlushCF(a)
+	// a的新记录在新的日志中，c的记录在旧的日志中
+	d.PutCF(a, []byte("k"), []byte("a2"))
+	d.DeleteCF(a, []byte("x"))
+	d.Put([]byte("k"), []byte("default"))
+
+	crash := dirname + "_crash"
+	crashCopy(t, dirname, crash)
+	d2, err := Open(crash, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+	a2, c2 := d2.ColumnFamily("a"), d2.ColumnFamily("c")
+	if a2 == nil || c2 == nil {
+		t.Fatal("恢复之后列族丢失")
+	}
+	expectGetCF(t, d2, a2, "k", "a2", true)
+	expectGetCF(t, d2, c2, "k", "c1", true)
+	expectGet(t, d2, "k", "default", true)
+	// 恢复的记录都已经写入SSTable，只剩下新的日志
+	if logs := logFiles(t, crash); len(logs) != 1 {
+		t.Error("恢复之后旧的日志没有删除", logs)
+	}
+	if _, err := os.Stat(filepath.Join(crash, currentFileName)); err != nil {
+		t.Fatal(err)
+	}
+}
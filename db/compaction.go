@@ -0,0 +1,441 @@
+package db
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/InsZVA/saver/blob"
+	"github.com/InsZVA/saver/sstable"
+	"github.com/InsZVA/saver/table"
+)
+
+// compaction 把列族cf的level中的inputs[0]与outputLevel中重叠的inputs[1]合并，输出到outputLevel
+type compaction struct {
+	cf          *ColumnFamily
+	level       int
+	outputLevel int
+	inputs      [2][]*fileMetadata
+	// 选出compaction时的version，用于判断输出层之下是否还有数据
+	version *version
+	// 选出compaction时没有释放的快照，之后创建的快照比输入文件中所有的记录都新
+	snapshots snapshotList
+	// compaction新写入的blob文件，没有时为0
+	blobFileNum uint64
+}
+
+// keyRange 文件中最小和最大的key
+func keyRange(files []*fileMetadata) ([]byte, []byte) {
+	var start, end []byte
+	for i, f := range files {
+		if i == 0 || bytes.Compare(f.smallest.Key(), start) < 0 {
+			start = f.smallest.Key()
+		}
+		if i == 0 || bytes.Compare(f.largest.Key(), end) > 0 {
+			end = f.largest.Key()
+		}
+	}
+	return start, end
+}
+
+// pickCompaction 按编号依次检查每个列族，选出第一个需要的compaction，没有需要compact的文件时返回nil
+// 调用时必须持有d.mu
+func (d *DB) pickCompaction() *compaction {
+	for _, cf := range d.vs.familyList() {
+		if c := cf.pickCompaction(); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// pickCompaction 按列族的CompactionStyle选出下一次compaction
+func (cf *ColumnFamily) pickCompaction() *compaction {
+	var c *compaction
+	if cf.opts.CompactionStyle == CompactionStyleUniversal {
+		c = cf.pickUniversalCompaction()
+	} else {
+		c = cf.pickLeveledCompaction()
+	}
+	if c != nil {
+		c.cf = cf
+	}
+	return c
+}
+
+// pickLeveledCompaction L0按文件数和总大小、其他层按目标大小计算得分，选出得分最高并且不小于1的层
+// 没有需要compact的层时返回nil
+func (cf *ColumnFamily) pickLeveledCompaction() *compaction {
+	v := cf.current
+	bestLevel, bestScore := -1, 1.0
+	score := float64(len(v.levels[0])) / float64(cf.opts.L0CompactionTrigger)
+	if s := float64(v.levelSize(0)) / float64(cf.opts.L0MaxSize); s > score {
+		score = s
+	}
+	if score >= bestScore {
+		bestLevel, bestScore = 0, score
+	}
+	// 最后一层没有下一层，不需要compact
+	for level := 1; level < numLevels-1; level++ {
+		score := float64(v.levelSize(level)) / float64(cf.opts.levelMaxSize(level))
+		if score >= bestScore {
+			bestLevel, bestScore = level, score
+		}
+	}
+	if bestLevel < 0 {
+		return nil
+	}
+	c := &compaction{level: bestLevel, outputLevel: bestLevel + 1, version: v}
+	if bestLevel == 0 {
+		// L0的文件互相重叠，全部一起compact
+		c.inputs[0] = append([]*fileMetadata(nil), v.levels[0]...)
+	} else {
+		// 从上次compaction结束的位置之后的第一个文件开始
+		files := v.levels[bestLevel]
+		f := files[0]
+		if ptr := cf.compactPointer[bestLevel]; ptr != nil {
+			for _, ff := range files {
+				if bytes.Compare(ff.smallest.Key(), ptr) > 0 {
+					f = ff
+					break
+				}
+			}
+		}
+		c.inputs[0] = []*fileMetadata{f}
+	}
+	start, end := keyRange(c.inputs[0])
+	c.inputs[1] = v.overlaps(c.outputLevel, start, end)
+	return c
+}
+
+// isBottommost 输出层之下没有与[start, end]重叠的文件，删除标记可以直接丢弃
+// 输出到L0时还要检查L0中没有参与compaction的文件
+func (c *compaction) isBottommost(start, end []byte) bool {
+	if c.outputLevel == 0 {
+		for _, f := range c.version.overlaps(0, start, end) {
+			if !c.isInput(f) {
+				return false
+			}
+		}
+	}
+	for level := c.outputLevel + 1; level < numLevels; level++ {
+		if len(c.version.overlaps(level, start, end)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *compaction) isInput(f *fileMetadata) bool {
+	for _, files := range c.inputs {
+		for _, ff := range files {
+			if ff == f {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runCompaction 执行compaction，返回需要应用的versionEdit，不持有d.mu
+func (d *DB) runCompaction(c *compaction) (*versionEdit, error) {
+	edit := &versionEdit{cf: c.cf.id}
+	for i, files := range c.inputs {
+		for _, f := range files {
+			edit.deleteFile(c.level+i, f.fileNum)
+		}
+	}
+	// 只有一个文件并且与下一层不重叠时直接移动到下一层
+	if c.outputLevel != c.level && len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 {
+		edit.addFile(c.outputLevel, c.inputs[0][0])
+		return edit, nil
+	}
+
+	var iters []internalIterator
+	var tombs []table.RangeTombstone
+	for _, files := range c.inputs {
+		for _, f := range files {
+			h, err := d.tc.Acquire(f.fileNum)
+			if err != nil {
+				for _, it := range iters {
+					it.Close()
+				}
+				return nil, err
+			}
+			defer h.Release()
+			iters = append(iters, h.Reader().NewIterator(&sstable.IterOptions{KeepCovered: true}))
+			tombs = append(tombs, h.Reader().RangeTombstones()...)
+		}
+	}
+	out := &compactionOutput{
+		d:         d,
+		c:         c,
+		rangeDels: table.FragmentRangeTombstones(tombs),
+		now:       d.now(),
+	}
+	start, end := keyRange(append(append([]*fileMetadata(nil), c.inputs[0]...), c.inputs[1]...))
+	out.bottommost = c.isBottommost(start, end)
+	err := d.finishBlobWriter(out.blob, out.merge(newMergingIterator(iters...)))
+	if err != nil {
+		out.abandon()
+		return nil, err
+	}
+	if out.blob != nil && out.blob.Size() > 0 {
+		c.blobFileNum = out.blob.FileNum()
+	}
+	// 输出的文件在目录中的项同步之后才能写入MANIFEST
+	if err = syncDir(d.dirname); err != nil {
+		out.abandon()
+		if c.blobFileNum != 0 {
+			os.Remove(blob.FileName(d.dirname, c.blobFileNum))
+		}
+		return nil, err
+	}
+	for _, f := range out.files {
+		edit.addFile(c.outputLevel, f)
+	}
+	return edit, nil
+}
+
+// compactionOutput 把合并之后的记录写入按TargetFileSize切分的多个文件
+type compactionOutput struct {
+	d         *DB
+	c         *compaction
+	rangeDels table.RangeTombstones
+	// 开始compaction时的时间，unix纳秒，用于判断记录是否过期
+	now int64
+	// 输出层之下没有与所有输入文件重叠的数据，传给CompactionFilter
+	bottommost bool
+	sst        *sstable.SSTable
+	w          *sstable.Writer
+	fileNum    uint64
+	// 所有输出文件共用的blob文件，在打开第一个输出文件时创建
+	blob *blob.Writer
+	// 当前文件的下界（包含），第一个文件没有下界
+	lower []byte
+	// 最近写入的user key
+	lastKey []byte
+	files   []*fileMetadata
+	// 创建过的所有文件，失败时删除
+	created []uint64
+}
+
+// merge 每个user key保留最新的版本以及每个快照能看到的版本，丢弃被范围删除标记覆盖的记录，
+// 以及最底层中没有更老的快照需要的删除标记
+// 过期的记录和被CompactionFilter删除的记录换成删除标记，继续遮盖更老的版本，在最底层时直接丢弃
+// 已经分离到blob文件中的value只复制指针
+func (o *compactionOutput) merge(it *mergingIterator) error {
+	gc := versionGC{snapshots: o.c.snapshots, tombs: o.rangeDels}
+	for it.First(); it.Valid(); it.Next() {
+		k := it.Key()
+		if gc.drop(k) {
+			continue
+		}
+		val := it.RawValue()
+		if table.Expired(k.Kind(), val, o.now) {
+			k, val = table.NewInternalKey(k.Key(), k.Seq(), table.KindDelete), nil
+		}
+		// 快照能看到的版本不能被改写
+		if gc.newest && o.c.snapshots.stripe(k.Seq()) == table.MaxSeq {
+			var err error
+			if k, val, err = o.filter(k, val); err != nil {
+				it.Close()
+				return err
+			}
+		}
+		if k.Kind() == table.KindDelete && o.c.snapshots.earliest(k.Seq()) && o.c.isBottommost(k.Key(), k.Key()) {
+			continue
+		}
+		if err := o.add(k, val); err != nil {
+			it.Close()
+			return err
+		}
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+	return o.finish()
+}
+
+func (o *compactionOutput) add(k table.Key, val []byte) error {
+	// L0中每个文件都是一个sorted run，输出到L0时不切分
+	// 同一层的文件按user key互不重叠，一个key的所有版本必须在同一个文件中
+	if o.w != nil && o.c.outputLevel > 0 && o.w.EstimatedSize() >= o.c.cf.opts.TargetFileSize &&
+		!bytes.Equal(k.Key(), o.lastKey) {
+		if err := o.finishFile(k.Key()); err != nil {
+			return err
+		}
+	}
+	if o.w == nil {
+		if err := o.openFile(); err != nil {
+			return err
+		}
+	}
+	o.lastKey = append(o.lastKey[:0], k.Key()...)
+	return o.w.Write(k, val)
+}
+
+func (o *compactionOutput) openFile() error {
+	var err error
+	o.d.mu.Lock()
+	o.fileNum = o.d.vs.newFileNum()
+	if o.blob == nil {
+		o.blob, err = o.d.newBlobWriter(o.c.cf)
+	}
+	o.d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	o.created = append(o.created, o.fileNum)
+	sst, err := sstable.CreateSSTable(sstable.TableFileName(o.d.dirname, o.fileNum))
+	if err != nil {
+		return err
+	}
+	o.sst = sst
+	opts := o.c.cf.opts.writerOptions()
+	opts.BlobWriter = o.blob
+	o.w = sst.NewWriterWithOptions(opts)
+	return nil
+}
+
+// finishFile 写入范围删除标记并结束当前文件，upper为下一个文件的第一个key，最后一个文件为nil
+// 范围删除标记被裁剪到[lower, upper)之内，保证同一层的文件互不重叠
+func (o *compactionOutput) finishFile(upper []byte) error {
+	for _, t := range o.rangeDels {
+		if o.lower != nil && bytes.Compare(t.Start, o.lower) < 0 {
+			t.Start = o.lower
+		}
+		if upper != nil && bytes.Compare(t.End, upper) > 0 {
+			t.End = upper
+		}
+		// 最底层的范围删除标记只在没有更老的快照时丢弃，否则它仍然要遮盖为快照保留的旧版本
+		if bytes.Compare(t.Start, t.End) >= 0 || (o.c.snapshots.earliest(t.Seq) && o.c.isBottommost(t.Start, t.End)) {
+			continue
+		}
+		if err := o.w.AddRangeTombstone(t); err != nil {
+			return err
+		}
+	}
+	err := o.w.Done()
+	if err == nil {
+		err = o.sst.Sync()
+	}
+	if cerr := o.sst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	meta, err := o.d.tableMeta(o.fileNum)
+	if err != nil {
+		return err
+	}
+	if meta != nil {
+		o.files = append(o.files, meta)
+	}
+	o.lower, o.w, o.sst = upper, nil, nil
+	return nil
+}
+
+func (o *compactionOutput) finish() error {
+	if o.w == nil && len(o.rangeDels) > 0 {
+		// 没有记录时范围删除标记也需要保留，空文件会被tableMeta删除
+		if err := o.openFile(); err != nil {
+			return err
+		}
+	}
+	if o.w == nil {
+		return nil
+	}
+	return o.finishFile(nil)
+}
+
+// abandon 删除失败的compaction创建的文件
+func (o *compactionOutput) abandon() {
+	if o.sst != nil {
+		o.sst.Close()
+	}
+	for _, fileNum := range o.created {
+		o.d.tc.Evict(fileNum)
+		os.Remove(sstable.TableFileName(o.d.dirname, fileNum))
+	}
+}
+
+// maybeScheduleCompaction 需要时在后台开始一次compaction，同一时间最多只有一个，调用时必须持有d.mu
+func (d *DB) maybeScheduleCompaction() {
+	if d.closed || d.compacting || d.ingesting || d.bgErr != nil {
+		return
+	}
+	c := d.pickCompaction()
+	if c == nil {
+		return
+	}
+	d.compacting = true
+	d.vs.ref(c.version)
+	c.snapshots = d.snapshotList()
+	go d.compact(c)
+}
+
+func (d *DB) compact(c *compaction) {
+	edit, err := d.runCompaction(c)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.vs.unref(c.version)
+	if err == nil && c.cf.dropped {
+		// 列族在compaction期间被删除，输出的文件不再需要
+		d.removeOutputs(c, edit)
+	} else if err == nil {
+		if err = d.vs.logAndApply(edit); err != nil {
+			d.removeOutputs(c, edit)
+		}
+	}
+	if err != nil {
+		d.bgErr = err
+	} else if c.level > 0 {
+		_, c.cf.compactPointer[c.level] = keyRange(c.inputs[0])
+	}
+	d.deleteObsoleteFiles()
+	d.compacting = false
+	d.compactionCond.Broadcast()
+	d.maybeScheduleCompaction()
+}
+
+// removeOutputs 删除没有生效的compaction输出的文件以及新写入的blob文件，调用时必须持有d.mu
+func (d *DB) removeOutputs(c *compaction, edit *versionEdit) {
+	for _, nf := range edit.added {
+		if !c.isInput(nf.meta) {
+			d.tc.Evict(nf.meta.fileNum)
+			os.Remove(sstable.TableFileName(d.dirname, nf.meta.fileNum))
+		}
+	}
+	if c.blobFileNum != 0 {
+		os.Remove(blob.FileName(d.dirname, c.blobFileNum))
+	}
+}
+
+// waitForCompaction 等待正在进行的compaction完成，调用时必须持有d.mu
+func (d *DB) waitForCompaction() {
+	for d.compacting {
+		d.compactionCond.Wait()
+	}
+}
+
+// deleteObsoleteFiles 删除不再被任何version引用的文件，调用时必须持有d.mu
+func (d *DB) deleteObsoleteFiles() {
+	live := d.vs.liveFiles()
+	for fileNum := range d.vs.obsolete {
+		if live[fileNum] {
+			continue
+		}
+		d.tc.Evict(fileNum)
+		os.Remove(sstable.TableFileName(d.dirname, fileNum))
+		delete(d.vs.obsolete, fileNum)
+	}
+	liveBlobs := d.vs.liveBlobFiles()
+	for blobNum := range d.vs.obsoleteBlobs {
+		if liveBlobs[blobNum] {
+			continue
+		}
+		d.blobs.Remove(blobNum)
+		delete(d.vs.obsoleteBlobs, blobNum)
+	}
+}
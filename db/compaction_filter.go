@@ -0,0 +1,68 @@
+package db
+
+import (
+	"github.com/InsZVA/saver/blob"
+	"github.com/InsZVA/saver/table"
+)
+
+// FilterDecision CompactionFilter对一条记录的处理结果
+type FilterDecision int
+
+const (
+	// FilterKeep 保留记录
+	FilterKeep FilterDecision = iota
+	// FilterRemove 删除记录，同时遮盖这个key更老的版本
+	FilterRemove
+	// FilterChangeValue 把value换成Filter返回的新值
+	FilterChangeValue
+)
+
+// CompactionFilter 在compaction中按应用的逻辑删除或者改写记录，例如删除一个已经移除的租户的所有key
+// compaction对合并之后每个key最新的写入调用Filter，这个写入必须比所有没有释放的快照都新，快照能看到的版本不会被改写；
+// 分离到blob文件的value先读出来再交给Filter；删除标记、已经过期的记录以及直接移动到下一层的文件不经过Filter
+// Filter在后台compaction中调用，可能与读写并发执行，不能修改key和value
+type CompactionFilter interface {
+	// Filter level是compaction开始的层，bottommost表示输出层之下没有与这次compaction重叠的数据
+	// val不包含TTL的过期时间，FilterChangeValue时返回新的value，原来的过期时间保持不变
+	Filter(level int, bottommost bool, key, val []byte) (FilterDecision, []byte)
+}
+
+// filter 用CompactionFilter处理一条记录，返回处理之后的key和value
+// val是记录中原样保存的值，KindBlobIndex的记录保留时仍然写入原来的指针，改写之后的value作为普通记录写入，
+// 长度超过BlobThreshold时重新分离到这次compaction的blob文件中
+func (o *compactionOutput) filter(k table.Key, val []byte) (table.Key, []byte, error) {
+	f := o.c.cf.opts.CompactionFilter
+	if f == nil {
+		return k, val, nil
+	}
+	userVal := val
+	switch k.Kind() {
+	case table.KindSet:
+	case table.KindSetWithTTL:
+		userVal = table.UserValue(k.Kind(), val)
+	case table.KindBlobIndex:
+		p, err := blob.DecodePointer(val)
+		if err != nil {
+			return k, nil, err
+		}
+		if userVal, err = o.d.blobs.Get(p); err != nil {
+			return k, nil, err
+		}
+	default:
+		return k, val, nil
+	}
+	decision, newVal := f.Filter(o.c.level, o.bottommost, k.Key(), userVal)
+	switch decision {
+	case FilterRemove:
+		return table.NewInternalKey(k.Key(), k.Seq(), table.KindDelete), nil, nil
+	case FilterChangeValue:
+		switch k.Kind() {
+		case table.KindSetWithTTL:
+			return k, append(append(make([]byte, 0, table.ExpirySize+len(newVal)), val[:table.ExpirySize]...), newVal...), nil
+		case table.KindBlobIndex:
+			return table.NewInternalKey(k.Key(), k.Seq(), table.KindSet), newVal, nil
+		}
+		return k, newVal, nil
+	}
+	return k, val, nil
+}
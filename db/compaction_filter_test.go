@@ -0,0 +1,177 @@
+package db
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/InsZVA/saver/table"
+)
+
+// prefixFilter 删除remove开头的key，把upper开头的key的value改成大写
+type prefixFilter struct {
+	mu         sync.Mutex
+	levels     []int
+	bottommost []bool
+}
+
+func (f *prefixFilter) Filter(level int, bottommost bool, key, val []byte) (FilterDecision, []byte) {
+	f.mu.Lock()
+	f.levels = append(f.levels, level)
+	f.bottommost = append(f.bottommost, bottommost)
+	f.mu.Unlock()
+	switch {
+	case bytes.HasPrefix(key, []byte("remove")):
+		return FilterRemove, nil
+	case bytes.HasPrefix(key, []byte("upper")):
+		return FilterChangeValue, bytes.ToUpper(val)
+	}
+	return FilterKeep, nil
+}
+
+func TestCompactionFilter(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	f := &prefixFilter{}
+	d := openTestDB(t, "/tmp/saver_db_compaction_filter", &Options{Now: clock.Now, L0CompactionTrigger: 2, CompactionFilter: f})
+	defer d.Close()
+	// remove2的旧版本在最底层，被删除之后要留下删除标记
+	writeExternalFile(t, "/tmp/saver_compaction_filter_ingest", []string{"remove2"}, "old")
+	if err := d.IngestExternalFiles([]string{"/tmp/saver_compaction_filter_ingest"}); err != nil {
+		t.Fatal(err)
+	}
+	d.Put([]byte("keep"), []byte("k"))
+	d.Put([]byte("remove1"), []byte("r"))
+	d.Put([]byte("remove2"), []byte("r"))
+	d.PutWithTTL([]byte("upper1"), []byte("abc"), time.Hour)
+	d.Flush()
+	d.Put([]byte("upper2"), []byte("def"))
+	// upper3的删除标记下面没有数据，compaction时直接丢弃
+	d.Delete([]byte("upper3"))
+	d.Flush()
+	d.mu.Lock()
+	d.waitForCompaction()
+	d.mu.Unlock()
+
+	v := d.defaultCF.current
+	if len(v.levels[0]) != 0 || len(v.levels[1]) != 1 {
+		t.Fatal("没有compact", levelFiles(d))
+	}
+	entries := tableEntries(t, d, v.levels[1][0])
+	expected := map[string]table.Kind{
+		"keep":    table.KindSet,
+		"remove2": table.KindDelete,
+		"upper1":  table.KindSetWithTTL,
+		"upper2":  table.KindSet,
+	}
+	if len(entries) != len(expected) {
+		t.Error("compaction没有处理过滤的记录", entries)
+	}
+	for k, kind := range expected {
+		if entries[k] != kind {
+			t.Error("compaction没有处理过滤的记录", entries)
+		}
+	}
+	expectGet(t, d, "keep", "k", true)
+	expectGet(t, d, "remove1", "", false)
+	expectGet(t, d, "remove2", "", false)
+	expectGet(t, d, "upper1", "ABC", true)
+	expectGet(t, d, "upper2", "DEF", true)
+	// 改写之后保留原来的过期时间
+	clock.advance(time.Hour)
+	expectGet(t, d, "upper1", "", false)
+
+	// 删除标记不经过Filter，L0到L1的compaction与最底层的文件重叠
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.levels) != 5 {
+		t.Error("Filter调用的次数不对", f.levels)
+	}
+	for i := range f.levels {
+		if f.levels[i] != 0 || f.bottommost[i] {
+			t.Error("Filter的参数不对", f.levels, f.bottommost)
+		}
+	}
+}
+
+func TestCompactionFilterBottommost(t *testing.T) {
+	f := &prefixFilter{}
+	d := openTestDB(t, "/tmp/saver_db_compaction_filter_bottommost", &Options{
+		CompactionStyle:     CompactionStyleUniversal,
+		L0CompactionTrigger: 2,
+		CompactionFilter:    f,
+	})
+	defer d.Close()
+	for i := 0; i < 2; i++ {
+		d.Put([]byte("remove"+strings.Repeat("x", i)), []byte("r"))
+		d.Put([]byte("upper"+strings.Repeat("x", i)), []byte("u"))
+		d.Flush()
+	}
+	d.mu.Lock()
+	d.waitForCompaction()
+	d.mu.Unlock()
+
+	v := d.defaultCF.current
+	if len(v.levels[0]) != 1 {
+		t.Fatal("没有compact", levelFiles(d))
+	}
+	// 最底层的compaction直接丢弃被删除的记录
+	entries := tableEntries(t, d, v.levels[0][0])
+	if len(entries) != 2 || entries["upper"] != table.KindSet || entries["upperx"] != table.KindSet {
+		t.Error("compaction没有处理过滤的记录", entries)
+	}
+	expectGet(t, d, "upperx", "U", true)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.levels {
+		if f.levels[i] != 0 || !f.bottommost[i] {
+			t.Error("Filter的参数不对", f.levels, f.bottommost)
+		}
+	}
+}
+
+func TestCompactionFilterBlob(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_compaction_filter_blob", &Options{
+		L0CompactionTrigger: 2,
+		BlobThreshold:       100,
+		CompactionFilter:    &prefixFilter{},
+	})
+	defer d.Close()
+	long := func(s string) string {
+		return strings.Repeat(s, 100)
+	}
+	d.Put([]byte("keep"), []byte(long("k")))
+	d.Put([]byte("remove"), []byte(long("r")))
+	d.Flush()
+	d.Put([]byte("upper1"), []byte(long("u")))
+	d.Put([]byte("upper2"), []byte("u"))
+	d.Flush()
+	d.mu.Lock()
+	d.waitForCompaction()
+	d.mu.Unlock()
+
+	v := d.defaultCF.current
+	if len(v.levels[0]) != 0 || len(v.levels[1]) != 1 {
+		t.Fatal("没有compact", levelFiles(d))
+	}
+	// 分离到blob文件的value同样经过Filter，改写之后的大value重新分离
+	entries := tableEntries(t, d, v.levels[1][0])
+	expected := map[string]table.Kind{
+		"keep":   table.KindBlobIndex,
+		"upper1": table.KindBlobIndex,
+		"upper2": table.KindSet,
+	}
+	if len(entries) != len(expected) {
+		t.Error("compaction没有处理过滤的记录", entries)
+	}
+	for k, kind := range expected {
+		if entries[k] != kind {
+			t.Error("compaction没有处理过滤的记录", entries)
+		}
+	}
+	expectGet(t, d, "keep", long("k"), true)
+	expectGet(t, d, "remove", "", false)
+	expectGet(t, d, "upper1", long("U"), true)
+	expectGet(t, d, "upper2", "U", true)
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/InsZVA/saver/sstable"
+)
+
+func TestLeveledCompaction(t *testing.T) {
+	dirname := "/tmp/saver_db_compaction"
+	d := openTestDB(t, dirname, &Options{
+		MemTableSize:        16 * 1024,
+		L0CompactionTrigger: 2,
+		BaseLevelSize:       64 * 1024,
+		LevelMultiplier:     4,
+		TargetFileSize:      16 * 1024,
+	})
+	defer d.Close()
+
+	model := make(map[string]string)
+	key := func(i int) string {
+		return fmt.Sprintf("key%06d", i)
+	}
+	check := func() {
+		for i := 0; i < 3000; i++ {
+			val, ok := model[key(i)]
+			expectGet(t, d, key(i), val, ok)
+		}
+	}
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 40000; n++ {
+		i := r.Intn(3000)
+		switch op := r.Intn(100); {
+		case op < 80:
+			val := fmt.Sprintf("value%d-%d-%s", i, n, make([]byte, r.Intn(40)))
+			model[key(i)] = val
+			if err := d.Put([]byte(key(i)), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+		case op < 99:
+			delete(model, key(i))
+			if err := d.Delete([]byte(key(i))); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			for j := i; j < i+50; j++ {
+				delete(model, key(j))
+			}
+			if err := d.DeleteRange([]byte(key(i)), []byte(key(i+50))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n%10000 == 0 {
+			check()
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	d.waitForCompaction()
+	v := d.defaultCF.current
+	if len(v.levels[0]) >= d.opts.L0CompactionTrigger {
+		t.Error("L0没有被compact", len(v.levels[0]))
+	}
+	deepest := 0
+	for level := 1; level < numLevels; level++ {
+		files := v.levels[level]
+		if len(files) > 0 {
+			deepest = level
+		}
+		if level < numLevels-1 && v.levelSize(level) > d.opts.levelMaxSize(level) {
+			t.Error("超过了目标大小", level, v.levelSize(level))
+		}
+		for i := 1; i < len(files); i++ {
+			if !files[i-1].afterLargest(files[i].smallest.Key()) {
+				t.Error("同一层的文件有重叠", level, i)
+			}
+		}
+	}
+	if deepest < 2 {
+		t.Error("应该有多层", deepest)
+	}
+	live := d.vs.liveFiles()
+	d.mu.Unlock()
+
+	// 被compact的文件已经删除
+	infos, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var onDisk []uint64
+	for _, info := range infos {
+		var num uint64
+		if filepath.Ext(info.Name()) == ".sst" {
+			fmt.Sscanf(info.Name(), "%06d.sst", &num)
+			onDisk = append(onDisk, num)
+			if !live[num] {
+				t.Error("没有删除被compact的文件", info.Name())
+			}
+		}
+	}
+	if len(onDisk) != len(live) {
+		t.Error("文件数错误", len(onDisk), len(live))
+	}
+	check()
+
+	// 最底层不保留删除标记
+	for _, f := range v.levels[deepest] {
+		h, err := d.tc.Acquire(f.fileNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !v.isBottomFor(deepest, f) {
+			h.Release()
+			continue
+		}
+		if n := h.Reader().Properties().NumDeletions; n != 0 {
+			t.Error("最底层的文件中不应该有删除标记", f.fileNum, n)
+		}
+		h.Release()
+	}
+}
+
+// isBottomFor level之下没有与f重叠的文件
+func (v *version) isBottomFor(level int, f *fileMetadata) bool {
+	c := &compaction{outputLevel: level, version: v}
+	return c.isBottommost(f.smallest.Key(), f.largest.Key())
+}
+
+func TestCompactionTrivialMove(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_compaction_move", &Options{L0CompactionTrigger: 1})
+	defer d.Close()
+	d.Put([]byte("a"), []byte("1"))
+	d.Flush()
+	d.mu.Lock()
+	d.waitForCompaction()
+	levels := d.defaultCF.current.levels
+	d.mu.Unlock()
+	if len(levels[0]) != 0 || len(levels[1]) != 1 {
+		t.Fatal("单个文件应该直接移动到下一层", len(levels[0]), len(levels[1]))
+	}
+	if _, err := sstable.OpenSSTable(sstable.TableFileName(d.dirname, levels[1][0].fileNum)); err != nil {
+		t.Error("移动的文件不应该被删除", err)
+	}
+	expectGet(t, d, "a", "1", true)
+}
+
+func TestPickCompaction(t *testing.T) {
+	d := &DB{vs: newVersionSet()}
+	cf := d.vs.families[defaultColumnFamilyID]
+	cf.opts = Options{L0CompactionTrigger: 2, BaseLevelSize: 100}.withDefaults()
+	if d.pickCompaction() != nil {
+		t.Error("空的version不需要compaction")
+	}
+	edit := &versionEdit{}
+	for i, r := range [][2]string{{"a", "c"}, {"d", "f"}, {"g", "i"}} {
+		m := testMeta(uint64(i+1), r[0], r[1], 1)
+		m.size = 60
+		edit.addFile(1, m)
+	}
+	m := testMeta(10, "b", "e", 1)
+	edit.addFile(2, m)
+	d.vs.applyEdit(edit)
+	c := d.pickCompaction()
+	if c == nil || c.level != 1 || len(c.inputs[0]) != 1 || c.inputs[0][0].fileNum != 1 ||
+		len(c.inputs[1]) != 1 || c.inputs[1][0].fileNum != 10 {
+		t.Fatal("选择的compaction错误", c)
+	}
+	// 下一次从上次结束的位置之后开始
+	cf.compactPointer[1] = []byte("c")
+	if c = d.pickCompaction(); c.inputs[0][0].fileNum != 2 {
+		t.Error("没有从compactPointer之后开始", c.inputs[0][0].fileNum)
+	}
+	cf.compactPointer[1] = []byte("i")
+	if c = d.pickCompaction(); c.inputs[0][0].fileNum != 1 {
+		t.Error("到达最后之后应该从头开始", c.inputs[0][0].fileNum)
+	}
+	files := []uint64{}
+	for _, f := range c.inputs[1] {
+		files = append(files, f.fileNum)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i] < files[j] })
+	if len(files) != 1 {
+		t.Error("下一层重叠的文件错误", files)
+	}
+}
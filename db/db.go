@@ -0,0 +1,620 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/InsZVA/saver/blob"
+	"github.com/InsZVA/saver/record"
+	"github.com/InsZVA/saver/sstable"
+	"github.com/InsZVA/saver/table"
+)
+
+var errDBClosed = errors.New("数据库已经关闭")
+
+// 内存表中每条记录除了key和value之外大概占用的内存
+const memEntryOverhead = 32
+
+func logFileName(dirname string, fileNum uint64) string {
+	return filepath.Join(dirname, fmt.Sprintf("%06d.log", fileNum))
+}
+
+// DB LSM树存储引擎：写入先追加到日志再写入内存表，内存表写满之后写入L0的SSTable
+// 数据分为多个列族，每个列族有自己的内存表和SSTable，所有列族共用一个日志
+type DB struct {
+	dirname string
+	opts    Options
+	tc      *sstable.TableCache
+	// 读取分离到blob文件中的value，所有列族共用
+	blobs     *blob.Reader
+	defaultCF *ColumnFamily
+	// 悲观事务的key锁
+	locks *lockManager
+
+	// 保护以下所有字段
+	mu      sync.Mutex
+	logNum  uint64
+	logFile *os.File
+	log     *record.Writer
+	// 已经切换掉，但还有列族的记录没有写入SSTable的日志
+	oldLogs []uint64
+	vs      *versionSet
+	closed  bool
+	// 是否有后台compaction正在进行，完成时通过compactionCond通知
+	compacting     bool
+	compactionCond *sync.Cond
+	// 导入期间不开始新的compaction
+	ingesting bool
+	// 后台compaction的错误，出错之后不再接受写入
+	bgErr error
+	// 没有释放的快照，按创建的顺序排列，序列号从小到大
+	snapshots []*Snapshot
+}
+
+// Open 打开dirname下的数据库，目录不存在时创建
+func Open(dirname string, opts *Options) (*DB, error) {
+	if err := os.MkdirAll(dirname, 0755); err != nil {
+		return nil, err
+	}
+	d := &DB{
+		dirname: dirname,
+		vs:      newVersionSet(),
+		locks:   newLockManager(),
+	}
+	d.compactionCond = sync.NewCond(&d.mu)
+	if opts != nil {
+		d.opts = *opts
+	}
+	d.opts = d.opts.withDefaults()
+	d.vs.dirname, d.vs.maxManifestSize = dirname, d.opts.MaxManifestFileSize
+	if _, err := d.vs.load(); err != nil {
+		return nil, err
+	}
+	// 列族的选项不记录在MANIFEST中
+	for _, cf := range d.vs.families {
+		cf.opts = d.familyOptions(d.opts.ColumnFamilyOptions[cf.name])
+	}
+	d.defaultCF = d.vs.families[defaultColumnFamilyID]
+	d.blobs = blob.NewReader(dirname, d.opts.MaxOpenFiles)
+	d.tc = sstable.NewTableCache(dirname, d.opts.MaxOpenFiles, &sstable.Options{Cache: d.opts.Cache, Blobs: d.blobs})
+	edits, err := d.recoverLogs()
+	if err != nil {
+		d.tc.Close()
+		return nil, err
+	}
+	if err := d.newLog(); err != nil {
+		d.tc.Close()
+		return nil, err
+	}
+	// 重放的日志都已经写入L0，新的MANIFEST中所有列族的logNum都指向新的日志
+	for _, cf := range d.vs.familyList() {
+		edit := edits[cf]
+		if edit == nil {
+			edit = &versionEdit{cf: cf.id}
+		}
+		edit.setLogNum(d.logNum)
+		if err := d.vs.logAndApply(edit); err != nil {
+			d.logFile.Close()
+			d.tc.Close()
+			return nil, err
+		}
+	}
+	if err := d.vs.createManifest(); err != nil {
+		d.logFile.Close()
+		d.tc.Close()
+		return nil, err
+	}
+	d.removeObsoleteFiles()
+	d.mu.Lock()
+	d.maybeScheduleCompaction()
+	d.mu.Unlock()
+	return d, nil
+}
+
+// removeObsoleteFiles 删除打开之前遗留的文件：不在version中的SSTable、没有被SSTable引用的blob文件、
+// 已经写入SSTable的日志、旧的MANIFEST和临时文件
+func (d *DB) removeObsoleteFiles() {
+	infos, err := ioutil.ReadDir(d.dirname)
+	if err != nil {
+		return
+	}
+	live, liveBlobs := d.vs.liveFiles(), d.vs.liveBlobFiles()
+	for _, info := range infos {
+		var num uint64
+		name := info.Name()
+		remove := false
+		switch {
+		case parseFileName(name, "%06d.sst", &num):
+			remove = !live[num]
+		case parseFileName(name, "%06d.blob", &num):
+			remove = !liveBlobs[num]
+		case parseFileName(name, "%06d.log", &num):
+			remove = num < d.vs.minLogNum()
+		case parseFileName(name, "MANIFEST-%06d", &num):
+			remove = num != d.vs.manifestNum
+		case parseFileName(name, "%06d.dbtmp", &num):
+			remove = true
+		}
+		if remove {
+			os.Remove(filepath.Join(d.dirname, name))
+		}
+	}
+}
+
+// parseFileName name是否是按format生成的文件名
+func parseFileName(name, format string, num *uint64) bool {
+	if _, err := fmt.Sscanf(name, format, num); err != nil {
+		return false
+	}
+	return fmt.Sprintf(format, *num) == name
+}
+
+// newLog 切换到一个新的日志文件
+func (d *DB) newLog() error {
+	num := d.vs.newFileNum()
+	f, err := os.Create(logFileName(d.dirname, num))
+	if err != nil {
+		return err
+	}
+	// 同时同步之前写入的SSTable和blob文件在目录中的项，之后才能写入MANIFEST
+	if err = syncDir(d.dirname); err != nil {
+		f.Close()
+		os.Remove(logFileName(d.dirname, num))
+		return err
+	}
+	d.logNum, d.logFile, d.log = num, f, record.NewWriter(f)
+	return nil
+}
+
+func (d *DB) Put(key, val []byte) error {
+	b := &Batch{}
+	b.Put(key, val)
+	return d.Write(b)
+}
+
+func (d *DB) Delete(key []byte) error {
+	b := &Batch{}
+	b.Delete(key)
+	return d.Write(b)
+}
+
+// DeleteRange 删除[start, end)内的所有key
+func (d *DB) DeleteRange(start, end []byte) error {
+	b := &Batch{}
+	b.DeleteRange(start, end)
+	return d.Write(b)
+}
+
+// PutCF 在列族cf中写入key
+func (d *DB) PutCF(cf *ColumnFamily, key, val []byte) error {
+	b := &Batch{}
+	b.PutCF(cf, key, val)
+	return d.Write(b)
+}
+
+func (d *DB) DeleteCF(cf *ColumnFamily, key []byte) error {
+	b := &Batch{}
+	b.DeleteCF(cf, key)
+	return d.Write(b)
+}
+
+// DeleteRangeCF 删除列族cf中[start, end)内的所有key
+func (d *DB) DeleteRangeCF(cf *ColumnFamily, start, end []byte) error {
+	b := &Batch{}
+	b.DeleteRangeCF(cf, start, end)
+	return d.Write(b)
+}
+
+// Write 原子地写入batch中的所有操作，batch中的操作可以属于不同的列族
+func (d *DB) Write(b *Batch) error {
+	if b.Count() == 0 {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.writeLocked(b)
+}
+
+// writeLocked 写入batch，调用时必须持有d.mu
+func (d *DB) writeLocked(b *Batch) error {
+	if d.closed {
+		return errDBClosed
+	}
+	if d.bgErr != nil {
+		return d.bgErr
+	}
+	if err := d.checkBatch(b.data); err != nil {
+		return err
+	}
+	// 复制一份，内存表中的key和value引用这份数据，调用方之后可以继续使用batch
+	wb := &Batch{data: append([]byte(nil), b.data...)}
+	wb.setSeq(d.vs.lastSeq + 1)
+	if _, err := d.log.Write(wb.data); err != nil {
+		return err
+	}
+	if d.opts.Sync {
+		if err := d.log.Sync(); err != nil {
+			return err
+		}
+	} else if err := d.log.Push(); err != nil {
+		return err
+	}
+	if err := d.applyBatch(wb.data, d.logNum); err != nil {
+		return err
+	}
+	for _, cf := range d.vs.families {
+		if cf.memSize >= cf.opts.MemTableSize {
+			if err := d.flushLocked(cf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkBatch 检查batch中的操作所属的列族都存在，调用时必须持有d.mu
+func (d *DB) checkBatch(data []byte) error {
+	r, err := newBatchReader(data)
+	if err != nil {
+		return err
+	}
+	for {
+		_, _, _, _, ok, err := r.next()
+		if err != nil || !ok {
+			return err
+		}
+		if d.vs.families[r.cf] == nil {
+			return errColumnFamilyDropped
+		}
+	}
+}
+
+// applyBatch 把编号为logNum的日志中的batch写入各自列族的内存表
+// 列族已经被删除，或者这个日志中列族的记录已经写入SSTable时跳过
+func (d *DB) applyBatch(data []byte, logNum uint64) error {
+	r, err := newBatchReader(data)
+	if err != nil {
+		return err
+	}
+	for {
+		kind, key, val, seq, ok, err := r.next()
+		if err != nil || !ok {
+			return err
+		}
+		d.vs.lastSeq = seq
+		cf := d.vs.families[r.cf]
+		if cf == nil || logNum < cf.logNum {
+			continue
+		}
+		switch kind {
+		case table.KindSet, table.KindSetWithTTL:
+			cf.mem.Set(table.NewInternalKey(key, seq, kind), val)
+		case table.KindDelete:
+			cf.mem.Delete(table.NewInternalKey(key, seq, table.KindDelete))
+		case table.KindRangeDelete:
+			cf.mem.DeleteRange(key, val, seq)
+		default:
+			return errBrokenBatch
+		}
+		cf.memSize += len(key) + len(val) + memEntryOverhead
+	}
+}
+
+// Get 查找key，第二个返回值表示是否存在
+func (d *DB) Get(key []byte) ([]byte, bool, error) {
+	return d.GetWithOptions(key, nil)
+}
+
+// GetWithOptions 按ro查找key，ro为nil时读取最新的数据
+func (d *DB) GetWithOptions(key []byte, ro *ReadOptions) ([]byte, bool, error) {
+	return d.GetCF(d.defaultCF, key, ro)
+}
+
+// GetCF 按ro在列族cf中查找key，ro为nil时读取最新的数据
+func (d *DB) GetCF(cf *ColumnFamily, key []byte, ro *ReadOptions) ([]byte, bool, error) {
+	d.mu.Lock()
+	if err := d.checkFamily(cf); err != nil {
+		d.mu.Unlock()
+		return nil, false, err
+	}
+	rs, err := d.acquireReadState(cf, ro)
+	if err != nil {
+		d.mu.Unlock()
+		return nil, false, err
+	}
+	// 持有version期间其中的文件不会被删除
+	defer d.unrefVersion(rs.version)
+	now := d.now()
+	val, found, deleted := getFromMem(rs.mem, key, rs.seq, now)
+	d.mu.Unlock()
+	if found || deleted {
+		return val, found, nil
+	}
+
+	for _, f := range rs.version.filesFor(key) {
+		val, found, deleted, err := d.getFromTable(f, key, rs.seq, now)
+		if err != nil || found || deleted {
+			return val, found, err
+		}
+	}
+	return nil, false, nil
+}
+
+// getFromMem 在一个内存表中查找序列号不大于seq的key，deleted表示key在这个内存表中被删除或者在now时已经过期
+func getFromMem(mem *table.SkipList, key []byte, seq uint64, now int64) (val []byte, found bool, deleted bool) {
+	// 同一个key的版本从新到旧排列，第一个序列号不大于seq的版本就是可见的最新版本
+	node := mem.Seek(table.NewInternalKey(key, seq, table.KindSet))
+	ok := node != mem.End() && bytes.Equal(node.Key().Key(), key)
+	tomb := mem.RangeTombstones().MaxCoveringSeq(key, seq)
+	if ok && node.Key().Seq() > tomb {
+		kind := node.Key().Kind()
+		if kind == table.KindDelete || table.Expired(kind, node.Val(), now) {
+			return nil, false, true
+		}
+		return table.UserValue(kind, node.Val()), true, false
+	}
+	return nil, false, tomb > 0
+}
+
+func (d *DB) unrefVersion(v *version) {
+	d.mu.Lock()
+	d.vs.unref(v)
+	// 关闭之后遗留的文件在下次打开时删除
+	if !d.closed {
+		d.deleteObsoleteFiles()
+	}
+	d.mu.Unlock()
+}
+
+// getFromTable 在一个SSTable中查找序列号不大于seq的key，deleted表示key在这个表中被删除或者已经过期，不需要继续查找更老的表
+func (d *DB) getFromTable(f *fileMetadata, key []byte, seq uint64, now int64) (val []byte, found bool, deleted bool, err error) {
+	h, err := d.tc.Acquire(f.fileNum)
+	if err != nil {
+		return nil, false, false, err
+	}
+	defer h.Release()
+	r := h.Reader()
+	k, val, ok, err := r.Lookup(table.NewInternalKey(key, seq, table.KindSet))
+	if err != nil {
+		return nil, false, false, err
+	}
+	tomb := r.RangeTombstones().MaxCoveringSeq(key, seq)
+	if ok && k.Seq() > tomb {
+		if k.Kind() == table.KindDelete || table.Expired(k.Kind(), val, now) {
+			return nil, false, true, nil
+		}
+		return table.UserValue(k.Kind(), val), true, false, nil
+	}
+	return nil, false, tomb > 0, nil
+}
+
+// Flush 把所有列族的内存表写入L0
+func (d *DB) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return errDBClosed
+	}
+	for _, cf := range d.vs.familyList() {
+		if err := d.flushLocked(cf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushCF 把列族cf的内存表写入L0
+func (d *DB) FlushCF(cf *ColumnFamily) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.checkFamily(cf); err != nil {
+		return err
+	}
+	return d.flushLocked(cf)
+}
+
+func memTableEmpty(mem *table.SkipList) bool {
+	return mem.First().Next() == mem.End() && len(mem.RangeTombstones()) == 0
+}
+
+// flushLocked 把cf的内存表写入L0并切换到新的日志，调用时必须持有d.mu
+// 其他列族的记录仍然在之前的日志中，等到所有列族都写入SSTable之后才删除这些日志
+func (d *DB) flushLocked(cf *ColumnFamily) error {
+	if cf.memEmpty() {
+		return nil
+	}
+	meta, err := d.writeLevel0(cf)
+	if err != nil {
+		return err
+	}
+	oldLogNum, oldLogFile := d.logNum, d.logFile
+	if err := d.newLog(); err != nil {
+		// 表还没有加入任何version，内存表中的记录仍然在原来的日志中
+		if meta != nil {
+			d.tc.Evict(meta.fileNum)
+			os.Remove(sstable.TableFileName(d.dirname, meta.fileNum))
+			// flush只引用自己新写入的blob文件
+			for blobNum := range meta.blobRefs {
+				os.Remove(blob.FileName(d.dirname, blobNum))
+			}
+		}
+		return err
+	}
+	// 内存表中的记录已经写入SSTable，之前的日志中不再有这个列族需要的记录
+	edit := &versionEdit{cf: cf.id}
+	edit.setLogNum(d.logNum)
+	if meta != nil {
+		edit.addFile(0, meta)
+	}
+	if err := d.vs.logAndApply(edit); err != nil {
+		d.bgErr = err
+		return err
+	}
+	oldLogFile.Close()
+	d.oldLogs = append(d.oldLogs, oldLogNum)
+	cf.resetMem()
+	// 内存表为空的列族在之前的日志中也没有需要的记录，重新打开时重放这些日志也不会恢复出它的记录
+	for _, other := range d.vs.families {
+		if other.memEmpty() {
+			other.logNum = d.logNum
+		}
+	}
+	d.deleteObsoleteLogs()
+	d.maybeScheduleCompaction()
+	return nil
+}
+
+// deleteObsoleteLogs 删除所有列族的记录都已经写入SSTable的日志，调用时必须持有d.mu
+func (d *DB) deleteObsoleteLogs() {
+	minLogNum := d.vs.minLogNum()
+	live := d.oldLogs[:0]
+	for _, num := range d.oldLogs {
+		if num < minLogNum {
+			os.Remove(logFileName(d.dirname, num))
+		} else {
+			live = append(live, num)
+		}
+	}
+	d.oldLogs = live
+}
+
+// writeLevel0 把cf的内存表写入一个新的SSTable，范围删除标记覆盖了所有记录时返回nil
+// 每个key保留最新的版本以及每个快照能看到的版本，大value写入一个新的blob文件，调用时必须持有d.mu
+func (d *DB) writeLevel0(cf *ColumnFamily) (*fileMetadata, error) {
+	opts := cf.opts.writerOptions()
+	bw, err := d.newBlobWriter(cf)
+	if err != nil {
+		return nil, err
+	}
+	opts.BlobWriter = bw
+	fileNum := d.vs.newFileNum()
+	path := sstable.TableFileName(d.dirname, fileNum)
+	sst, err := sstable.CreateSSTable(path)
+	if err == nil {
+		err = writeMemTable(sst.NewWriterWithOptions(opts), cf.mem, d.snapshotList())
+		if err == nil {
+			err = sst.Sync()
+		}
+		if cerr := sst.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err = d.finishBlobWriter(bw, err); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return d.tableMeta(fileNum)
+}
+
+// newBlobWriter 列族设置了BlobThreshold时创建一个新的blob文件，否则返回nil，调用时必须持有d.mu
+func (d *DB) newBlobWriter(cf *ColumnFamily) (*blob.Writer, error) {
+	if cf.opts.BlobThreshold <= 0 {
+		return nil, nil
+	}
+	return blob.Create(d.dirname, d.vs.newFileNum())
+}
+
+// finishBlobWriter 写入的SSTable结束之后调用，err为写入SSTable的错误
+// 同步并关闭blob文件，出错或者没有写入任何value时删除它
+func (d *DB) finishBlobWriter(bw *blob.Writer, err error) error {
+	if bw == nil {
+		return err
+	}
+	if err == nil && bw.Size() > 0 {
+		err = bw.Sync()
+	}
+	if cerr := bw.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || bw.Size() == 0 {
+		os.Remove(blob.FileName(d.dirname, bw.FileNum()))
+	}
+	return err
+}
+
+func writeMemTable(w *sstable.Writer, mem *table.SkipList, snapshots snapshotList) error {
+	gc := versionGC{snapshots: snapshots, tombs: mem.RangeTombstones()}
+	for p := mem.First().Next(); p != mem.End(); p = p.Next() {
+		if gc.drop(p.Key()) {
+			continue
+		}
+		if err := w.Write(p.Key(), p.Val()); err != nil {
+			return err
+		}
+	}
+	// 范围删除标记全部保留，用于遮盖更老的SSTable
+	for _, t := range mem.RangeTombstones() {
+		if err := w.AddRangeTombstone(t); err != nil {
+			return err
+		}
+	}
+	return w.Done()
+}
+
+// tableMeta 读取SSTable生成元数据，空表返回nil并删除文件
+func (d *DB) tableMeta(fileNum uint64) (*fileMetadata, error) {
+	path := sstable.TableFileName(d.dirname, fileNum)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := d.tc.Acquire(fileNum)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Release()
+	b, ok := h.Reader().Bounds()
+	if !ok {
+		d.tc.Evict(fileNum)
+		return nil, os.Remove(path)
+	}
+	props := h.Reader().Properties()
+	meta := &fileMetadata{
+		fileNum:  fileNum,
+		size:     uint64(info.Size()),
+		smallest: b.Smallest,
+		largest:  b.Largest,
+		minSeq:   props.MinSeq,
+		maxSeq:   props.MaxSeq,
+		blobRefs: props.BlobRefs,
+	}
+	// 属性中的序列号只统计了普通记录，L0按maxSeq排列，范围删除标记的序列号也要计入
+	for i, t := range h.Reader().RangeTombstones() {
+		if (i == 0 && props.NumEntries == 0) || t.Seq < meta.minSeq {
+			meta.minSeq = t.Seq
+		}
+		if t.Seq > meta.maxSeq {
+			meta.maxSeq = t.Seq
+		}
+	}
+	if props.GlobalSeq != 0 {
+		meta.minSeq, meta.maxSeq = props.GlobalSeq, props.GlobalSeq
+	}
+	return meta, nil
+}
+
+func (d *DB) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return errDBClosed
+	}
+	d.closed = true
+	d.waitForCompaction()
+	err := d.log.Close()
+	if cerr := d.vs.close(); err == nil {
+		err = cerr
+	}
+	if cerr := d.tc.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := d.blobs.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
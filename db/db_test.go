@@ -0,0 +1,134 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/InsZVA/saver/sstable"
+)
+
+func openTestDB(t *testing.T, dirname string, opts *Options) *DB {
+	os.RemoveAll(dirname)
+	d, err := Open(dirname, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func expectGet(t *testing.T, d *DB, key string, val string, found bool) {
+	v, ok, err := d.Get([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != found || (ok && string(v) != val) {
+		t.Errorf("Get(%s)错误: %s %v，应该为%s %v", key, v, ok, val, found)
+	}
+}
+
+func TestDB(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db", &Options{L0CompactionTrigger: 100})
+	if err := d.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	d.Put([]byte("b"), []byte("2"))
+	d.Put([]byte("c"), []byte("3"))
+	expectGet(t, d, "a", "1", true)
+	expectGet(t, d, "d", "", false)
+	d.Delete([]byte("b"))
+	expectGet(t, d, "b", "", false)
+
+	// 写入L0之后删除标记仍然遮盖更老的表
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	d.Put([]byte("b"), []byte("22"))
+	d.Flush()
+	d.Delete([]byte("b"))
+	d.Flush()
+	if n := len(d.defaultCF.current.levels[0]); n != 3 {
+		t.Fatal("L0文件数错误", n)
+	}
+	expectGet(t, d, "a", "1", true)
+	expectGet(t, d, "b", "", false)
+	d.Put([]byte("b"), []byte("222"))
+	expectGet(t, d, "b", "222", true)
+
+	b := &Batch{}
+	b.Put([]byte("x"), []byte("9"))
+	b.DeleteRange([]byte("a"), []byte("c"))
+	b.Put([]byte("a"), []byte("11"))
+	if err := d.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	expectGet(t, d, "a", "11", true)
+	expectGet(t, d, "b", "", false)
+	expectGet(t, d, "c", "3", true)
+	expectGet(t, d, "x", "9", true)
+	d.Flush()
+	expectGet(t, d, "a", "11", true)
+	expectGet(t, d, "b", "", false)
+	expectGet(t, d, "c", "3", true)
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := d.Get([]byte("a")); err != errDBClosed {
+		t.Error("关闭之后应该返回错误", err)
+	}
+	if err := d.Put([]byte("a"), nil); err != errDBClosed {
+		t.Error("关闭之后应该返回错误", err)
+	}
+}
+
+func TestDBAutoFlush(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_flush", &Options{MemTableSize: 64 * 1024})
+	defer d.Close()
+	n := 5000
+	for i := 0; i < n; i++ {
+		if err := d.Put([]byte(fmt.Sprintf("%06d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.mu.Lock()
+	if d.defaultCF.memSize >= d.opts.MemTableSize || d.vs.nextFileNum < 4 {
+		t.Error("内存表写满之后应该写入L0")
+	}
+	d.mu.Unlock()
+	for i := 0; i < n; i++ {
+		expectGet(t, d, fmt.Sprintf("%06d", i), fmt.Sprintf("value%d", i), true)
+	}
+	// 只保留当前的日志
+	logs := 0
+	infos, _ := ioutil.ReadDir("/tmp/saver_db_flush")
+	for _, info := range infos {
+		var num uint64
+		if _, err := fmt.Sscanf(info.Name(), "%06d.log", &num); err == nil {
+			logs++
+		}
+	}
+	if logs != 1 {
+		t.Error("旧的日志没有删除", logs)
+	}
+}
+
+func TestDBFlushNewLogError(t *testing.T) {
+	dirname := "/tmp/saver_db_flush_log_error"
+	d := openTestDB(t, dirname, &Options{L0CompactionTrigger: 100})
+	defer d.Close()
+	d.Put([]byte("a"), []byte("1"))
+	// flush先分配SSTable的编号，再分配新日志的编号，占用日志的文件名使切换日志失败
+	d.mu.Lock()
+	tableNum := d.vs.nextFileNum
+	os.Mkdir(logFileName(dirname, tableNum+1), 0755)
+	d.mu.Unlock()
+	if err := d.Flush(); err == nil {
+		t.Fatal("切换日志失败时Flush应该返回错误")
+	}
+	if _, err := os.Stat(sstable.TableFileName(dirname, tableNum)); !os.IsNotExist(err) {
+		t.Error("没有生效的L0文件应该被删除", err)
+	}
+	expectGet(t, d, "a", "1", true)
+}
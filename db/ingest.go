@@ -0,0 +1,223 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/InsZVA/saver/sstable"
+	"github.com/InsZVA/saver/table"
+)
+
+var (
+	errIngestEmpty      = errors.New("导入的SSTable为空")
+	errIngestOrder      = errors.New("导入的SSTable中key不是严格递增的")
+	errIngestBounds     = errors.New("导入的SSTable中key的范围与统计信息不一致")
+	errIngestComparator = errors.New("导入的SSTable使用了不同的比较器")
+	errIngestBlob       = errors.New("导入的SSTable不能包含分离到blob文件中的value")
+	errIngestOverlap    = errors.New("同时导入的SSTable之间key的范围有重叠")
+)
+
+// ingestFile 一个待导入的文件
+type ingestFile struct {
+	path    string
+	bounds  sstable.Bounds
+	fileNum uint64
+}
+
+// IngestExternalFiles 把用sstable.Writer生成的外部文件导入默认列族，不经过日志和内存表
+func (d *DB) IngestExternalFiles(paths []string) error {
+	return d.IngestExternalFilesCF(d.defaultCF, paths)
+}
+
+// IngestExternalFilesCF 把用sstable.Writer生成的外部文件导入列族cf，不经过日志和内存表
+// 文件被复制到数据库目录中，所有文件使用同一个新的全局序列号，放到cf中不与其他文件重叠的最深的层
+// 与cf的内存表重叠时先把它写入L0；所有文件在同一个version中生效，读取方要么看到全部文件，要么一个也看不到
+func (d *DB) IngestExternalFilesCF(cf *ColumnFamily, paths []string) error {
+	files := make([]*ingestFile, len(paths))
+	for i, path := range paths {
+		b, err := validateExternalFile(path)
+		if err != nil {
+			return err
+		}
+		files[i] = &ingestFile{path: path, bounds: b}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].bounds.Smallest.Cmp(files[j].bounds.Smallest) < 0
+	})
+	for i := 1; i < len(files); i++ {
+		if files[i].bounds.Smallest.Cmp(files[i-1].bounds.Largest) <= 0 {
+			return errIngestOverlap
+		}
+	}
+
+	// 复制文件时不持有锁，只预先分配文件编号
+	d.mu.Lock()
+	if err := d.checkFamily(cf); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	for _, f := range files {
+		f.fileNum = d.vs.newFileNum()
+	}
+	d.mu.Unlock()
+	err := d.ingest(cf, files)
+	if err != nil {
+		for _, f := range files {
+			d.tc.Evict(f.fileNum)
+			os.Remove(sstable.TableFileName(d.dirname, f.fileNum))
+		}
+	}
+	return err
+}
+
+func (d *DB) ingest(cf *ColumnFamily, files []*ingestFile) error {
+	for _, f := range files {
+		if err := copyFile(f.path, sstable.TableFileName(d.dirname, f.fileNum)); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(d.dirname); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// compaction的输出可能与导入的文件重叠，等待它完成，之后持有锁期间不会开始新的compaction
+	d.waitForCompaction()
+	// 等待期间cf可能已经被删除
+	if err := d.checkFamily(cf); err != nil {
+		return err
+	}
+	d.ingesting = true
+	defer func() {
+		d.ingesting = false
+		d.maybeScheduleCompaction()
+	}()
+	for _, f := range files {
+		if cf.memOverlaps(f.bounds) {
+			if err := d.flushLocked(cf); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	seq := d.vs.lastSeq + 1
+	edit := &versionEdit{cf: cf.id}
+	for _, f := range files {
+		if err := sstable.SetGlobalSeq(sstable.TableFileName(d.dirname, f.fileNum), seq); err != nil {
+			return err
+		}
+		meta, err := d.tableMeta(f.fileNum)
+		if err != nil {
+			return err
+		}
+		level := 0
+		if cf.opts.CompactionStyle == CompactionStyleLeveled {
+			level = cf.current.pickIngestLevel(f.bounds)
+		}
+		edit.addFile(level, meta)
+	}
+	d.vs.lastSeq = seq
+	return d.vs.logAndApply(edit)
+}
+
+// memOverlaps 内存表中是否有key或者范围删除标记落在b的范围内
+func (cf *ColumnFamily) memOverlaps(b sstable.Bounds) bool {
+	mem := cf.mem
+	if n := mem.Seek(table.NewSearchKey(b.Smallest.Key())); n != mem.End() && n.Key().Cmp(b.Largest) <= 0 {
+		return true
+	}
+	for _, t := range mem.RangeTombstones() {
+		if b.Overlaps(t.Start, t.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// pickIngestLevel 与L0重叠时只能放在L0，否则放到从L1开始第一个重叠的层之上
+// universal compaction只使用L0，导入的文件总是放在L0
+func (v *version) pickIngestLevel(b sstable.Bounds) int {
+	start, end := b.Smallest.Key(), b.Largest.Key()
+	if len(v.overlaps(0, start, end)) > 0 {
+		return 0
+	}
+	level := 0
+	for l := 1; l < numLevels; l++ {
+		if len(v.overlaps(l, start, end)) > 0 {
+			break
+		}
+		level = l
+	}
+	return level
+}
+
+// validateExternalFile 检查外部文件中的key严格递增，并且与统计信息中的范围一致
+func validateExternalFile(path string) (sstable.Bounds, error) {
+	sst, err := sstable.OpenSSTable(path)
+	if err != nil {
+		return sstable.Bounds{}, err
+	}
+	defer sst.Close()
+	r, err := sst.NewReader()
+	if err != nil {
+		return sstable.Bounds{}, err
+	}
+	props := r.Properties()
+	if props.ComparatorName != sstable.BytewiseComparator {
+		return sstable.Bounds{}, errIngestComparator
+	}
+	b, ok := r.Bounds()
+	if !ok {
+		return sstable.Bounds{}, errIngestEmpty
+	}
+	it := r.NewIterator(nil)
+	defer it.Close()
+	var last []byte
+	n := uint64(0)
+	for it.First(); it.Valid(); it.Next() {
+		k := it.Key()
+		if k.Kind() == table.KindBlobIndex {
+			return sstable.Bounds{}, errIngestBlob
+		}
+		if n > 0 && bytes.Compare(k.Key(), last) <= 0 {
+			return sstable.Bounds{}, errIngestOrder
+		}
+		if n == 0 && !bytes.Equal(k.Key(), props.SmallestKey.Key()) {
+			return sstable.Bounds{}, errIngestBounds
+		}
+		last = append(last[:0], k.Key()...)
+		n++
+	}
+	if err := it.Error(); err != nil {
+		return sstable.Bounds{}, err
+	}
+	if n > 0 && !bytes.Equal(last, props.LargestKey.Key()) {
+		return sstable.Bounds{}, errIngestBounds
+	}
+	return b, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/InsZVA/saver/sstable"
+	"github.com/InsZVA/saver/table"
+)
+
+// writeExternalFile 用sstable.Writer生成一个外部文件，value为prefix加上key
+func writeExternalFile(t *testing.T, path string, keys []string, prefix string) {
+	sst, err := sstable.CreateSSTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := sst.NewWriter()
+	for _, k := range keys {
+		if err = w.Write(table.NewKey([]byte(k)), []byte(prefix+k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Done(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+}
+
+func TestIngestExternalFiles(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_ingest", &Options{L0CompactionTrigger: 100})
+	defer d.Close()
+	d.Put([]byte("b"), []byte("old"))
+	d.Put([]byte("m"), []byte("old"))
+	d.Flush()
+
+	// 与L0重叠，只能放到L0
+	writeExternalFile(t, "/tmp/saver_ingest_1", []string{"a", "b", "c"}, "v1")
+	// 不与任何文件重叠，放到最深的层
+	writeExternalFile(t, "/tmp/saver_ingest_2", []string{"x", "y"}, "v2")
+	seq := d.vs.lastSeq
+	if err := d.IngestExternalFiles([]string{"/tmp/saver_ingest_2", "/tmp/saver_ingest_1"}); err != nil {
+		t.Fatal(err)
+	}
+	if d.vs.lastSeq != seq+1 {
+		t.Error("所有文件应该使用同一个全局序列号", d.vs.lastSeq)
+	}
+	if n := len(d.defaultCF.current.levels[0]); n != 2 {
+		t.Error("与L0重叠的文件应该放到L0", n)
+	}
+	if n := len(d.defaultCF.current.levels[numLevels-1]); n != 1 {
+		t.Error("不重叠的文件应该放到最深的层", n)
+	}
+	expectGet(t, d, "b", "v1b", true)
+	expectGet(t, d, "m", "old", true)
+	expectGet(t, d, "y", "v2y", true)
+	d.Put([]byte("a"), []byte("new"))
+	expectGet(t, d, "a", "new", true)
+
+	// 与内存表重叠时先写入L0，导入的文件更新
+	d.Put([]byte("p"), []byte("mem"))
+	writeExternalFile(t, "/tmp/saver_ingest_3", []string{"o", "p"}, "v3")
+	if err := d.IngestExternalFiles([]string{"/tmp/saver_ingest_3"}); err != nil {
+		t.Fatal(err)
+	}
+	if !d.defaultCF.memEmpty() {
+		t.Error("与内存表重叠时应该先写入L0")
+	}
+	expectGet(t, d, "p", "v3p", true)
+	expectGet(t, d, "a", "new", true)
+	// 导入的文件在L0中位于最前面
+	if f := d.defaultCF.current.levels[0][0]; f.maxSeq != d.vs.lastSeq {
+		t.Error("导入的文件应该是L0中最新的", f.maxSeq, d.vs.lastSeq)
+	}
+
+	// L1以下有重叠时放到重叠的层之上
+	writeExternalFile(t, "/tmp/saver_ingest_4", []string{"w", "x"}, "v4")
+	if err := d.IngestExternalFiles([]string{"/tmp/saver_ingest_4"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(d.defaultCF.current.levels[numLevels-2]); n != 1 {
+		t.Error("文件应该放到重叠的层之上", n)
+	}
+	expectGet(t, d, "x", "v4x", true)
+	expectGet(t, d, "y", "v2y", true)
+}
+
+func TestIngestExternalFilesInvalid(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_ingest_invalid", nil)
+	defer d.Close()
+	writeExternalFile(t, "/tmp/saver_ingest_a", []string{"a", "c"}, "")
+	writeExternalFile(t, "/tmp/saver_ingest_b", []string{"b", "d"}, "")
+	writeExternalFile(t, "/tmp/saver_ingest_empty", nil, "")
+	if err := d.IngestExternalFiles([]string{"/tmp/saver_ingest_a", "/tmp/saver_ingest_b"}); err != errIngestOverlap {
+		t.Error("重叠的文件应该返回错误", err)
+	}
+	if err := d.IngestExternalFiles([]string{"/tmp/saver_ingest_empty"}); err != errIngestEmpty {
+		t.Error("空文件应该返回错误", err)
+	}
+	if err := d.IngestExternalFiles([]string{"/tmp/saver_ingest_not_exist"}); err == nil {
+		t.Error("不存在的文件应该返回错误")
+	}
+	for level := range d.defaultCF.current.levels {
+		if len(d.defaultCF.current.levels[level]) != 0 {
+			t.Error("导入失败时不应该修改version")
+		}
+	}
+	expectGet(t, d, "a", "", false)
+}
+
+func TestIngestExternalFilesCF(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_ingest_cf", &Options{L0CompactionTrigger: 100})
+	defer d.Close()
+	users, err := d.CreateColumnFamily("users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Put([]byte("b"), []byte("default"))
+	d.PutCF(users, []byte("b"), []byte("mem"))
+
+	// 只与users的内存表重叠，只有users的内存表写入L0
+	writeExternalFile(t, "/tmp/saver_ingest_cf", []string{"a", "b"}, "v")
+	if err := d.IngestExternalFilesCF(users, []string{"/tmp/saver_ingest_cf"}); err != nil {
+		t.Fatal(err)
+	}
+	if !users.memEmpty() || d.defaultCF.memEmpty() {
+		t.Error("只应该把users的内存表写入L0")
+	}
+	if n := len(users.current.levels[0]); n != 2 {
+		t.Error("users的L0中应该有2个文件", n)
+	}
+	for level := range d.defaultCF.current.levels {
+		if len(d.defaultCF.current.levels[level]) != 0 {
+			t.Error("默认列族的version不应该被修改")
+		}
+	}
+	expectGetCF(t, d, users, "a", "va", true)
+	expectGetCF(t, d, users, "b", "vb", true)
+	expectGet(t, d, "a", "", false)
+	expectGet(t, d, "b", "default", true)
+
+	if err := d.DropColumnFamily(users); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.IngestExternalFilesCF(users, []string{"/tmp/saver_ingest_cf"}); err != errColumnFamilyDropped {
+		t.Error("导入到已经删除的列族应该返回错误", err)
+	}
+}
@@ -0,0 +1,499 @@
+package db
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/InsZVA/saver/sstable"
+	"github.com/InsZVA/saver/table"
+)
+
+// memIterator 内存表上的internalIterator，同一个key的多个版本从新到旧排列
+// 迭代期间内存表仍然会被写入，每次移动都持有写入内存表时使用的锁mu；节点插入之后key和value不再改变，
+// 读取当前节点不需要加锁。新写入的记录也会被遍历到，由调用者按序列号过滤
+type memIterator struct {
+	mu   *sync.Mutex
+	list *table.SkipList
+	node *table.SkipListNode
+}
+
+func (it *memIterator) First() bool {
+	it.mu.Lock()
+	it.node = it.list.First().Next()
+	it.mu.Unlock()
+	return it.Valid()
+}
+
+func (it *memIterator) Last() bool {
+	it.mu.Lock()
+	it.node = it.list.End().Prev()
+	it.mu.Unlock()
+	return it.Valid()
+}
+
+func (it *memIterator) SeekGE(key table.Key) bool {
+	it.mu.Lock()
+	it.node = it.list.Seek(key)
+	it.mu.Unlock()
+	return it.Valid()
+}
+
+func (it *memIterator) SeekLT(key table.Key) bool {
+	it.mu.Lock()
+	it.node = it.list.Seek(key).Prev()
+	it.mu.Unlock()
+	return it.Valid()
+}
+
+func (it *memIterator) Next() bool {
+	it.mu.Lock()
+	if it.node != it.list.End() {
+		it.node = it.node.Next()
+	}
+	it.mu.Unlock()
+	return it.Valid()
+}
+
+func (it *memIterator) Prev() bool {
+	it.mu.Lock()
+	if it.node != it.list.First() {
+		it.node = it.node.Prev()
+	}
+	it.mu.Unlock()
+	return it.Valid()
+}
+
+func (it *memIterator) Valid() bool {
+	return it.node != nil && it.node != it.list.First() && it.node != it.list.End()
+}
+
+func (it *memIterator) Key() table.Key {
+	return it.node.Key()
+}
+
+func (it *memIterator) Value() []byte {
+	return it.node.Val()
+}
+
+func (it *memIterator) Error() error {
+	return nil
+}
+
+func (it *memIterator) Close() error {
+	return nil
+}
+
+// levelIterator 依次遍历一组互不重叠、按key排列的文件，只在需要时打开文件
+// 文件的范围删除标记在第一次打开它时读取：文件的范围包含它的范围删除标记，向一个方向遍历时
+// 覆盖当前key的文件要么是当前的文件，要么已经被经过并打开过，因此判断当前key时需要的标记都已经读取
+type levelIterator struct {
+	d     *DB
+	files []*fileMetadata
+	opts  sstable.IterOptions
+	// 当前打开的文件
+	index int
+	h     *sstable.TableHandle
+	iter  *sstable.Iterator
+	err   error
+	// 已经打开过的文件的范围删除标记，同一层的文件互不重叠，按文件的顺序拼接之后仍然是切分好的
+	loaded    []bool
+	fileTombs []table.RangeTombstones
+	tombs     table.RangeTombstones
+}
+
+func newLevelIterator(d *DB, files []*fileMetadata, opts sstable.IterOptions) *levelIterator {
+	return &levelIterator{
+		d:         d,
+		files:     files,
+		opts:      opts,
+		loaded:    make([]bool, len(files)),
+		fileTombs: make([]table.RangeTombstones, len(files)),
+	}
+}
+
+// open 切换到第index个文件，index越界时关闭当前文件
+func (l *levelIterator) open(index int) bool {
+	l.closeFile()
+	l.index = index
+	if index < 0 || index >= len(l.files) {
+		return false
+	}
+	h, err := l.d.tc.Acquire(l.files[index].fileNum)
+	if err != nil {
+		l.err = err
+		return false
+	}
+	l.h, l.iter = h, h.Reader().NewIterator(&l.opts)
+	if !l.loaded[index] {
+		l.loaded[index] = true
+		if ts := h.Reader().RangeTombstones(); len(ts) > 0 {
+			l.fileTombs[index] = ts
+			l.tombs = l.tombs[:0]
+			for _, ts := range l.fileTombs {
+				l.tombs = append(l.tombs, ts...)
+			}
+		}
+	}
+	return true
+}
+
+func (l *levelIterator) closeFile() {
+	if l.iter == nil {
+		return
+	}
+	if err := l.iter.Close(); err != nil && l.err == nil {
+		l.err = err
+	}
+	l.h.Release()
+	l.h, l.iter = nil, nil
+}
+
+// forward 当前文件结束时依次打开之后的文件
+func (l *levelIterator) forward(ok bool) bool {
+	for !ok {
+		if l.iter != nil {
+			if err := l.iter.Error(); err != nil {
+				l.err = err
+			}
+		}
+		if l.err != nil || !l.open(l.index+1) {
+			return false
+		}
+		ok = l.iter.First()
+	}
+	return true
+}
+
+// backward 当前文件结束时依次打开之前的文件
+func (l *levelIterator) backward(ok bool) bool {
+	for !ok {
+		if l.iter != nil {
+			if err := l.iter.Error(); err != nil {
+				l.err = err
+			}
+		}
+		if l.err != nil || !l.open(l.index-1) {
+			return false
+		}
+		ok = l.iter.Last()
+	}
+	return true
+}
+
+func (l *levelIterator) First() bool {
+	if !l.open(0) {
+		return false
+	}
+	return l.forward(l.iter.First())
+}
+
+func (l *levelIterator) Last() bool {
+	if !l.open(len(l.files) - 1) {
+		return false
+	}
+	return l.backward(l.iter.Last())
+}
+
+func (l *levelIterator) SeekGE(key table.Key) bool {
+	i := sort.Search(len(l.files), func(i int) bool {
+		return !l.files[i].afterLargest(key.Key())
+	})
+	if !l.open(i) {
+		return false
+	}
+	return l.forward(l.iter.SeekGE(key))
+}
+
+func (l *levelIterator) SeekLT(key table.Key) bool {
+	i := sort.Search(len(l.files), func(i int) bool {
+		return bytes.Compare(l.files[i].smallest.Key(), key.Key()) >= 0
+	})
+	if !l.open(i - 1) {
+		return false
+	}
+	return l.backward(l.iter.SeekLT(key))
+}
+
+func (l *levelIterator) Next() bool {
+	if l.iter == nil {
+		return false
+	}
+	return l.forward(l.iter.Next())
+}
+
+func (l *levelIterator) Prev() bool {
+	if l.iter == nil {
+		return false
+	}
+	return l.backward(l.iter.Prev())
+}
+
+func (l *levelIterator) Valid() bool {
+	return l.iter != nil && l.iter.Valid()
+}
+
+func (l *levelIterator) Key() table.Key {
+	return l.iter.Key()
+}
+
+func (l *levelIterator) Value() []byte {
+	return l.iter.Value()
+}
+
+func (l *levelIterator) Error() error {
+	return l.err
+}
+
+func (l *levelIterator) Close() error {
+	l.closeFile()
+	return l.err
+}
+
+// Iterator 数据库上的双向迭代器，按key升序遍历每个key最新的可见版本，跳过被删除和已经过期的key
+// 迭代器看到的是创建时的数据，之后的写入序列号更大，不可见，是否过期也按创建时的时间判断；Key和Value在下一次移动迭代器之前有效
+// 使用完之后必须调用Close
+type Iterator struct {
+	d    *DB
+	rs   readState
+	iter *mergingIterator
+	// 内存表的范围删除标记，文件的范围删除标记由每一层的levelIterator读取
+	tombs  table.RangeTombstones
+	levels []*levelIterator
+	// 创建时的时间，unix纳秒
+	now   int64
+	lower []byte
+	upper []byte
+	// 1表示iter正向定位，-1表示反向定位
+	dir   int
+	valid bool
+	key   []byte
+	val   []byte
+	err   error
+}
+
+// NewIterator 创建迭代器，ro为nil时读取最新的数据，新建的迭代器需要先定位
+// 迭代器直接遍历当前的内存表，不冻结它；创建时只读取内存表的范围删除标记，文件在遍历到时才打开
+func (d *DB) NewIterator(ro *ReadOptions) (*Iterator, error) {
+	return d.NewIteratorCF(d.defaultCF, ro)
+}
+
+// NewIteratorCF 创建遍历列族cf的迭代器
+func (d *DB) NewIteratorCF(cf *ColumnFamily, ro *ReadOptions) (*Iterator, error) {
+	d.mu.Lock()
+	if err := d.checkFamily(cf); err != nil {
+		d.mu.Unlock()
+		return nil, err
+	}
+	rs, err := d.acquireReadState(cf, ro)
+	if err != nil {
+		d.mu.Unlock()
+		return nil, err
+	}
+	it := &Iterator{d: d, rs: rs, now: d.now()}
+	if ro != nil {
+		it.lower, it.upper = ro.LowerBound, ro.UpperBound
+	}
+	// 内存表flush之后迭代器仍然遍历原来的内存表；之后新加入的范围删除标记比rs.seq新，不需要读取
+	iters := []internalIterator{&memIterator{mu: &d.mu, list: rs.mem}}
+	it.tombs = append(table.RangeTombstones(nil), rs.mem.RangeTombstones()...)
+	d.mu.Unlock()
+
+	// 被范围删除标记覆盖的记录可能对快照可见，统一在hidden中判断
+	opts := sstable.IterOptions{LowerBound: it.lower, UpperBound: it.upper, KeepCovered: true}
+	for level, files := range rs.version.levels {
+		var overlaps []*fileMetadata
+		for _, f := range files {
+			// 上界不包含在范围内
+			if !f.overlaps(it.lower, it.upper) || (it.upper != nil && bytes.Equal(f.smallest.Key(), it.upper)) {
+				continue
+			}
+			overlaps = append(overlaps, f)
+		}
+		if level == 0 {
+			// L0的文件互相重叠，每个文件单独遍历
+			for _, f := range overlaps {
+				it.levels = append(it.levels, newLevelIterator(d, []*fileMetadata{f}, opts))
+			}
+		} else if len(overlaps) > 0 {
+			it.levels = append(it.levels, newLevelIterator(d, overlaps, opts))
+		}
+	}
+	for _, l := range it.levels {
+		iters = append(iters, l)
+	}
+	it.iter = newMergingIterator(iters...)
+	return it, nil
+}
+
+// hidden iter当前的记录是否被删除、已经过期，或者被范围删除标记覆盖
+func (it *Iterator) hidden(k table.Key) bool {
+	if k.Kind() == table.KindDelete || table.Expired(k.Kind(), it.iter.Value(), it.now) || it.tombs.Covers(k, it.rs.seq) {
+		return true
+	}
+	for _, l := range it.levels {
+		if l.tombs.Covers(k, it.rs.seq) {
+			return true
+		}
+	}
+	return false
+}
+
+// findNext 从iter的当前位置向后找到第一个可见的key，跳过比读取的序列号新的记录
+// 相同的user key从新到旧排列，第一个版本不可见时这个key的所有版本都跳过
+func (it *Iterator) findNext() bool {
+	it.valid = false
+	for it.iter.Valid() {
+		k := it.iter.Key()
+		if it.upper != nil && bytes.Compare(k.Key(), it.upper) >= 0 {
+			break
+		}
+		if k.Seq() > it.rs.seq {
+			it.iter.Next()
+			continue
+		}
+		it.key = append(it.key[:0], k.Key()...)
+		if it.hidden(k) {
+			it.skipForward()
+			continue
+		}
+		it.val = append(it.val[:0], table.UserValue(k.Kind(), it.iter.Value())...)
+		it.valid = true
+		return true
+	}
+	it.err = it.iter.Error()
+	return false
+}
+
+// findPrev 从iter的当前位置向前找到第一个可见的key
+// 反向时相同的user key从旧到新排列，需要遍历完一个user key的所有版本才知道最新的可见版本，
+// 结束时iter位于上一个user key的第一个版本，下一次Prev从这里继续
+func (it *Iterator) findPrev() bool {
+	it.valid = false
+	for it.iter.Valid() {
+		k := it.iter.Key()
+		if it.lower != nil && bytes.Compare(k.Key(), it.lower) < 0 {
+			break
+		}
+		if k.Seq() <= it.rs.seq {
+			if it.valid && !bytes.Equal(k.Key(), it.key) {
+				return true
+			}
+			// 更新的版本遮盖之前找到的版本
+			it.key = append(it.key[:0], k.Key()...)
+			it.valid = !it.hidden(k)
+			if it.valid {
+				it.val = append(it.val[:0], table.UserValue(k.Kind(), it.iter.Value())...)
+			}
+		}
+		it.iter.Prev()
+	}
+	if it.err = it.iter.Error(); it.err != nil {
+		it.valid = false
+	}
+	return it.valid
+}
+
+// skipForward 跳过user key等于it.key的所有版本
+func (it *Iterator) skipForward() {
+	for it.iter.Valid() && bytes.Equal(it.iter.Key().Key(), it.key) {
+		it.iter.Next()
+	}
+}
+
+// First 定位到第一个key，有下界时定位到下界
+func (it *Iterator) First() bool {
+	if it.lower != nil {
+		return it.SeekGE(it.lower)
+	}
+	it.dir = 1
+	it.iter.First()
+	return it.findNext()
+}
+
+// Last 定位到最后一个key，有上界时定位到上界之前
+func (it *Iterator) Last() bool {
+	if it.upper != nil {
+		return it.SeekLT(it.upper)
+	}
+	it.dir = -1
+	it.iter.Last()
+	return it.findPrev()
+}
+
+// SeekGE 定位到第一个大于等于key的位置
+func (it *Iterator) SeekGE(key []byte) bool {
+	if it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+		key = it.lower
+	}
+	it.dir = 1
+	it.iter.SeekGE(table.NewSearchKey(key))
+	return it.findNext()
+}
+
+// SeekLT 定位到最后一个小于key的位置
+func (it *Iterator) SeekLT(key []byte) bool {
+	if it.upper != nil && bytes.Compare(key, it.upper) > 0 {
+		key = it.upper
+	}
+	it.dir = -1
+	it.iter.SeekLT(table.NewSearchKey(key))
+	return it.findPrev()
+}
+
+// Next 移动到下一个key，迭代器无效时返回false
+func (it *Iterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	if it.dir < 0 {
+		// 反向定位时改为定位到下一个user key
+		it.dir = 1
+		it.iter.SeekGE(table.NewSearchKey(append(append([]byte(nil), it.key...), 0)))
+	} else {
+		it.skipForward()
+	}
+	return it.findNext()
+}
+
+// Prev 移动到上一个key，迭代器无效时返回false
+func (it *Iterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	if it.dir > 0 {
+		it.dir = -1
+		it.iter.SeekLT(table.NewSearchKey(it.key))
+	}
+	return it.findPrev()
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.val
+}
+
+func (it *Iterator) Error() error {
+	return it.err
+}
+
+// Close 关闭迭代器，释放它引用的文件
+func (it *Iterator) Close() error {
+	if it.iter == nil {
+		return it.err
+	}
+	err := it.iter.Close()
+	it.iter, it.valid = nil, false
+	it.d.unrefVersion(it.rs.version)
+	if it.err != nil {
+		return it.err
+	}
+	return err
+}
@@ -0,0 +1,268 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/InsZVA/saver/sstable"
+)
+
+// expectScan 正向和反向遍历it，结果应该与keys和model一致
+func expectScan(t *testing.T, it *Iterator, keys []string, model map[string]string) {
+	n := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		if n >= len(keys) || string(it.Key()) != keys[n] || string(it.Value()) != model[keys[n]] {
+			t.Fatalf("正向遍历第%d个错误: %s %s", n, it.Key(), it.Value())
+		}
+		n++
+	}
+	if it.Error() != nil || n != len(keys) {
+		t.Fatal("正向遍历数量错误", n, len(keys), it.Error())
+	}
+	n = len(keys)
+	for ok := it.Last(); ok; ok = it.Prev() {
+		n--
+		if n < 0 || string(it.Key()) != keys[n] || string(it.Value()) != model[keys[n]] {
+			t.Fatalf("反向遍历第%d个错误: %s %s", n, it.Key(), it.Value())
+		}
+	}
+	if it.Error() != nil || n != 0 {
+		t.Fatal("反向遍历数量错误", n, it.Error())
+	}
+}
+
+func sortedKeys(model map[string]string, lower, upper string) []string {
+	var keys []string
+	for k := range model {
+		if (lower == "" || k >= lower) && (upper == "" || k < upper) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestIterator(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_iterator", &Options{
+		MemTableSize:        8 * 1024,
+		L0CompactionTrigger: 2,
+		BaseLevelSize:       32 * 1024,
+		TargetFileSize:      8 * 1024,
+	})
+	defer d.Close()
+	model := make(map[string]string)
+	key := func(i int) string {
+		return fmt.Sprintf("key%05d", i)
+	}
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 20000; n++ {
+		i := r.Intn(2000)
+		switch op := r.Intn(100); {
+		case op < 75:
+			model[key(i)] = fmt.Sprint(n)
+			d.Put([]byte(key(i)), []byte(fmt.Sprint(n)))
+		case op < 98:
+			delete(model, key(i))
+			d.Delete([]byte(key(i)))
+		default:
+			for j := i; j < i+30; j++ {
+				delete(model, key(j))
+			}
+			d.DeleteRange([]byte(key(i)), []byte(key(i+30)))
+		}
+		if n%5000 == 4999 {
+			it, err := d.NewIterator(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expectScan(t, it, sortedKeys(model, "", ""), model)
+			it.Close()
+		}
+	}
+
+	it, err := d.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := sortedKeys(model, "", "")
+	// 随机定位并改变方向
+	for n := 0; n < 1000; n++ {
+		target := key(r.Intn(2100))
+		i := sort.SearchStrings(keys, target)
+		if r.Intn(2) == 0 {
+			ok := it.SeekGE([]byte(target))
+			if ok != (i < len(keys)) || (ok && string(it.Key()) != keys[i]) {
+				t.Fatal("SeekGE错误", target, string(it.Key()))
+			}
+		} else {
+			i--
+			ok := it.SeekLT([]byte(target))
+			if ok != (i >= 0) || (ok && string(it.Key()) != keys[i]) {
+				t.Fatal("SeekLT错误", target, string(it.Key()))
+			}
+		}
+		for step := 0; step < 5 && i >= 0 && i < len(keys); step++ {
+			if r.Intn(2) == 0 {
+				i++
+				ok := it.Next()
+				if ok != (i < len(keys)) || (ok && string(it.Key()) != keys[i]) {
+					t.Fatal("Next错误", string(it.Key()))
+				}
+			} else {
+				i--
+				ok := it.Prev()
+				if ok != (i >= 0) || (ok && string(it.Key()) != keys[i]) {
+					t.Fatal("Prev错误", string(it.Key()))
+				}
+			}
+		}
+	}
+	// 创建之后的写入不可见
+	d.Put([]byte("zzz"), []byte("new"))
+	d.DeleteRange([]byte(key(0)), []byte(key(1000)))
+	d.Flush()
+	expectScan(t, it, keys, model)
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lower, upper := key(1500), key(1800)
+	it, err = d.NewIterator(&ReadOptions{LowerBound: []byte(lower), UpperBound: []byte(upper)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectScan(t, it, sortedKeys(model, lower, upper), model)
+	if it.SeekGE([]byte(key(0))); string(it.Key()) < lower {
+		t.Error("SeekGE越过了下界", string(it.Key()))
+	}
+	if it.SeekLT([]byte("zzzz")); it.Valid() && string(it.Key()) >= upper {
+		t.Error("SeekLT越过了上界", string(it.Key()))
+	}
+	it.Close()
+}
+
+func TestIteratorSnapshot(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_iterator_snapshot", nil)
+	defer d.Close()
+	d.Put([]byte("a"), []byte("1"))
+	d.Put([]byte("b"), []byte("1"))
+	d.Flush()
+	d.Put([]byte("c"), []byte("1"))
+	s := d.GetSnapshot()
+	defer s.Release()
+	d.Put([]byte("a"), []byte("2"))
+	d.Delete([]byte("b"))
+	d.DeleteRange([]byte("c"), []byte("d"))
+	d.Put([]byte("d"), []byte("2"))
+
+	it, err := d.NewIterator(&ReadOptions{Snapshot: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := map[string]string{"a": "1", "b": "1", "c": "1"}
+	expectScan(t, it, sortedKeys(old, "", ""), old)
+	it.Close()
+
+	it, err = d.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := map[string]string{"a": "2", "d": "2"}
+	expectScan(t, it, sortedKeys(cur, "", ""), cur)
+	it.Close()
+
+	s.Release()
+	if _, err := d.NewIterator(&ReadOptions{Snapshot: s}); err != errSnapshotReleased {
+		t.Error("不能用释放的快照创建迭代器", err)
+	}
+}
+
+func TestIteratorConcurrentWrite(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_iterator_concurrent", &Options{MemTableSize: 16 * 1024, L0CompactionTrigger: 2})
+	defer d.Close()
+	key := func(i int) string {
+		return fmt.Sprintf("key%04d", i)
+	}
+	model := make(map[string]string)
+	for i := 0; i < 1000; i += 2 {
+		model[key(i)] = "old"
+		d.Put([]byte(key(i)), []byte("old"))
+	}
+	mem := d.defaultCF.mem
+	it, err := d.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	if d.defaultCF.mem != mem {
+		t.Error("创建迭代器时不应该冻结内存表")
+	}
+	// 迭代期间写入同一个内存表，写满之后flush并compact
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < 3; n++ {
+			for i := 0; i < 1000; i++ {
+				d.Put([]byte(key(i)), []byte(fmt.Sprint(n)))
+			}
+		}
+		d.DeleteRange([]byte(key(0)), []byte(key(500)))
+	}()
+	keys := sortedKeys(model, "", "")
+	for n := 0; n < 5; n++ {
+		expectScan(t, it, keys, model)
+	}
+	<-done
+	expectScan(t, it, keys, model)
+}
+
+func TestIteratorLazyOpen(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_iterator_lazy", &Options{L0CompactionTrigger: 100})
+	defer d.Close()
+	writeExternalFile(t, "/tmp/saver_iterator_lazy_1", []string{"a", "b", "c"}, "v")
+	writeExternalFile(t, "/tmp/saver_iterator_lazy_2", []string{"x", "y", "z"}, "v")
+	for _, path := range []string{"/tmp/saver_iterator_lazy_1", "/tmp/saver_iterator_lazy_2"} {
+		if err := d.IngestExternalFiles([]string{path}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// L0中只有一个范围删除标记，覆盖了下层两个文件中的部分key
+	d.DeleteRange([]byte("b"), []byte("y"))
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 创建迭代器时不打开任何文件
+	var paths []string
+	for _, files := range d.defaultCF.current.levels {
+		for _, f := range files {
+			d.tc.Evict(f.fileNum)
+			path := sstable.TableFileName(d.dirname, f.fileNum)
+			if err := os.Rename(path, path+".moved"); err != nil {
+				t.Fatal(err)
+			}
+			paths = append(paths, path)
+		}
+	}
+	it, err := d.NewIterator(nil)
+	for _, path := range paths {
+		os.Rename(path+".moved", path)
+	}
+	if err != nil {
+		t.Fatal("创建迭代器时不应该打开文件", err)
+	}
+	defer it.Close()
+	model := map[string]string{"a": "va", "y": "vy", "z": "vz"}
+	expectScan(t, it, sortedKeys(model, "", ""), model)
+	for _, key := range []string{"b", "c", "x"} {
+		if it.SeekGE([]byte(key)); !it.Valid() || string(it.Key()) != "y" {
+			t.Errorf("SeekGE(%s)应该定位到y", key)
+		}
+		if it.SeekLT([]byte(key)); !it.Valid() || string(it.Key()) != "a" {
+			t.Errorf("SeekLT(%s)应该定位到a", key)
+		}
+	}
+}
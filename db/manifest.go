@@ -0,0 +1,438 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/InsZVA/saver/record"
+	"github.com/InsZVA/saver/table"
+)
+
+var (
+	errBrokenManifest  = errors.New("MANIFEST已损坏")
+	errBrokenCurrent   = errors.New("CURRENT文件已损坏")
+	errMissingManifest = errors.New("MANIFEST中缺少必要的字段")
+)
+
+/*
+MANIFEST中每条记录是一个versionEdit的编码，由若干个字段组成，每个字段以一个字节的tag开头:
+tagLogNum:      [logNum64]
+tagNextFileNum: [nextFileNum64]
+tagLastSeq:     [lastSeq64]
+tagDeletedFile: [level8][fileNum64]
+tagNewFile:     [level8][fileNum64][size64][minSeq64][maxSeq64][smallest][largest]
+tagColumnFamily:    [id32]
+tagNewColumnFamily: [nameLength32][name...]
+tagDropColumnFamily
+tagMaxColumnFamily: [id32]
+tagBlobRef:     [blobFileNum64][length64] 紧跟在tagNewFile之后，表示这个文件引用的blob文件，每个blob文件一个
+key的编码为[keyLength32][key...][seq<<8|kind 64]
+每条记录只修改一个列族，没有tagColumnFamily时修改默认列族
+每个MANIFEST开头的记录是完整的状态，每个列族一条，CURRENT中保存当前使用的MANIFEST的文件名
+*/
+const (
+	tagLogNum = iota + 1
+	tagNextFileNum
+	tagLastSeq
+	tagDeletedFile
+	tagNewFile
+	tagColumnFamily
+	tagNewColumnFamily
+	tagDropColumnFamily
+	tagMaxColumnFamily
+	tagBlobRef
+)
+
+const currentFileName = "CURRENT"
+
+func manifestFileName(dirname string, fileNum uint64) string {
+	return filepath.Join(dirname, fmt.Sprintf("MANIFEST-%06d", fileNum))
+}
+
+func tempFileName(dirname string, fileNum uint64) string {
+	return filepath.Join(dirname, fmt.Sprintf("%06d.dbtmp", fileNum))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func appendKey(buf []byte, k table.Key) []byte {
+	buf = appendUint32(buf, uint32(len(k.Key())))
+	buf = append(buf, k.Key()...)
+	return appendUint64(buf, k.Seq()<<8|uint64(k.Kind()))
+}
+
+func (edit *versionEdit) setLogNum(num uint64) {
+	edit.hasLogNum, edit.logNum = true, num
+}
+
+func (edit *versionEdit) encode() []byte {
+	var buf []byte
+	if edit.cf != defaultColumnFamilyID {
+		buf = appendUint32(append(buf, tagColumnFamily), edit.cf)
+	}
+	if edit.newFamily != "" {
+		buf = appendUint32(append(buf, tagNewColumnFamily), uint32(len(edit.newFamily)))
+		buf = append(buf, edit.newFamily...)
+	}
+	if edit.dropFamily {
+		buf = append(buf, tagDropColumnFamily)
+	}
+	if edit.hasMaxColumnFamily {
+		buf = appendUint32(append(buf, tagMaxColumnFamily), edit.maxColumnFamily)
+	}
+	if edit.hasLogNum {
+		buf = appendUint64(append(buf, tagLogNum), edit.logNum)
+	}
+	if edit.hasNextFileNum {
+		buf = appendUint64(append(buf, tagNextFileNum), edit.nextFileNum)
+	}
+	if edit.hasLastSeq {
+		buf = appendUint64(append(buf, tagLastSeq), edit.lastSeq)
+	}
+	deleted := make([]deletedFile, 0, len(edit.deleted))
+	for f := range edit.deleted {
+		deleted = append(deleted, f)
+	}
+	sort.Slice(deleted, func(i, j int) bool {
+		if deleted[i].level != deleted[j].level {
+			return deleted[i].level < deleted[j].level
+		}
+		return deleted[i].fileNum < deleted[j].fileNum
+	})
+	for _, f := range deleted {
+		buf = appendUint64(append(buf, tagDeletedFile, byte(f.level)), f.fileNum)
+	}
+	for _, nf := range edit.added {
+		m := nf.meta
+		buf = append(buf, tagNewFile, byte(nf.level))
+		buf = appendUint64(buf, m.fileNum)
+		buf = appendUint64(buf, m.size)
+		buf = appendUint64(buf, m.minSeq)
+		buf = appendUint64(buf, m.maxSeq)
+		buf = appendKey(buf, m.smallest)
+		buf = appendKey(buf, m.largest)
+		blobNums := make([]uint64, 0, len(m.blobRefs))
+		for blobNum := range m.blobRefs {
+			blobNums = append(blobNums, blobNum)
+		}
+		sort.Slice(blobNums, func(i, j int) bool {
+			return blobNums[i] < blobNums[j]
+		})
+		for _, blobNum := range blobNums {
+			buf = appendUint64(append(buf, tagBlobRef), blobNum)
+			buf = appendUint64(buf, m.blobRefs[blobNum])
+		}
+	}
+	return buf
+}
+
+// editDecoder 依次读取versionEdit编码中的字段，出错之后的读取都返回0
+type editDecoder struct {
+	data []byte
+	err  error
+}
+
+func (dec *editDecoder) uint32() uint32 {
+	if len(dec.data) < 4 {
+		dec.err = errBrokenManifest
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(dec.data)
+	dec.data = dec.data[4:]
+	return v
+}
+
+func (dec *editDecoder) uint64() uint64 {
+	if len(dec.data) < 8 {
+		dec.err = errBrokenManifest
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(dec.data)
+	dec.data = dec.data[8:]
+	return v
+}
+
+func (dec *editDecoder) level() int {
+	if len(dec.data) < 1 || int(dec.data[0]) >= numLevels {
+		dec.err = errBrokenManifest
+		return 0
+	}
+	level := int(dec.data[0])
+	dec.data = dec.data[1:]
+	return level
+}
+
+// bytes 读取[length32][data...]
+func (dec *editDecoder) bytes() []byte {
+	n := int(dec.uint32())
+	if dec.err != nil || len(dec.data) < n {
+		dec.err = errBrokenManifest
+		return nil
+	}
+	b := append([]byte(nil), dec.data[:n]...)
+	dec.data = dec.data[n:]
+	return b
+}
+
+func (dec *editDecoder) key() table.Key {
+	key := dec.bytes()
+	if dec.err != nil {
+		return table.Key{}
+	}
+	trailer := dec.uint64()
+	return table.NewInternalKey(key, trailer>>8, table.Kind(trailer&0xff))
+}
+
+func decodeVersionEdit(data []byte) (*versionEdit, error) {
+	edit := &versionEdit{}
+	dec := &editDecoder{data: data}
+	for len(dec.data) > 0 && dec.err == nil {
+		tag := dec.data[0]
+		dec.data = dec.data[1:]
+		switch tag {
+		case tagColumnFamily:
+			edit.cf = dec.uint32()
+		case tagNewColumnFamily:
+			edit.newFamily = string(dec.bytes())
+			if dec.err == nil && edit.newFamily == "" {
+				return nil, errBrokenManifest
+			}
+		case tagDropColumnFamily:
+			edit.dropFamily = true
+		case tagMaxColumnFamily:
+			edit.hasMaxColumnFamily, edit.maxColumnFamily = true, dec.uint32()
+		case tagLogNum:
+			edit.setLogNum(dec.uint64())
+		case tagNextFileNum:
+			edit.hasNextFileNum, edit.nextFileNum = true, dec.uint64()
+		case tagLastSeq:
+			edit.hasLastSeq, edit.lastSeq = true, dec.uint64()
+		case tagDeletedFile:
+			level := dec.level()
+			edit.deleteFile(level, dec.uint64())
+		case tagNewFile:
+			level := dec.level()
+			m := &fileMetadata{}
+			m.fileNum = dec.uint64()
+			m.size = dec.uint64()
+			m.minSeq = dec.uint64()
+			m.maxSeq = dec.uint64()
+			m.smallest = dec.key()
+			m.largest = dec.key()
+			edit.addFile(level, m)
+		case tagBlobRef:
+			if len(edit.added) == 0 {
+				return nil, errBrokenManifest
+			}
+			m := edit.added[len(edit.added)-1].meta
+			if m.blobRefs == nil {
+				m.blobRefs = make(map[uint64]uint64)
+			}
+			blobNum := dec.uint64()
+			m.blobRefs[blobNum] = dec.uint64()
+		default:
+			return nil, errBrokenManifest
+		}
+	}
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	return edit, nil
+}
+
+// load 从CURRENT指向的MANIFEST恢复所有的version edit，CURRENT不存在时返回false
+func (vs *versionSet) load() (bool, error) {
+	current, err := ioutil.ReadFile(filepath.Join(vs.dirname, currentFileName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	name := string(current)
+	if !strings.HasSuffix(name, "\n") || strings.ContainsAny(name[:len(name)-1], "/\n") {
+		return false, errBrokenCurrent
+	}
+	f, err := os.Open(filepath.Join(vs.dirname, name[:len(name)-1]))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var hasNextFileNum, hasLastSeq bool
+	r := record.NewReader(f)
+	for {
+		data, err := r.Read()
+		// 最后一条记录不完整说明写入时崩溃了，这个edit没有生效
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		edit, err := decodeVersionEdit(data)
+		if err != nil {
+			return false, err
+		}
+		if err := vs.applyEdit(edit); err != nil {
+			return false, err
+		}
+		if edit.hasNextFileNum {
+			hasNextFileNum, vs.nextFileNum = true, edit.nextFileNum
+		}
+		if edit.hasLastSeq {
+			hasLastSeq, vs.lastSeq = true, edit.lastSeq
+		}
+	}
+	if !hasNextFileNum || !hasLastSeq {
+		return false, errMissingManifest
+	}
+	// MANIFEST中删除的文件在打开时由removeObsoleteFiles统一清理
+	vs.obsolete = make(map[uint64]bool)
+	vs.obsoleteBlobs = make(map[uint64]bool)
+	return true, nil
+}
+
+// snapshot 记录当前完整状态的versionEdit，每个列族一个，作为新MANIFEST开头的记录
+// 第一个是默认列族，同时记录用过的最大的列族编号
+func (vs *versionSet) snapshot() []*versionEdit {
+	var edits []*versionEdit
+	for _, cf := range vs.familyList() {
+		edit := &versionEdit{cf: cf.id}
+		if cf.id != defaultColumnFamilyID {
+			edit.newFamily = cf.name
+		}
+		edit.setLogNum(cf.logNum)
+		for level, files := range cf.current.levels {
+			for _, f := range files {
+				edit.addFile(level, f)
+			}
+		}
+		edits = append(edits, edit)
+	}
+	edits[0].hasMaxColumnFamily, edits[0].maxColumnFamily = true, vs.maxColumnFamily
+	return edits
+}
+
+// createManifest 创建新的MANIFEST，写入当前的完整状态之后让CURRENT指向它，并删除旧的MANIFEST
+func (vs *versionSet) createManifest() error {
+	num := vs.newFileNum()
+	path := manifestFileName(vs.dirname, num)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := record.NewWriter(f)
+	var size uint64
+	for _, edit := range vs.snapshot() {
+		edit.hasNextFileNum, edit.nextFileNum = true, vs.nextFileNum
+		edit.hasLastSeq, edit.lastSeq = true, vs.lastSeq
+		data := edit.encode()
+		if _, err = w.Write(data); err != nil {
+			break
+		}
+		size += uint64(len(data))
+	}
+	if err == nil {
+		err = w.Sync()
+	}
+	if err == nil {
+		err = setCurrentFile(vs.dirname, num)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if vs.manifest != nil {
+		vs.manifestFile.Close()
+		os.Remove(manifestFileName(vs.dirname, vs.manifestNum))
+	}
+	vs.manifestNum, vs.manifestFile, vs.manifest = num, f, w
+	vs.manifestSize = size
+	return nil
+}
+
+// setCurrentFile 先写入临时文件再重命名，保证CURRENT总是完整的
+func setCurrentFile(dirname string, manifestNum uint64) error {
+	tmp := tempFileName(dirname, manifestNum)
+	content := filepath.Base(manifestFileName(dirname, manifestNum)) + "\n"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(content); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dirname, currentFileName))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// 重命名以及新的MANIFEST只有在目录同步之后才不会因为断电丢失
+	return syncDir(dirname)
+}
+
+// syncDir 把目录中文件的创建、重命名和删除同步到磁盘
+func syncDir(dirname string) error {
+	f, err := os.Open(dirname)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// logAndApply 把edit写入MANIFEST之后再应用到内存中，没有打开MANIFEST时只应用到内存中
+// MANIFEST超过maxManifestSize时先切换到新的MANIFEST再写入edit，切换失败时返回错误，edit不生效
+func (vs *versionSet) logAndApply(edit *versionEdit) error {
+	if vs.manifest != nil {
+		if vs.manifestSize >= vs.maxManifestSize {
+			if err := vs.createManifest(); err != nil {
+				return err
+			}
+		}
+		edit.hasNextFileNum, edit.nextFileNum = true, vs.nextFileNum
+		edit.hasLastSeq, edit.lastSeq = true, vs.lastSeq
+		data := edit.encode()
+		if _, err := vs.manifest.Write(data); err != nil {
+			return err
+		}
+		if err := vs.manifest.Sync(); err != nil {
+			return err
+		}
+		vs.manifestSize += uint64(len(data))
+	}
+	return vs.applyEdit(edit)
+}
+
+func (vs *versionSet) close() error {
+	if vs.manifest == nil {
+		return nil
+	}
+	return vs.manifest.Close()
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/InsZVA/saver/table"
+)
+
+func TestVersionEditEncode(t *testing.T) {
+	edit := &versionEdit{}
+	edit.setLogNum(3)
+	edit.hasNextFileNum, edit.nextFileNum = true, 10
+	edit.hasLastSeq, edit.lastSeq = true, 1000
+	edit.deleteFile(1, 5)
+	edit.deleteFile(0, 6)
+	m := testMeta(7, "a", "z", 20)
+	m.largest = table.NewInternalKey([]byte("z"), table.MaxSeq, table.KindRangeDelete)
+	m.size, m.minSeq = 4096, 8
+	m.blobRefs = map[uint64]uint64{12: 300, 11: 100}
+	edit.addFile(2, m)
+	edit.addFile(0, testMeta(8, "0", "b", 30))
+
+	data := edit.encode()
+	got, err := decodeVersionEdit(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, edit) {
+		t.Errorf("解码结果错误: %+v，应该为%+v", got, edit)
+	}
+	if _, err := decodeVersionEdit(data[:len(data)-1]); err != errBrokenManifest {
+		t.Error("截断的edit应该解码失败", err)
+	}
+	if _, err := decodeVersionEdit([]byte{tagBlobRef + 1}); err != errBrokenManifest {
+		t.Error("未知的tag应该解码失败", err)
+	}
+	if _, err := decodeVersionEdit(appendUint64(appendUint64([]byte{tagBlobRef}, 1), 1)); err != errBrokenManifest {
+		t.Error("没有文件的blob引用应该解码失败", err)
+	}
+
+	for _, edit := range []*versionEdit{
+		{cf: 2, newFamily: "users", hasMaxColumnFamily: true, maxColumnFamily: 5},
+		{cf: 3, dropFamily: true},
+	} {
+		got, err := decodeVersionEdit(edit.encode())
+		if err != nil || !reflect.DeepEqual(got, edit) {
+			t.Errorf("列族的edit解码错误: %+v，应该为%+v %v", got, edit, err)
+		}
+	}
+}
+
+// levelFiles 每层的文件编号
+func levelFiles(d *DB) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.waitForCompaction()
+	var ret [numLevels][]uint64
+	for level, files := range d.defaultCF.current.levels {
+		for _, f := range files {
+			ret[level] = append(ret[level], f.fileNum)
+		}
+	}
+	return fmt.Sprint(ret)
+}
+
+func TestManifestReopen(t *testing.T) {
+	dirname := "/tmp/saver_db_manifest"
+	opts := &Options{MemTableSize: 4096, L0CompactionTrigger: 2, TargetFileSize: 4096}
+	d := openTestDB(t, dirname, opts)
+	for i := 0; i < 2000; i++ {
+		d.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	d.Delete([]byte("key00005"))
+	d.DeleteRange([]byte("key00100"), []byte("key00200"))
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	layout := levelFiles(d)
+	lastSeq, nextFileNum := d.vs.lastSeq, d.vs.nextFileNum
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 不在version中的文件在打开时被删除
+	orphan := filepath.Join(dirname, "999999.sst")
+	ioutil.WriteFile(orphan, []byte("orphan"), 0644)
+
+	d, err := Open(dirname, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := levelFiles(d); got != layout {
+		t.Errorf("重新打开之后文件分布错误: %v，应该为%v", got, layout)
+	}
+	if d.vs.lastSeq != lastSeq || d.vs.nextFileNum <= nextFileNum {
+		t.Error("序列号或文件编号没有恢复", d.vs.lastSeq, d.vs.nextFileNum)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("没有删除不在version中的文件")
+	}
+	current, _ := ioutil.ReadFile(filepath.Join(dirname, currentFileName))
+	if string(current) != filepath.Base(manifestFileName(dirname, d.vs.manifestNum))+"\n" {
+		t.Error("CURRENT错误", string(current))
+	}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		deleted := i == 5 || (i >= 100 && i < 200)
+		expectGet(t, d, key, fmt.Sprintf("value%d", i), !deleted)
+	}
+	// 重新打开之后的写入和compaction继续记录到MANIFEST中
+	for i := 0; i < 1000; i++ {
+		d.Put([]byte(fmt.Sprintf("key%05d", i)), []byte("new"))
+	}
+	d.Flush()
+	layout = levelFiles(d)
+	d.Close()
+	d, err = Open(dirname, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if got := levelFiles(d); got != layout {
+		t.Errorf("重新打开之后文件分布错误: %v，应该为%v", got, layout)
+	}
+	expectGet(t, d, "key00150", "new", true)
+	expectGet(t, d, "key01500", "value1500", true)
+}
+
+func TestManifestRotate(t *testing.T) {
+	dirname := "/tmp/saver_db_manifest_rotate"
+	opts := &Options{MaxManifestFileSize: 1, L0CompactionTrigger: 100}
+	d := openTestDB(t, dirname, opts)
+	for i := 0; i < 5; i++ {
+		d.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v"))
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	layout := levelFiles(d)
+	d.Close()
+	infos, _ := ioutil.ReadDir(dirname)
+	manifests := 0
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), "MANIFEST-") {
+			manifests++
+		}
+	}
+	if manifests != 1 {
+		t.Error("旧的MANIFEST没有删除", manifests)
+	}
+	d, err := Open(dirname, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if got := levelFiles(d); got != layout || d.defaultCF.current.levels[0] == nil || len(d.defaultCF.current.levels[0]) != 5 {
+		t.Errorf("切换MANIFEST之后文件分布错误: %v，应该为%v", got, layout)
+	}
+	for i := 0; i < 5; i++ {
+		expectGet(t, d, fmt.Sprintf("key%d", i), "v", true)
+	}
+}
+
+func TestManifestRotateError(t *testing.T) {
+	dirname := "/tmp/saver_db_manifest_rotate_error"
+	opts := &Options{MaxManifestFileSize: 1, L0CompactionTrigger: 100}
+	d := openTestDB(t, dirname, opts)
+	defer d.Close()
+	d.Put([]byte("a"), []byte("v"))
+	// 占用之后几个文件编号的MANIFEST文件名，新的MANIFEST无法创建
+	d.mu.Lock()
+	for num := d.vs.nextFileNum; num < d.vs.nextFileNum+5; num++ {
+		os.Mkdir(manifestFileName(dirname, num), 0755)
+	}
+	d.mu.Unlock()
+	if err := d.Flush(); err == nil {
+		t.Fatal("切换MANIFEST失败时Flush应该返回错误")
+	}
+	if err := d.Put([]byte("b"), []byte("v")); err == nil {
+		t.Error("切换MANIFEST失败之后不应该再接受写入")
+	}
+	if len(d.defaultCF.current.levels[0]) != 0 {
+		t.Error("没有写入MANIFEST的edit不应该生效")
+	}
+}
+
+func TestManifestBrokenCurrent(t *testing.T) {
+	dirname := "/tmp/saver_db_manifest_broken"
+	d := openTestDB(t, dirname, nil)
+	d.Close()
+	ioutil.WriteFile(filepath.Join(dirname, currentFileName), []byte("MANIFEST-000001"), 0644)
+	if _, err := Open(dirname, nil); err != errBrokenCurrent {
+		t.Error("损坏的CURRENT应该打开失败", err)
+	}
+}
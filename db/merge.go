@@ -0,0 +1,161 @@
+package db
+
+import (
+	"container/heap"
+
+	"github.com/InsZVA/saver/table"
+)
+
+// internalIterator 按table.Key.InternalCmp排列的双向迭代器，同一个user key可以有多个版本，从新到旧排列
+type internalIterator interface {
+	First() bool
+	Last() bool
+	SeekGE(key table.Key) bool
+	SeekLT(key table.Key) bool
+	Next() bool
+	Prev() bool
+	Valid() bool
+	Key() table.Key
+	Value() []byte
+	Error() error
+	Close() error
+}
+
+// mergingIterator 把多个internalIterator合并成一个，按user key排列，相同的user key按序列号从新到旧排列，
+// 序列号也相同时排在前面的迭代器优先；反向遍历时顺序完全相反，相同的user key从旧到新
+// First和SeekGE之后只能调用Next，Last和SeekLT之后只能调用Prev，改变方向需要重新定位
+type mergingIterator struct {
+	iters []internalIterator
+	h     mergeHeap
+	err   error
+}
+
+func newMergingIterator(iters ...internalIterator) *mergingIterator {
+	return &mergingIterator{iters: iters}
+}
+
+type mergeHeap struct {
+	iters []internalIterator
+	index []int
+	// 反向时按InternalCmp最大的在堆顶
+	reverse bool
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.index)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.iters[h.index[i]].Key(), h.iters[h.index[j]].Key()
+	if c := a.InternalCmp(b); c != 0 {
+		return (c < 0) != h.reverse
+	}
+	return h.index[i] < h.index[j]
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.index[i], h.index[j] = h.index[j], h.index[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	h.index = append(h.index, x.(int))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	n := len(h.index)
+	x := h.index[n-1]
+	h.index = h.index[:n-1]
+	return x
+}
+
+// init 用position定位每个迭代器，重新建立堆
+func (m *mergingIterator) init(reverse bool, position func(it internalIterator) bool) bool {
+	m.h = mergeHeap{iters: m.iters, reverse: reverse}
+	m.err = nil
+	for i, it := range m.iters {
+		if position(it) {
+			m.h.index = append(m.h.index, i)
+		} else if err := it.Error(); err != nil {
+			m.err = err
+			return false
+		}
+	}
+	heap.Init(&m.h)
+	return m.Valid()
+}
+
+func (m *mergingIterator) First() bool {
+	return m.init(false, internalIterator.First)
+}
+
+func (m *mergingIterator) Last() bool {
+	return m.init(true, internalIterator.Last)
+}
+
+// SeekGE 按InternalCmp定位到第一个大于等于key的位置
+func (m *mergingIterator) SeekGE(key table.Key) bool {
+	return m.init(false, func(it internalIterator) bool { return it.SeekGE(key) })
+}
+
+// SeekLT 按InternalCmp定位到最后一个小于key的位置
+func (m *mergingIterator) SeekLT(key table.Key) bool {
+	return m.init(true, func(it internalIterator) bool { return it.SeekLT(key) })
+}
+
+// step 移动堆顶的迭代器，迭代器结束时从堆中移除
+func (m *mergingIterator) step(move func(it internalIterator) bool) bool {
+	if !m.Valid() {
+		return false
+	}
+	it := m.iters[m.h.index[0]]
+	if move(it) {
+		heap.Fix(&m.h, 0)
+	} else if m.err = it.Error(); m.err == nil {
+		heap.Pop(&m.h)
+	}
+	return m.Valid()
+}
+
+func (m *mergingIterator) Next() bool {
+	return m.step(internalIterator.Next)
+}
+
+func (m *mergingIterator) Prev() bool {
+	return m.step(internalIterator.Prev)
+}
+
+func (m *mergingIterator) Valid() bool {
+	return m.err == nil && m.h.Len() > 0
+}
+
+func (m *mergingIterator) Key() table.Key {
+	return m.iters[m.h.index[0]].Key()
+}
+
+func (m *mergingIterator) Value() []byte {
+	return m.iters[m.h.index[0]].Value()
+}
+
+// RawValue 当前记录中实际保存的数据，分离到blob文件中的value返回编码后的指针，不读取blob文件
+func (m *mergingIterator) RawValue() []byte {
+	it := m.iters[m.h.index[0]]
+	if r, ok := it.(interface{ RawValue() []byte }); ok {
+		return r.RawValue()
+	}
+	return it.Value()
+}
+
+func (m *mergingIterator) Error() error {
+	return m.err
+}
+
+func (m *mergingIterator) Close() error {
+	err := m.err
+	for _, it := range m.iters {
+		if cerr := it.Close(); err == nil {
+			err = cerr
+		}
+	}
+	m.h = mergeHeap{}
+	return err
+}
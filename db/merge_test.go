@@ -0,0 +1,127 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/InsZVA/saver/table"
+)
+
+// sliceIterator 测试用的internalIterator
+type sliceIterator struct {
+	keys []table.Key
+	pos  int
+}
+
+func (it *sliceIterator) First() bool {
+	it.pos = 0
+	return it.Valid()
+}
+
+func (it *sliceIterator) Last() bool {
+	it.pos = len(it.keys) - 1
+	return it.Valid()
+}
+
+func (it *sliceIterator) SeekGE(key table.Key) bool {
+	it.pos = 0
+	for it.Valid() && it.Key().InternalCmp(key) < 0 {
+		it.pos++
+	}
+	return it.Valid()
+}
+
+func (it *sliceIterator) SeekLT(key table.Key) bool {
+	it.pos = len(it.keys) - 1
+	for it.Valid() && it.Key().InternalCmp(key) >= 0 {
+		it.pos--
+	}
+	return it.Valid()
+}
+
+func (it *sliceIterator) Next() bool {
+	it.pos++
+	return it.Valid()
+}
+
+func (it *sliceIterator) Prev() bool {
+	it.pos--
+	return it.Valid()
+}
+
+func (it *sliceIterator) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.keys)
+}
+
+func (it *sliceIterator) Key() table.Key {
+	return it.keys[it.pos]
+}
+
+func (it *sliceIterator) Value() []byte {
+	return []byte{byte(it.keys[it.pos].Seq())}
+}
+
+func (it *sliceIterator) Error() error {
+	return nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+func ik(key string, seq uint64) table.Key {
+	return table.NewInternalKey([]byte(key), seq, table.KindSet)
+}
+
+func TestMergingIterator(t *testing.T) {
+	it := newMergingIterator(
+		&sliceIterator{keys: []table.Key{ik("a", 1), ik("c", 5), ik("e", 2)}},
+		&sliceIterator{},
+		&sliceIterator{keys: []table.Key{ik("b", 3), ik("c", 7), ik("d", 1)}},
+		&sliceIterator{keys: []table.Key{ik("c", 6), ik("f", 9)}},
+	)
+	expect := []table.Key{ik("a", 1), ik("b", 3), ik("c", 7), ik("c", 6), ik("c", 5), ik("d", 1), ik("e", 2), ik("f", 9)}
+	n := 0
+	for it.First(); it.Valid(); it.Next() {
+		if n >= len(expect) || it.Key().Cmp(expect[n]) != 0 || it.Key().Seq() != expect[n].Seq() ||
+			it.Value()[0] != byte(expect[n].Seq()) {
+			t.Fatal("合并顺序错误", n, string(it.Key().Key()), it.Key().Seq())
+		}
+		n++
+	}
+	if n != len(expect) {
+		t.Error("合并数量错误", n)
+	}
+	if it.Next() {
+		t.Error("结束之后不应该还有元素")
+	}
+	// 反向时顺序完全相反，相同的user key从旧到新排列
+	reverse := []table.Key{ik("f", 9), ik("e", 2), ik("d", 1), ik("c", 5), ik("c", 6), ik("c", 7), ik("b", 3), ik("a", 1)}
+	n = 0
+	for it.Last(); it.Valid(); it.Prev() {
+		if n >= len(reverse) || it.Key().Cmp(reverse[n]) != 0 || it.Key().Seq() != reverse[n].Seq() {
+			t.Fatal("反向合并顺序错误", n, string(it.Key().Key()), it.Key().Seq())
+		}
+		n++
+	}
+	if n != len(reverse) {
+		t.Error("反向合并数量错误", n)
+	}
+	if !it.SeekGE(table.NewSearchKey([]byte("c"))) || string(it.Key().Key()) != "c" || it.Key().Seq() != 7 {
+		t.Error("SeekGE错误")
+	}
+	if !it.SeekGE(ik("c", 6)) || it.Key().Seq() != 6 || !it.Next() || it.Key().Seq() != 5 {
+		t.Error("按序列号SeekGE错误")
+	}
+	if !it.SeekLT(table.NewSearchKey([]byte("c"))) || string(it.Key().Key()) != "b" {
+		t.Error("SeekLT错误")
+	}
+	if it.SeekGE(table.NewSearchKey([]byte("g"))) || it.SeekLT(table.NewSearchKey([]byte("a"))) {
+		t.Error("越界的Seek应该失效")
+	}
+	if it.Close() != nil {
+		t.Error("Close错误")
+	}
+	if newMergingIterator().First() {
+		t.Error("没有迭代器时不应该有元素")
+	}
+}
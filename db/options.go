@@ -0,0 +1,136 @@
+package db
+
+import (
+	"time"
+
+	"github.com/InsZVA/saver/cache"
+	"github.com/InsZVA/saver/sstable"
+)
+
+const (
+	defaultMemTableSize                   = 4 * 1024 * 1024
+	defaultMaxOpenFiles                   = 500
+	defaultFilterBitsPerKey               = 10
+	defaultL0CompactionTrigger            = 4
+	defaultL0MaxSize                      = 128 * 1024 * 1024
+	defaultBaseLevelSize                  = 256 * 1024 * 1024
+	defaultLevelMultiplier                = 10
+	defaultTargetFileSize                 = 8 * 1024 * 1024
+	defaultUniversalSizeRatio             = 1
+	defaultUniversalMaxSpaceAmplification = 200
+	defaultMaxManifestFileSize            = 64 * 1024 * 1024
+	defaultBlobGCRatio                    = 0.5
+)
+
+// CompactionStyle compaction的方式
+type CompactionStyle int
+
+const (
+	// CompactionStyleLeveled 每层有目标大小，超过时与下一层重叠的文件合并，读放大和空间放大较小
+	CompactionStyleLeveled CompactionStyle = iota
+	// CompactionStyleUniversal 所有文件都在L0，每个文件是一个sorted run，合并大小相近的sorted run，写放大较小
+	CompactionStyleUniversal
+)
+
+// Options 打开数据库时的选项，为0的字段使用默认值
+// 列族也使用Options，其中MaxOpenFiles、Cache、Sync、MaxManifestFileSize、BlobGCRatio、ColumnFamilyOptions和Now
+// 是整个数据库共用的，在列族的选项中不生效
+type Options struct {
+	// 内存表超过这个大小时写入L0
+	MemTableSize int
+	// 最多同时打开的SSTable数，blob文件也最多同时打开这么多
+	MaxOpenFiles int
+	// 所有SSTable共享的块缓存，为nil时不使用
+	Cache *cache.Cache
+	// 布隆过滤器中每个key占用的位数
+	FilterBitsPerKey int
+	// SSTable中data block的目标大小，为0时使用sstable的默认值
+	BlockSize int
+	// L0的文件数或者总大小达到其中一个值时触发L0到L1的compaction
+	// universal compaction中sorted run的数量达到L0CompactionTrigger时触发compaction
+	L0CompactionTrigger int
+	L0MaxSize           uint64
+	// L1的目标大小，之后每层的目标大小是上一层的LevelMultiplier倍
+	BaseLevelSize   uint64
+	LevelMultiplier int
+	// compaction输出的文件达到这个大小时开始写下一个文件
+	// universal compaction只输出一个文件，不使用这个选项
+	TargetFileSize  uint64
+	CompactionStyle CompactionStyle
+	// universal compaction中，从新到旧相邻的sorted run的大小不超过之前选中的总大小的(100+UniversalSizeRatio)%时一起合并
+	UniversalSizeRatio int
+	// universal compaction中，除最旧的sorted run以外的总大小超过最旧的sorted run大小的这个百分比时合并所有的sorted run
+	UniversalMaxSpaceAmplification int
+	// 每次写入之后把日志同步到磁盘；为false时日志只写入操作系统的缓存，进程崩溃不会丢失写入，机器崩溃时可能丢失
+	Sync bool
+	// MANIFEST超过这个大小时切换到只包含当前状态的新MANIFEST
+	MaxManifestFileSize uint64
+	// compaction中按应用的逻辑删除或者改写记录，为nil时不使用
+	CompactionFilter CompactionFilter
+	// 不为0时，flush和compaction把长度不小于BlobThreshold的value写入blob文件，SSTable中只保存指针，
+	// 之后的compaction只复制指针，不再重写value；带TTL的记录不分离
+	BlobThreshold int
+	// CollectBlobGarbage回收仍被引用的value占文件大小的比例低于BlobGCRatio的blob文件
+	BlobGCRatio float64
+	// 打开数据库时已有列族的选项，按列族名查找，没有列出的列族使用数据库本身的选项
+	ColumnFamilyOptions map[string]*Options
+	// 返回当前时间，用于计算和判断TTL，为nil时使用time.Now
+	Now func() time.Time
+}
+
+func (opts Options) withDefaults() Options {
+	if opts.MemTableSize <= 0 {
+		opts.MemTableSize = defaultMemTableSize
+	}
+	if opts.MaxOpenFiles <= 0 {
+		opts.MaxOpenFiles = defaultMaxOpenFiles
+	}
+	if opts.FilterBitsPerKey <= 0 {
+		opts.FilterBitsPerKey = defaultFilterBitsPerKey
+	}
+	if opts.L0CompactionTrigger <= 0 {
+		opts.L0CompactionTrigger = defaultL0CompactionTrigger
+	}
+	if opts.L0MaxSize == 0 {
+		opts.L0MaxSize = defaultL0MaxSize
+	}
+	if opts.BaseLevelSize == 0 {
+		opts.BaseLevelSize = defaultBaseLevelSize
+	}
+	if opts.LevelMultiplier <= 1 {
+		opts.LevelMultiplier = defaultLevelMultiplier
+	}
+	if opts.TargetFileSize == 0 {
+		opts.TargetFileSize = defaultTargetFileSize
+	}
+	if opts.UniversalSizeRatio <= 0 {
+		opts.UniversalSizeRatio = defaultUniversalSizeRatio
+	}
+	if opts.UniversalMaxSpaceAmplification <= 0 {
+		opts.UniversalMaxSpaceAmplification = defaultUniversalMaxSpaceAmplification
+	}
+	if opts.MaxManifestFileSize == 0 {
+		opts.MaxManifestFileSize = defaultMaxManifestFileSize
+	}
+	if opts.BlobGCRatio <= 0 {
+		opts.BlobGCRatio = defaultBlobGCRatio
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return opts
+}
+
+// levelMaxSize level（L1及以下）的目标大小
+func (opts Options) levelMaxSize(level int) uint64 {
+	size := opts.BaseLevelSize
+	for l := 1; l < level; l++ {
+		size *= uint64(opts.LevelMultiplier)
+	}
+	return size
+}
+
+// writerOptions 写入SSTable时的选项
+func (opts Options) writerOptions() *sstable.WriterOptions {
+	return &sstable.WriterOptions{FilterBitsPerKey: opts.FilterBitsPerKey, BlockSize: opts.BlockSize, BlobThreshold: opts.BlobThreshold}
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/InsZVA/saver/record"
+)
+
+// recoverLogs 按编号顺序重放所有可能包含未写入SSTable的记录的日志，恢复崩溃之前的内存表
+// 内存表写满时写入L0，重放完之后剩余的记录也写入L0，每个列族新增的文件记录在返回的edit中
+func (d *DB) recoverLogs() (map[*ColumnFamily]*versionEdit, error) {
+	infos, err := ioutil.ReadDir(d.dirname)
+	if err != nil {
+		return nil, err
+	}
+	minLogNum := d.vs.minLogNum()
+	var nums []uint64
+	for _, info := range infos {
+		var num uint64
+		if parseFileName(info.Name(), "%06d.log", &num) && num >= minLogNum {
+			nums = append(nums, num)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	// 导入的文件不经过日志，MANIFEST中的lastSeq可能比日志中的更大
+	lastSeq := d.vs.lastSeq
+	edits := make(map[*ColumnFamily]*versionEdit)
+	for _, num := range nums {
+		d.vs.markFileNumUsed(num)
+		if err := d.replayLog(num, edits); err != nil {
+			return nil, err
+		}
+	}
+	for _, cf := range d.vs.families {
+		if !cf.memEmpty() {
+			if err := d.flushRecovered(cf, edits); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if d.vs.lastSeq < lastSeq {
+		d.vs.lastSeq = lastSeq
+	}
+	return edits, nil
+}
+
+// replayLog 把一个日志中的batch依次写入内存表，崩溃时最后一条记录可能不完整，忽略它
+func (d *DB) replayLog(num uint64, edits map[*ColumnFamily]*versionEdit) error {
+	f, err := os.Open(logFileName(d.dirname, num))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := record.NewReader(f)
+	for {
+		data, err := r.Read()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := d.applyBatch(data, num); err != nil {
+			return err
+		}
+		for _, cf := range d.vs.families {
+			if cf.memSize >= cf.opts.MemTableSize {
+				if err := d.flushRecovered(cf, edits); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// flushRecovered 把cf重放得到的内存表写入L0，文件在打开完成时和新的logNum一起生效
+func (d *DB) flushRecovered(cf *ColumnFamily, edits map[*ColumnFamily]*versionEdit) error {
+	meta, err := d.writeLevel0(cf)
+	if err != nil {
+		return err
+	}
+	if meta != nil {
+		if edits[cf] == nil {
+			edits[cf] = &versionEdit{cf: cf.id}
+		}
+		edits[cf].addFile(0, meta)
+	}
+	cf.resetMem()
+	return nil
+}
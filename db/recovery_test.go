@@ -0,0 +1,175 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crashCopy 复制数据库目录中的所有文件，相当于进程在这一刻被杀死之后留下的目录
+func crashCopy(t *testing.T, src, dst string) {
+	os.RemoveAll(dst)
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := ioutil.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if err := copyFile(filepath.Join(src, info.Name()), filepath.Join(dst, info.Name())); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecover(t *testing.T) {
+	dirname := "/tmp/saver_db_recover"
+	opts := &Options{MemTableSize: 8 * 1024, L0CompactionTrigger: 2}
+	d := openTestDB(t, dirname, opts)
+	defer d.Close()
+	model := make(map[string]string)
+	key := func(i int) string {
+		return fmt.Sprintf("key%05d", i)
+	}
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 5000; n++ {
+		i := r.Intn(1000)
+		switch op := r.Intn(100); {
+		case op < 80:
+			model[key(i)] = fmt.Sprint(n)
+			d.Put([]byte(key(i)), []byte(fmt.Sprint(n)))
+		case op < 98:
+			delete(model, key(i))
+			d.Delete([]byte(key(i)))
+		default:
+			for j := i; j < i+20; j++ {
+				delete(model, key(j))
+			}
+			d.DeleteRange([]byte(key(i)), []byte(key(i+20)))
+		}
+	}
+	d.mu.Lock()
+	d.waitForCompaction()
+	lastSeq := d.vs.lastSeq
+	crashCopy(t, dirname, dirname+"_crash")
+	d.mu.Unlock()
+
+	check := func(d *DB) {
+		for i := 0; i < 1000; i++ {
+			val, ok := model[key(i)]
+			expectGet(t, d, key(i), val, ok)
+		}
+	}
+	d2, err := Open(dirname+"_crash", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2.vs.lastSeq != lastSeq {
+		t.Error("序列号没有恢复", d2.vs.lastSeq, lastSeq)
+	}
+	check(d2)
+	// 恢复之后继续写入，新的写入使用更大的序列号
+	d2.Put([]byte(key(1)), []byte("new"))
+	model[key(1)] = "new"
+	if d2.vs.lastSeq != lastSeq+1 {
+		t.Error("恢复之后的序列号错误", d2.vs.lastSeq)
+	}
+	// 正常关闭时内存表中的记录也从日志中恢复
+	if err = d2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	d2, err = Open(dirname+"_crash", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+	check(d2)
+	infos, _ := ioutil.ReadDir(dirname + "_crash")
+	logs := 0
+	for _, info := range infos {
+		if filepath.Ext(info.Name()) == ".log" {
+			logs++
+		}
+	}
+	if logs != 1 {
+		t.Error("重放过的日志没有删除", logs)
+	}
+}
+
+func TestRecoverTornLog(t *testing.T) {
+	dirname := "/tmp/saver_db_recover_torn"
+	d := openTestDB(t, dirname, &Options{Sync: true})
+	defer d.Close()
+	// 每个batch写完之后日志的长度，都在同一个块中
+	var ends []int64
+	for i := 0; i < 50; i++ {
+		b := &Batch{}
+		b.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprint(i)))
+		b.Delete([]byte(fmt.Sprintf("del%02d", i)))
+		if err := d.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		info, err := d.logFile.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, info.Size())
+	}
+	logName := filepath.Base(logFileName(dirname, d.logNum))
+
+	crash := dirname + "_crash"
+	for size := int64(0); size <= ends[len(ends)-1]; size += 5 {
+		crashCopy(t, dirname, crash)
+		// 写到一半时进程被杀死，日志只写入了一部分
+		if err := os.Truncate(filepath.Join(crash, logName), size); err != nil {
+			t.Fatal(err)
+		}
+		d2, err := Open(crash, nil)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		complete := 0
+		for complete < len(ends) && ends[complete] <= size {
+			complete++
+		}
+		for i := 0; i < 50; i++ {
+			expectGet(t, d2, fmt.Sprintf("key%02d", i), fmt.Sprint(i), i < complete)
+		}
+		if d2.vs.lastSeq != uint64(complete*2) {
+			t.Error(size, "序列号错误", d2.vs.lastSeq, complete*2)
+		}
+		d2.Close()
+	}
+}
+
+func TestRecoverIngestSeq(t *testing.T) {
+	dirname := "/tmp/saver_db_recover_ingest"
+	d := openTestDB(t, dirname, nil)
+	defer d.Close()
+	d.Put([]byte("a"), []byte("1"))
+	path := "/tmp/saver_recover_ingest.sst"
+	writeExternalFile(t, path, []string{"x"}, "v")
+	if err := d.IngestExternalFiles([]string{path}); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	lastSeq := d.vs.lastSeq
+	crashCopy(t, dirname, dirname+"_crash")
+	d.mu.Unlock()
+
+	d2, err := Open(dirname+"_crash", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+	// 导入的文件使用的序列号比日志中的都大
+	if d2.vs.lastSeq != lastSeq {
+		t.Error("序列号没有恢复", d2.vs.lastSeq, lastSeq)
+	}
+	expectGet(t, d2, "a", "1", true)
+	expectGet(t, d2, "x", "vx", true)
+}
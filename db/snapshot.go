@@ -0,0 +1,148 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/InsZVA/saver/table"
+)
+
+var (
+	errSnapshotReleased = errors.New("快照已经释放")
+	errSnapshotDB       = errors.New("快照不属于这个数据库")
+)
+
+// ReadOptions 读取时的选项
+type ReadOptions struct {
+	// 不为nil时只读取创建快照时已经存在的数据
+	Snapshot *Snapshot
+	// 迭代器的下界（包含）和上界（不包含），为nil时不限制，Get不使用
+	LowerBound []byte
+	UpperBound []byte
+}
+
+// Snapshot 创建时数据库所有列族的一致视图，多次读取的结果相同
+// 快照只是一个序列号：内存表和SSTable中保存了每个key的多个版本，通过快照读取时只能看到序列号不大于它的最新版本；
+// flush和compaction为每个没有释放的快照保留它能看到的版本，快照不引用内存表和文件
+type Snapshot struct {
+	d *DB
+	// 创建快照时最后一次写入的序列号，快照中所有记录的序列号都不大于它
+	seq uint64
+	// 由d.mu保护
+	released bool
+}
+
+// GetSnapshot 创建当前数据库的快照，不再使用时必须调用Release
+func (d *DB) GetSnapshot() *Snapshot {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := &Snapshot{d: d, seq: d.vs.lastSeq}
+	d.snapshots = append(d.snapshots, s)
+	return s
+}
+
+// Seq 快照的序列号
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Release 释放快照，之后不能再用它读取，重复调用没有影响
+// 之后的flush和compaction不再为它保留旧的版本
+func (s *Snapshot) Release() {
+	d := s.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	for i, ss := range d.snapshots {
+		if ss == s {
+			d.snapshots = append(d.snapshots[:i], d.snapshots[i+1:]...)
+			break
+		}
+	}
+}
+
+// readState 一次读取使用的内存表和version
+type readState struct {
+	// 只读取序列号不大于seq的记录
+	seq     uint64
+	mem     *table.SkipList
+	version *version
+}
+
+// acquireReadState 按ro取得读取cf使用的数据，返回的version已经被ref，读取完之后需要unrefVersion
+// 通过快照读取时使用快照的序列号，否则使用最后一次写入的序列号；快照之后新建的列族中没有快照能看到的记录
+// 调用时必须持有d.mu
+func (d *DB) acquireReadState(cf *ColumnFamily, ro *ReadOptions) (readState, error) {
+	rs := readState{seq: d.vs.lastSeq, mem: cf.mem, version: cf.current}
+	if ro != nil && ro.Snapshot != nil {
+		s := ro.Snapshot
+		if s.d != d {
+			return readState{}, errSnapshotDB
+		}
+		if s.released {
+			return readState{}, errSnapshotReleased
+		}
+		rs.seq = s.seq
+	}
+	d.vs.ref(rs.version)
+	return rs, nil
+}
+
+// snapshotList 没有释放的快照的序列号，从小到大排列
+type snapshotList []uint64
+
+// snapshotList 调用时必须持有d.mu，快照按创建的顺序排列，序列号不会减小
+func (d *DB) snapshotList() snapshotList {
+	seqs := make(snapshotList, len(d.snapshots))
+	for i, s := range d.snapshots {
+		seqs[i] = s.seq
+	}
+	return seqs
+}
+
+// stripe 能看到序列号为seq的记录的最老的快照，比所有快照都新时返回table.MaxSeq
+// 同一个key在同一个stripe中的两个版本，任何快照和之后的读取都不会只看到旧的那一个
+func (s snapshotList) stripe(seq uint64) uint64 {
+	i := sort.Search(len(s), func(i int) bool {
+		return s[i] >= seq
+	})
+	if i == len(s) {
+		return table.MaxSeq
+	}
+	return s[i]
+}
+
+// earliest 没有比seq更老的快照，更老的版本对任何读取都不可见
+func (s snapshotList) earliest(seq uint64) bool {
+	return len(s) == 0 || seq <= s[0]
+}
+
+// versionGC 按InternalCmp的顺序检查flush或compaction中的记录，找出任何快照和之后的读取都看不到的版本
+type versionGC struct {
+	snapshots snapshotList
+	tombs     table.RangeTombstones
+	lastKey   []byte
+	// lastKey上一个版本所在的stripe
+	lastStripe uint64
+	hasLast    bool
+	// 最近检查的记录是否是这个key的第一个（最新的）版本
+	newest bool
+}
+
+// drop 记录k是否可以丢弃：被同一个stripe中更新的版本遮盖，或者被同一个stripe中的范围删除标记覆盖
+// 必须按顺序对每一条记录调用
+func (g *versionGC) drop(k table.Key) bool {
+	stripe := g.snapshots.stripe(k.Seq())
+	g.newest = !g.hasLast || !bytes.Equal(k.Key(), g.lastKey)
+	if g.newest {
+		g.lastKey, g.hasLast = append(g.lastKey[:0], k.Key()...), true
+	} else if stripe == g.lastStripe {
+		return true
+	}
+	g.lastStripe = stripe
+	return g.tombs.MaxCoveringSeq(k.Key(), stripe) > k.Seq()
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func expectSnapshotGet(t *testing.T, d *DB, s *Snapshot, key string, val string, found bool) {
+	v, ok, err := d.GetWithOptions([]byte(key), &ReadOptions{Snapshot: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok != found || (ok && string(v) != val) {
+		t.Errorf("快照%d中Get(%s)错误: %s %v，应该为%s %v", s.Seq(), key, v, ok, val, found)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dirname := "/tmp/saver_db_snapshot"
+	d := openTestDB(t, dirname, &Options{L0CompactionTrigger: 1})
+	defer d.Close()
+	d.Put([]byte("a"), []byte("1"))
+	d.Put([]byte("b"), []byte("1"))
+	s1 := d.GetSnapshot()
+	if s1.Seq() != 2 {
+		t.Error("快照的序列号错误", s1.Seq())
+	}
+	d.Put([]byte("a"), []byte("2"))
+	d.Delete([]byte("b"))
+	d.Put([]byte("c"), []byte("2"))
+	s2 := d.GetSnapshot()
+	s3 := d.GetSnapshot()
+	d.DeleteRange([]byte("a"), []byte("z"))
+	d.Put([]byte("d"), []byte("3"))
+
+	check := func() {
+		expectSnapshotGet(t, d, s1, "a", "1", true)
+		expectSnapshotGet(t, d, s1, "b", "1", true)
+		expectSnapshotGet(t, d, s1, "c", "", false)
+		expectSnapshotGet(t, d, s1, "d", "", false)
+		for _, s := range []*Snapshot{s2, s3} {
+			expectSnapshotGet(t, d, s, "a", "2", true)
+			expectSnapshotGet(t, d, s, "b", "", false)
+			expectSnapshotGet(t, d, s, "c", "2", true)
+			expectSnapshotGet(t, d, s, "d", "", false)
+		}
+		expectGet(t, d, "a", "", false)
+		expectGet(t, d, "c", "", false)
+		expectGet(t, d, "d", "3", true)
+	}
+	check()
+	// 写入L0并compact之后快照仍然能读到旧的版本
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	path := "/tmp/saver_snapshot_ingest.sst"
+	writeExternalFile(t, path, []string{"x"}, "v")
+	if err := d.IngestExternalFiles([]string{path}); err != nil {
+		t.Fatal(err)
+	}
+	d.Put([]byte("e"), []byte("4"))
+	d.Flush()
+	d.mu.Lock()
+	d.waitForCompaction()
+	if len(d.defaultCF.current.levels[0]) != 0 || !d.defaultCF.memEmpty() {
+		t.Error("没有compact", len(d.defaultCF.current.levels[0]))
+	}
+	d.mu.Unlock()
+	check()
+	expectSnapshotGet(t, d, s1, "x", "", false)
+	expectGet(t, d, "x", "vx", true)
+	expectGet(t, d, "e", "4", true)
+
+	s1.Release()
+	s1.Release()
+	if _, _, err := d.GetWithOptions([]byte("a"), &ReadOptions{Snapshot: s1}); err != errSnapshotReleased {
+		t.Error("释放之后的快照不能读取", err)
+	}
+	s2.Release()
+	s3.Release()
+	// 快照不引用文件，compaction之后旧文件已经删除
+	d.mu.Lock()
+	live := d.vs.liveFiles()
+	d.mu.Unlock()
+	infos, _ := ioutil.ReadDir(dirname)
+	for _, info := range infos {
+		var num uint64
+		if parseFileName(info.Name(), "%06d.sst", &num) && !live[num] {
+			t.Error("释放快照之后没有删除旧文件", info.Name())
+		}
+	}
+
+	other := openTestDB(t, dirname+"_other", nil)
+	defer other.Close()
+	s := other.GetSnapshot()
+	defer s.Release()
+	if _, _, err := d.GetWithOptions([]byte("a"), &ReadOptions{Snapshot: s}); err != errSnapshotDB {
+		t.Error("不能使用其他数据库的快照", err)
+	}
+}
+
+func TestSnapshotConcurrentWrite(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_snapshot_concurrent", &Options{MemTableSize: 4096, L0CompactionTrigger: 2})
+	defer d.Close()
+	key := func(i int) string {
+		return fmt.Sprintf("key%04d", i)
+	}
+	for i := 0; i < 500; i++ {
+		d.Put([]byte(key(i)), []byte("old"))
+	}
+	s := d.GetSnapshot()
+	defer s.Release()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < 3; n++ {
+			for i := 0; i < 500; i++ {
+				d.Put([]byte(key(i)), []byte(fmt.Sprint(n)))
+			}
+		}
+		d.DeleteRange([]byte(key(0)), []byte(key(500)))
+	}()
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 500; i += 7 {
+			expectSnapshotGet(t, d, s, key(i), "old", true)
+		}
+	}
+	<-done
+	for i := 0; i < 500; i++ {
+		expectSnapshotGet(t, d, s, key(i), "old", true)
+		expectGet(t, d, key(i), "", false)
+	}
+}
+
+// countEntries 默认列族所有SSTable中的记录数
+func countEntries(t *testing.T, d *DB) uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.waitForCompaction()
+	var n uint64
+	for _, files := range d.defaultCF.current.levels {
+		for _, f := range files {
+			h, err := d.tc.Acquire(f.fileNum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n += h.Reader().Properties().NumEntries
+			h.Release()
+		}
+	}
+	return n
+}
+
+func TestSnapshotKeepVersions(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_snapshot_versions", &Options{L0CompactionTrigger: 1})
+	defer d.Close()
+	d.Put([]byte("a"), []byte("1"))
+	d.Put([]byte("b"), []byte("1"))
+	s := d.GetSnapshot()
+	d.Put([]byte("a"), []byte("2"))
+	d.Put([]byte("a"), []byte("3"))
+	d.Delete([]byte("b"))
+	d.Flush()
+	// a保留3和快照能看到的1，b在最底层也要保留删除标记遮盖快照能看到的1
+	if n := countEntries(t, d); n != 4 {
+		t.Error("快照能看到的版本没有保留", n)
+	}
+	expectSnapshotGet(t, d, s, "a", "1", true)
+	expectSnapshotGet(t, d, s, "b", "1", true)
+	expectGet(t, d, "a", "3", true)
+	expectGet(t, d, "b", "", false)
+
+	s.Release()
+	d.Put([]byte("a"), []byte("4"))
+	d.Put([]byte("b"), []byte("4"))
+	d.Flush()
+	if n := countEntries(t, d); n != 2 {
+		t.Error("释放快照之后没有丢弃旧的版本", n)
+	}
+	expectGet(t, d, "a", "4", true)
+	expectGet(t, d, "b", "4", true)
+}
@@ -0,0 +1,345 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/InsZVA/saver/table"
+)
+
+var (
+	errTxnDone        = errors.New("事务已经提交或者回滚")
+	errTxnConflict    = errors.New("事务读写的key在事务开始之后被修改")
+	errTxnLockTimeout = errors.New("等待key的锁超时")
+	errTxnDeadlock    = errors.New("等待key的锁会造成死锁")
+)
+
+const defaultLockTimeout = time.Second
+
+// TxnMode 事务处理冲突的方式
+type TxnMode int
+
+const (
+	// TxnOptimistic 不加锁，提交时检查读写过的key在事务开始之后是否被修改，被修改时提交失败
+	TxnOptimistic TxnMode = iota
+	// TxnPessimistic 读写key之前先加锁，直到提交或者回滚时释放，不经过事务的写入不加锁
+	// 等待锁超时或者会造成死锁时读写返回错误，拿到锁时key已经在事务开始之后被修改则返回冲突错误，之后应该回滚事务
+	TxnPessimistic
+)
+
+// TxnOptions 开始事务时的选项
+type TxnOptions struct {
+	Mode TxnMode
+	// 悲观事务等待锁的最长时间，为0时使用默认值
+	LockTimeout time.Duration
+}
+
+// Txn 读写多个key的事务，写入先保存在事务中，提交时作为一个batch原子地写入日志
+// 事务只读写默认列族，事务中的Get读取事务开始时的快照，并能读到本事务之前的写入；一个事务不能同时在多个goroutine中使用
+type Txn struct {
+	d    *DB
+	opts TxnOptions
+	// 开始时创建的快照，提交或者回滚时释放
+	// 快照让compaction保留事务开始之后写入的删除标记，检查冲突时不会漏掉被删除的key
+	snapshot *Snapshot
+	// 开始时最后一次写入的序列号
+	seq    uint64
+	batch  Batch
+	writes map[string]txnWrite
+	// 乐观事务读写过的key
+	keys map[string]bool
+	// 悲观事务持有锁的key
+	locked []string
+	done   bool
+}
+
+type txnWrite struct {
+	val     []byte
+	deleted bool
+}
+
+// Begin 开始一个事务，opts为nil时使用乐观事务
+func (d *DB) Begin(opts *TxnOptions) *Txn {
+	txn := &Txn{
+		d:      d,
+		writes: make(map[string]txnWrite),
+		keys:   make(map[string]bool),
+	}
+	if opts != nil {
+		txn.opts = *opts
+	}
+	if txn.opts.LockTimeout <= 0 {
+		txn.opts.LockTimeout = defaultLockTimeout
+	}
+	txn.snapshot = d.GetSnapshot()
+	txn.seq = txn.snapshot.Seq()
+	return txn
+}
+
+// access 读写key之前调用：乐观事务记录key，悲观事务对key加锁
+// 悲观事务拿到锁时key已经在事务开始之后被修改，快照中的值已经过时，返回冲突错误
+func (txn *Txn) access(key []byte) error {
+	if txn.done {
+		return errTxnDone
+	}
+	if txn.opts.Mode == TxnOptimistic {
+		txn.keys[string(key)] = true
+		return nil
+	}
+	held, err := txn.d.locks.lock(txn, string(key), txn.opts.LockTimeout)
+	if err != nil || held {
+		return err
+	}
+	txn.locked = append(txn.locked, string(key))
+	d := txn.d
+	d.mu.Lock()
+	rs, _ := d.acquireReadState(d.defaultCF, nil)
+	newer := newerInMem(rs.mem, key, txn.seq)
+	d.mu.Unlock()
+	defer d.unrefVersion(rs.version)
+	if !newer {
+		if newer, err = d.newerInFiles(rs.version.filesFor(key), key, txn.seq); err != nil {
+			return err
+		}
+	}
+	if newer {
+		return errTxnConflict
+	}
+	return nil
+}
+
+// Get 查找key，先查找本事务中的写入，再按事务开始时的快照读取
+func (txn *Txn) Get(key []byte) ([]byte, bool, error) {
+	if err := txn.access(key); err != nil {
+		return nil, false, err
+	}
+	if w, ok := txn.writes[string(key)]; ok {
+		return w.val, !w.deleted, nil
+	}
+	return txn.d.GetWithOptions(key, &ReadOptions{Snapshot: txn.snapshot})
+}
+
+func (txn *Txn) Put(key, val []byte) error {
+	if err := txn.access(key); err != nil {
+		return err
+	}
+	txn.batch.Put(key, val)
+	txn.writes[string(key)] = txnWrite{val: append([]byte(nil), val...)}
+	return nil
+}
+
+func (txn *Txn) Delete(key []byte) error {
+	if err := txn.access(key); err != nil {
+		return err
+	}
+	txn.batch.Delete(key)
+	txn.writes[string(key)] = txnWrite{deleted: true}
+	return nil
+}
+
+// Commit 提交事务，所有写入作为一个batch原子地写入
+// 乐观事务中读写过的key在事务开始之后被修改时返回冲突错误，不写入任何数据
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return errTxnDone
+	}
+	txn.done = true
+	defer txn.release()
+	d := txn.d
+	if txn.opts.Mode != TxnOptimistic {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return txn.write()
+	}
+	keys := make([]string, 0, len(txn.keys))
+	for key := range txn.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	// 先不持有锁检查当前version中的文件，读取文件时不阻塞其他读写
+	d.mu.Lock()
+	rs, _ := d.acquireReadState(d.defaultCF, nil)
+	d.mu.Unlock()
+	defer d.unrefVersion(rs.version)
+	for _, key := range keys {
+		newer, err := d.newerInFiles(rs.version.filesFor([]byte(key)), []byte(key), txn.seq)
+		if err != nil {
+			return err
+		}
+		if newer {
+			return errTxnConflict
+		}
+	}
+	// 再持有锁检查内存表以及之后flush、compaction产生的文件，检查和写入之间不会有其他写入
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, key := range keys {
+		if newerInMem(d.defaultCF.mem, []byte(key), txn.seq) {
+			return errTxnConflict
+		}
+		var files []*fileMetadata
+		if cur := d.defaultCF.current; cur != rs.version {
+			files = filesAdded(cur.filesFor([]byte(key)), rs.version.filesFor([]byte(key)))
+		}
+		newer, err := d.newerInFiles(files, []byte(key), txn.seq)
+		if err != nil {
+			return err
+		}
+		if newer {
+			return errTxnConflict
+		}
+	}
+	return txn.write()
+}
+
+// write 写入事务中的batch，调用时必须持有d.mu
+func (txn *Txn) write() error {
+	if txn.batch.Count() == 0 {
+		return nil
+	}
+	return txn.d.writeLocked(&txn.batch)
+}
+
+// Rollback 放弃事务中的所有写入
+func (txn *Txn) Rollback() error {
+	if txn.done {
+		return errTxnDone
+	}
+	txn.done = true
+	txn.release()
+	return nil
+}
+
+func (txn *Txn) release() {
+	txn.snapshot.Release()
+	if len(txn.locked) > 0 {
+		txn.d.locks.unlock(txn, txn.locked)
+		txn.locked = nil
+	}
+}
+
+// newerInMem 内存表中key是否有序列号大于seq的记录（包括删除标记和范围删除标记），调用时必须持有d.mu
+func newerInMem(mem *table.SkipList, key []byte, seq uint64) bool {
+	node := mem.Seek(table.NewSearchKey(key))
+	if node != mem.End() && bytes.Equal(node.Key().Key(), key) && node.Key().Seq() > seq {
+		return true
+	}
+	return mem.RangeTombstones().MaxCoveringSeq(key, table.MaxSeq) > seq
+}
+
+// newerInFiles files中key是否有序列号大于seq的记录，files按filesFor的顺序从新到旧排列，不需要持有d.mu
+// maxSeq不大于seq的文件中不会有更新的记录，不需要读取；找到key的一条记录之后，更老的文件中只有更老的版本
+func (d *DB) newerInFiles(files []*fileMetadata, key []byte, seq uint64) (bool, error) {
+	for _, f := range files {
+		if f.maxSeq <= seq {
+			continue
+		}
+		h, err := d.tc.Acquire(f.fileNum)
+		if err != nil {
+			return false, err
+		}
+		r := h.Reader()
+		k, _, found, err := r.Lookup(table.NewSearchKey(key))
+		tomb := r.RangeTombstones().MaxCoveringSeq(key, table.MaxSeq)
+		h.Release()
+		if err != nil {
+			return false, err
+		}
+		if tomb > seq || (found && k.Seq() > seq) {
+			return true, nil
+		}
+		if found {
+			return false, nil
+		}
+	}
+	return false, nil
+}
+
+// filesAdded files中不在old里的文件，保持原来的顺序
+func filesAdded(files, old []*fileMetadata) []*fileMetadata {
+	var added []*fileMetadata
+outer:
+	for _, f := range files {
+		for _, o := range old {
+			if o.fileNum == f.fileNum {
+				continue outer
+			}
+		}
+		added = append(added, f)
+	}
+	return added
+}
+
+// lockManager 悲观事务的key锁，每个key同一时间只能被一个事务持有
+type lockManager struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+	// 正在等待锁的事务所等待的持有者，用于检测死锁
+	waitsFor map[*Txn]*Txn
+}
+
+type keyLock struct {
+	owner *Txn
+	// 释放锁时关闭，通知等待的事务
+	released chan struct{}
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{
+		locks:    make(map[string]*keyLock),
+		waitsFor: make(map[*Txn]*Txn),
+	}
+}
+
+// lock 为txn获取key的锁，held表示txn之前已经持有这个锁
+// 等待会形成环时返回死锁错误，超过timeout时返回超时错误
+func (lm *lockManager) lock(txn *Txn, key string, timeout time.Duration) (held bool, err error) {
+	deadline := time.Now().Add(timeout)
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	defer delete(lm.waitsFor, txn)
+	for {
+		l := lm.locks[key]
+		if l == nil {
+			lm.locks[key] = &keyLock{owner: txn, released: make(chan struct{})}
+			return false, nil
+		}
+		if l.owner == txn {
+			return true, nil
+		}
+		// 沿着等待关系查找，回到txn说明形成了环
+		for t := l.owner; t != nil; t = lm.waitsFor[t] {
+			if t == txn {
+				return false, errTxnDeadlock
+			}
+		}
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return false, errTxnLockTimeout
+		}
+		lm.waitsFor[txn] = l.owner
+		lm.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-l.released:
+			timer.Stop()
+		case <-timer.C:
+		}
+		lm.mu.Lock()
+	}
+}
+
+// unlock 释放txn持有的keys的锁
+func (lm *lockManager) unlock(txn *Txn, keys []string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for _, key := range keys {
+		if l := lm.locks[key]; l != nil && l.owner == txn {
+			delete(lm.locks, key)
+			close(l.released)
+		}
+	}
+}
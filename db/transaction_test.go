@@ -0,0 +1,205 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOptimisticTxn(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_txn_optimistic", &Options{L0CompactionTrigger: 1})
+	defer d.Close()
+	d.Put([]byte("a"), []byte("1"))
+
+	txn := d.Begin(nil)
+	if v, ok, err := txn.Get([]byte("a")); err != nil || !ok || string(v) != "1" {
+		t.Fatal("事务中读取错误", string(v), ok, err)
+	}
+	txn.Put([]byte("a"), []byte("2"))
+	txn.Delete([]byte("b"))
+	if v, ok, _ := txn.Get([]byte("a")); !ok || string(v) != "2" {
+		t.Error("事务中读不到自己的写入", string(v))
+	}
+	if _, ok, _ := txn.Get([]byte("b")); ok {
+		t.Error("事务中读到了自己删除的key")
+	}
+	// 提交之前其他读取看不到事务中的写入
+	expectGet(t, d, "a", "1", true)
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	expectGet(t, d, "a", "2", true)
+	if err := txn.Commit(); err != errTxnDone {
+		t.Error("重复提交应该失败", err)
+	}
+	if err := txn.Put([]byte("c"), nil); err != errTxnDone {
+		t.Error("提交之后不能写入", err)
+	}
+
+	// 读过的key在事务开始之后被修改
+	txn = d.Begin(nil)
+	txn.Get([]byte("a"))
+	txn.Put([]byte("c"), []byte("3"))
+	d.Put([]byte("a"), []byte("other"))
+	if err := txn.Commit(); err != errTxnConflict {
+		t.Error("应该检测到冲突", err)
+	}
+	expectGet(t, d, "c", "", false)
+
+	// 写入SSTable之后的修改也能检测到，范围删除也算修改
+	txn = d.Begin(nil)
+	txn.Put([]byte("b"), []byte("3"))
+	d.DeleteRange([]byte("b"), []byte("c"))
+	d.Flush()
+	if err := txn.Commit(); err != errTxnConflict {
+		t.Error("应该检测到冲突", err)
+	}
+
+	// 事务中按开始时的快照读取；最底层的compaction保留事务开始之后的删除标记，仍然能检测到冲突
+	d.Put([]byte("f"), []byte("1"))
+	d.Flush()
+	txn = d.Begin(nil)
+	d.Delete([]byte("f"))
+	d.Flush()
+	if layout := levelFiles(d); !strings.HasPrefix(layout, "[[] ") {
+		t.Fatal("没有compact到最底层", layout)
+	}
+	if v, ok, err := txn.Get([]byte("f")); err != nil || !ok || string(v) != "1" {
+		t.Error("事务中应该读到开始时的值", string(v), ok, err)
+	}
+	if err := txn.Commit(); err != errTxnConflict {
+		t.Error("应该检测到删除造成的冲突", err)
+	}
+
+	// 同一个文件中其他key的更新不算冲突
+	d.Put([]byte("g"), []byte("1"))
+	d.Flush()
+	txn = d.Begin(nil)
+	txn.Get([]byte("g"))
+	txn.Put([]byte("g"), []byte("2"))
+	d.Put([]byte("h"), []byte("other"))
+	d.Flush()
+	if err := txn.Commit(); err != nil {
+		t.Error("其他key的修改不应该造成冲突", err)
+	}
+	expectGet(t, d, "g", "2", true)
+
+	txn = d.Begin(nil)
+	txn.Put([]byte("d"), []byte("4"))
+	d.Put([]byte("e"), []byte("other"))
+	if err := txn.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	expectGet(t, d, "d", "", false)
+	if err := txn.Rollback(); err != errTxnDone {
+		t.Error("重复回滚应该失败", err)
+	}
+}
+
+func TestPessimisticTxn(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_txn_pessimistic", nil)
+	defer d.Close()
+	opts := &TxnOptions{Mode: TxnPessimistic, LockTimeout: 50 * time.Millisecond}
+
+	t1 := d.Begin(opts)
+	if err := t1.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	t2 := d.Begin(opts)
+	if _, _, err := t2.Get([]byte("a")); err != errTxnLockTimeout {
+		t.Error("应该等待锁超时", err)
+	}
+	// t1提交之后t2拿到锁，a在t2开始之后被修改，t2的快照已经过时
+	done := make(chan error)
+	go func() {
+		_, _, err := t2.Get([]byte("a"))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := t1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != errTxnConflict {
+		t.Error("拿到锁时应该检测到冲突", err)
+	}
+	t2.Rollback()
+	// 之后开始的事务读到提交的值
+	t2 = d.Begin(opts)
+	if v, _, err := t2.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Errorf("读到的值错误: %s %v", v, err)
+	}
+	t2.Rollback()
+
+	// 死锁检测
+	t1 = d.Begin(&TxnOptions{Mode: TxnPessimistic, LockTimeout: time.Second})
+	t2 = d.Begin(&TxnOptions{Mode: TxnPessimistic, LockTimeout: time.Second})
+	t1.Put([]byte("x"), []byte("1"))
+	t2.Put([]byte("y"), []byte("2"))
+	go func() {
+		done <- t1.Put([]byte("y"), []byte("1"))
+	}()
+	for {
+		d.locks.mu.Lock()
+		waiting := d.locks.waitsFor[t1] == t2
+		d.locks.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := t2.Put([]byte("x"), []byte("2")); err != errTxnDeadlock {
+		t.Error("应该检测到死锁", err)
+	}
+	t2.Rollback()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := t1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	expectGet(t, d, "x", "1", true)
+	expectGet(t, d, "y", "1", true)
+}
+
+func TestTxnCounter(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_txn_counter", &Options{MemTableSize: 1024})
+	defer d.Close()
+	increment := func(mode TxnMode) error {
+		txn := d.Begin(&TxnOptions{Mode: mode, LockTimeout: 10 * time.Second})
+		v, _, err := txn.Get([]byte("counter"))
+		if err != nil {
+			txn.Rollback()
+			return err
+		}
+		n, _ := strconv.Atoi(string(v))
+		txn.Put([]byte("counter"), []byte(strconv.Itoa(n+1)))
+		return txn.Commit()
+	}
+	for _, mode := range []TxnMode{TxnOptimistic, TxnPessimistic} {
+		d.Delete([]byte("counter"))
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					// 乐观事务冲突时重试
+					for {
+						err := increment(mode)
+						if err == nil {
+							break
+						}
+						if err != errTxnConflict {
+							t.Error(err)
+							return
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		expectGet(t, d, "counter", "400", true)
+	}
+}
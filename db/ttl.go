@@ -0,0 +1,28 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+var errInvalidTTL = errors.New("TTL必须大于0")
+
+// PutWithTTL 写入key，经过ttl之后过期，过期的key读取时视为不存在
+func (d *DB) PutWithTTL(key, val []byte, ttl time.Duration) error {
+	return d.PutCFWithTTL(d.defaultCF, key, val, ttl)
+}
+
+// PutCFWithTTL 在列族cf中写入key，经过ttl之后过期
+func (d *DB) PutCFWithTTL(cf *ColumnFamily, key, val []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errInvalidTTL
+	}
+	b := &Batch{}
+	b.PutCFWithExpiry(cf, key, val, d.opts.Now().Add(ttl))
+	return d.Write(b)
+}
+
+// now 当前时间的unix纳秒
+func (d *DB) now() int64 {
+	return d.opts.Now().UnixNano()
+}
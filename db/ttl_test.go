@@ -0,0 +1,132 @@
+package db
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/InsZVA/saver/table"
+)
+
+// fakeClock 测试中手动推进的时钟，后台compaction也会读取
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// tableEntries 文件中所有的记录，key为user key，value为类型
+func tableEntries(t *testing.T, d *DB, f *fileMetadata) map[string]table.Kind {
+	h, err := d.tc.Acquire(f.fileNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Release()
+	entries := make(map[string]table.Kind)
+	it := h.Reader().NewIterator(nil)
+	defer it.Close()
+	for it.First(); it.Valid(); it.Next() {
+		entries[string(it.Key().Key())] = it.Key().Kind()
+	}
+	return entries
+}
+
+func TestTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	d := openTestDB(t, "/tmp/saver_db_ttl", &Options{Now: clock.Now, L0CompactionTrigger: 100})
+	defer d.Close()
+	if err := d.PutWithTTL([]byte("a"), []byte("1"), 0); err != errInvalidTTL {
+		t.Error("TTL必须大于0", err)
+	}
+	d.PutWithTTL([]byte("a"), []byte("1"), 10*time.Second)
+	d.Put([]byte("b"), []byte("2"))
+	d.PutWithTTL([]byte("c"), []byte("3"), time.Hour)
+	// 过期的新版本遮盖更老的版本
+	d.Put([]byte("d"), []byte("old"))
+	d.Flush()
+	d.PutWithTTL([]byte("d"), []byte("4"), 5*time.Second)
+	expectGet(t, d, "a", "1", true)
+	expectGet(t, d, "d", "4", true)
+	it, err := d.NewIterator(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}
+	expectScan(t, it, []string{"a", "b", "c", "d"}, all)
+
+	clock.advance(10 * time.Second)
+	expectGet(t, d, "a", "", false)
+	expectGet(t, d, "b", "2", true)
+	expectGet(t, d, "c", "3", true)
+	expectGet(t, d, "d", "", false)
+	// 已经创建的迭代器按创建时的时间判断
+	expectScan(t, it, []string{"a", "b", "c", "d"}, all)
+	it.Close()
+	if it, err = d.NewIterator(nil); err != nil {
+		t.Fatal(err)
+	}
+	expectScan(t, it, []string{"b", "c"}, all)
+	it.Close()
+	// 写入SSTable之后同样过期
+	d.Flush()
+	expectGet(t, d, "a", "", false)
+	expectGet(t, d, "c", "3", true)
+	clock.advance(time.Hour)
+	expectGet(t, d, "c", "", false)
+
+	// batch中指定过期时间
+	b := &Batch{}
+	b.PutWithExpiry([]byte("e"), []byte("5"), clock.Now().Add(time.Second))
+	b.Put([]byte("f"), []byte("6"))
+	d.Write(b)
+	expectGet(t, d, "e", "5", true)
+	clock.advance(time.Second)
+	expectGet(t, d, "e", "", false)
+	expectGet(t, d, "f", "6", true)
+}
+
+func TestTTLCompaction(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	dirname := "/tmp/saver_db_ttl_compaction"
+	d := openTestDB(t, dirname, &Options{Now: clock.Now, L0CompactionTrigger: 2})
+	defer d.Close()
+	// x的旧版本在最底层
+	writeExternalFile(t, "/tmp/saver_ttl_ingest", []string{"x"}, "old")
+	if err := d.IngestExternalFiles([]string{"/tmp/saver_ttl_ingest"}); err != nil {
+		t.Fatal(err)
+	}
+	d.PutWithTTL([]byte("a"), []byte("1"), time.Second)
+	d.PutWithTTL([]byte("b"), []byte("2"), time.Hour)
+	d.PutWithTTL([]byte("x"), []byte("3"), time.Second)
+	d.Flush()
+	clock.advance(time.Second)
+	d.Put([]byte("c"), []byte("4"))
+	d.Flush()
+	d.mu.Lock()
+	d.waitForCompaction()
+	d.mu.Unlock()
+
+	// L0的两个文件合并到L1，过期的a被丢弃，x下面还有旧版本，换成删除标记
+	v := d.defaultCF.current
+	if len(v.levels[0]) != 0 || len(v.levels[1]) != 1 {
+		t.Fatal("没有compact", levelFiles(d))
+	}
+	entries := tableEntries(t, d, v.levels[1][0])
+	if _, ok := entries["a"]; ok || entries["b"] != table.KindSetWithTTL || entries["x"] != table.KindDelete || len(entries) != 3 {
+		t.Error("compaction没有处理过期的记录", entries)
+	}
+	expectGet(t, d, "a", "", false)
+	expectGet(t, d, "b", "2", true)
+	expectGet(t, d, "x", "", false)
+}
@@ -0,0 +1,65 @@
+package db
+
+// pickUniversalCompaction universal compaction把L0中的每个文件作为一个sorted run，从新到旧依次为
+// runs[0], runs[1], ...，sorted run的数量达到L0CompactionTrigger时按以下顺序选择：
+//  1. 空间放大：除最旧的sorted run以外的总大小超过最旧的sorted run的UniversalMaxSpaceAmplification%时合并全部
+//  2. 大小比例：从某个sorted run开始，依次加入大小不超过已选中总大小(100+UniversalSizeRatio)%的下一个sorted run，
+//     至少选中两个时合并它们
+//  3. 都不满足时合并最新的几个sorted run，使数量降到L0CompactionTrigger以下
+//
+// 选中的sorted run总是相邻的，合并后的文件在L0中仍然处于原来的位置
+func (cf *ColumnFamily) pickUniversalCompaction() *compaction {
+	v := cf.current
+	runs := v.levels[0]
+	n := len(runs)
+	if n < 2 || n < cf.opts.L0CompactionTrigger {
+		return nil
+	}
+	if inputs := cf.pickSpaceAmplification(runs); inputs != nil {
+		return newUniversalCompaction(v, inputs)
+	}
+	if inputs := cf.pickSizeRatio(runs); inputs != nil {
+		return newUniversalCompaction(v, inputs)
+	}
+	m := n - cf.opts.L0CompactionTrigger + 2
+	if m > n {
+		m = n
+	}
+	return newUniversalCompaction(v, runs[:m])
+}
+
+func newUniversalCompaction(v *version, inputs []*fileMetadata) *compaction {
+	c := &compaction{level: 0, outputLevel: 0, version: v}
+	c.inputs[0] = append([]*fileMetadata(nil), inputs...)
+	return c
+}
+
+func (cf *ColumnFamily) pickSpaceAmplification(runs []*fileMetadata) []*fileMetadata {
+	var newer uint64
+	for _, f := range runs[:len(runs)-1] {
+		newer += f.size
+	}
+	oldest := runs[len(runs)-1].size
+	if newer*100 < oldest*uint64(cf.opts.UniversalMaxSpaceAmplification) {
+		return nil
+	}
+	return runs
+}
+
+func (cf *ColumnFamily) pickSizeRatio(runs []*fileMetadata) []*fileMetadata {
+	ratio := uint64(100 + cf.opts.UniversalSizeRatio)
+	for i := range runs {
+		sum := runs[i].size
+		j := i + 1
+		for ; j < len(runs); j++ {
+			if runs[j].size*100 > sum*ratio {
+				break
+			}
+			sum += runs[j].size
+		}
+		if j-i >= 2 {
+			return runs[i:j]
+		}
+	}
+	return nil
+}
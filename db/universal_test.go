@@ -0,0 +1,127 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestPickUniversalCompaction(t *testing.T) {
+	pick := func(sizes ...uint64) []uint64 {
+		d := &DB{vs: newVersionSet()}
+		d.vs.families[defaultColumnFamilyID].opts = Options{
+			L0CompactionTrigger: 4,
+			CompactionStyle:     CompactionStyleUniversal,
+		}.withDefaults()
+		edit := &versionEdit{}
+		// sizes从新到旧排列
+		for i, size := range sizes {
+			m := testMeta(uint64(i+1), "a", "z", uint64(len(sizes)-i))
+			m.size = size
+			edit.addFile(0, m)
+		}
+		d.vs.applyEdit(edit)
+		c := d.pickCompaction()
+		if c == nil {
+			return nil
+		}
+		if c.level != 0 || c.outputLevel != 0 || len(c.inputs[1]) != 0 {
+			t.Fatal("universal compaction只使用L0", c.level, c.outputLevel)
+		}
+		var ret []uint64
+		for _, f := range c.inputs[0] {
+			ret = append(ret, f.fileNum)
+		}
+		return ret
+	}
+	for _, tt := range []struct {
+		sizes  []uint64
+		expect []uint64
+	}{
+		// sorted run的数量不够
+		{[]uint64{1, 1, 1}, nil},
+		// 空间放大超过200%
+		{[]uint64{10, 10, 10, 10}, []uint64{1, 2, 3, 4}},
+		// 大小相近的前三个
+		{[]uint64{10, 10, 20, 100}, []uint64{1, 2, 3}},
+		// 最新的太小时从第二个开始
+		{[]uint64{1, 30, 30, 100}, []uint64{2, 3}},
+		// 都不满足时合并最新的几个
+		{[]uint64{10, 100, 1000, 10000, 100000}, []uint64{1, 2, 3}},
+	} {
+		ret := pick(tt.sizes...)
+		if fmt.Sprint(ret) != fmt.Sprint(tt.expect) {
+			t.Error("选择的sorted run错误", tt.sizes, ret, tt.expect)
+		}
+	}
+}
+
+func TestUniversalCompaction(t *testing.T) {
+	d := openTestDB(t, "/tmp/saver_db_universal", &Options{
+		MemTableSize:        16 * 1024,
+		L0CompactionTrigger: 4,
+		CompactionStyle:     CompactionStyleUniversal,
+	})
+	defer d.Close()
+
+	model := make(map[string]string)
+	key := func(i int) string {
+		return fmt.Sprintf("key%06d", i)
+	}
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 30000; n++ {
+		i := r.Intn(2000)
+		if r.Intn(10) == 0 {
+			delete(model, key(i))
+			if err := d.Delete([]byte(key(i))); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		val := fmt.Sprintf("value%d-%d", i, n)
+		model[key(i)] = val
+		if err := d.Put([]byte(key(i)), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	d.waitForCompaction()
+	v := d.defaultCF.current
+	if n := len(v.levels[0]); n == 0 || n >= d.opts.L0CompactionTrigger {
+		t.Error("sorted run的数量错误", n)
+	}
+	for level := 1; level < numLevels; level++ {
+		if len(v.levels[level]) != 0 {
+			t.Error("universal compaction不应该使用L0以外的层", level)
+		}
+	}
+	for i := 1; i < len(v.levels[0]); i++ {
+		if v.levels[0][i-1].minSeq <= v.levels[0][i].maxSeq {
+			t.Error("sorted run的序列号范围有重叠", i)
+		}
+	}
+	d.mu.Unlock()
+	for i := 0; i < 2000; i++ {
+		val, ok := model[key(i)]
+		expectGet(t, d, key(i), val, ok)
+	}
+
+	// 导入的文件放在L0
+	path := "/tmp/saver_db_universal_ingest.sst"
+	writeExternalFile(t, path, []string{"zzz"}, "v")
+	if err := d.IngestExternalFiles([]string{path}); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	d.waitForCompaction()
+	for level := 1; level < numLevels; level++ {
+		if len(d.defaultCF.current.levels[level]) != 0 {
+			t.Error("导入的文件应该放在L0", level)
+		}
+	}
+	d.mu.Unlock()
+	expectGet(t, d, "zzz", "vzzz", true)
+}
@@ -0,0 +1,333 @@
+package db
+
+import (
+	"bytes"
+	"os"
+	"sort"
+
+	"github.com/InsZVA/saver/record"
+	"github.com/InsZVA/saver/table"
+)
+
+const numLevels = 7
+
+// fileMetadata 一个SSTable的元数据
+type fileMetadata struct {
+	fileNum uint64
+	size    uint64
+	// 文件中key的范围，包括范围删除标记
+	smallest table.Key
+	largest  table.Key
+	minSeq   uint64
+	maxSeq   uint64
+	// 文件中的blob指针引用的每个blob文件以及引用的value总长度，没有时为nil
+	blobRefs map[uint64]uint64
+}
+
+// largestExclusive largest是范围删除标记的End时不包含在文件中
+func (f *fileMetadata) largestExclusive() bool {
+	return f.largest.Kind() == table.KindRangeDelete
+}
+
+// afterLargest key是否在文件的范围之后
+func (f *fileMetadata) afterLargest(key []byte) bool {
+	c := bytes.Compare(key, f.largest.Key())
+	return c > 0 || (c == 0 && f.largestExclusive())
+}
+
+// overlaps 文件与[start, end]是否有交集，start或end为nil表示这一侧不限制
+func (f *fileMetadata) overlaps(start, end []byte) bool {
+	if start != nil && f.afterLargest(start) {
+		return false
+	}
+	if end != nil && bytes.Compare(end, f.smallest.Key()) < 0 {
+		return false
+	}
+	return true
+}
+
+func (f *fileMetadata) contains(key []byte) bool {
+	return f.overlaps(key, key)
+}
+
+// version 某一时刻所有层的文件，生成之后不再修改
+// 读取时持有当前的version，不受并发的flush和导入影响
+// L0中的文件可能互相重叠，按maxSeq从新到旧排列；其他层的文件互不重叠，按key排列
+type version struct {
+	levels [numLevels][]*fileMetadata
+	// 正在使用这个version的读取方数，由DB.mu保护
+	refs int
+}
+
+// overlaps level中与[start, end]有交集的文件
+func (v *version) overlaps(level int, start, end []byte) []*fileMetadata {
+	var ret []*fileMetadata
+	for _, f := range v.levels[level] {
+		if f.overlaps(start, end) {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// find level（不包括L0）中可能包含key的文件
+func (v *version) find(level int, key []byte) *fileMetadata {
+	files := v.levels[level]
+	i := sort.Search(len(files), func(i int) bool {
+		return !files[i].afterLargest(key)
+	})
+	if i < len(files) && files[i].contains(key) {
+		return files[i]
+	}
+	return nil
+}
+
+// filesFor 可能包含key的文件，从新到旧排列
+// L0的文件互相重叠，需要全部检查，其他层每层最多一个文件
+func (v *version) filesFor(key []byte) []*fileMetadata {
+	var files []*fileMetadata
+	for _, f := range v.levels[0] {
+		if f.contains(key) {
+			files = append(files, f)
+		}
+	}
+	for level := 1; level < numLevels; level++ {
+		if f := v.find(level, key); f != nil {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+type newFile struct {
+	level int
+	meta  *fileMetadata
+}
+
+type deletedFile struct {
+	level   int
+	fileNum uint64
+}
+
+// versionEdit 一个列族从一个version到下一个version的变化，写入MANIFEST时还会记录文件编号和序列号
+type versionEdit struct {
+	// 修改的列族
+	cf uint32
+	// 不为空时创建名为newFamily的列族
+	newFamily  string
+	dropFamily bool
+	// 用过的最大的列族编号，只记录在MANIFEST的第一条记录中
+	hasMaxColumnFamily bool
+	maxColumnFamily    uint32
+	// 比logNum老的日志中这个列族的记录都已经写入了SSTable
+	hasLogNum      bool
+	logNum         uint64
+	hasNextFileNum bool
+	nextFileNum    uint64
+	hasLastSeq     bool
+	lastSeq        uint64
+	added          []newFile
+	deleted        map[deletedFile]bool
+}
+
+func (edit *versionEdit) addFile(level int, meta *fileMetadata) {
+	edit.added = append(edit.added, newFile{level, meta})
+}
+
+func (edit *versionEdit) deleteFile(level int, fileNum uint64) {
+	if edit.deleted == nil {
+		edit.deleted = make(map[deletedFile]bool)
+	}
+	edit.deleted[deletedFile{level, fileNum}] = true
+}
+
+// apply 生成应用了edit之后的新version，v本身不变
+func (v *version) apply(edit *versionEdit) *version {
+	nv := &version{}
+	for level, files := range v.levels {
+		for _, f := range files {
+			if !edit.deleted[deletedFile{level, f.fileNum}] {
+				nv.levels[level] = append(nv.levels[level], f)
+			}
+		}
+	}
+	for _, nf := range edit.added {
+		nv.levels[nf.level] = append(nv.levels[nf.level], nf.meta)
+	}
+	l0 := nv.levels[0]
+	sort.Slice(l0, func(i, j int) bool {
+		if l0[i].maxSeq != l0[j].maxSeq {
+			return l0[i].maxSeq > l0[j].maxSeq
+		}
+		return l0[i].fileNum > l0[j].fileNum
+	})
+	for level := 1; level < numLevels; level++ {
+		files := nv.levels[level]
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].smallest.Cmp(files[j].smallest) < 0
+		})
+	}
+	return nv
+}
+
+// versionSet 所有列族当前的version以及文件编号和序列号的分配，由DB.mu保护
+type versionSet struct {
+	families        map[uint32]*ColumnFamily
+	maxColumnFamily uint32
+	// 不再是current但仍有读取方引用的version
+	old map[*version]bool
+	// compaction删除的文件，在没有version引用之后才从磁盘上删除
+	obsolete map[uint64]bool
+	// 被删除的文件引用过的blob文件，在没有version中的文件引用之后才从磁盘上删除
+	obsoleteBlobs map[uint64]bool
+	nextFileNum   uint64
+	lastSeq       uint64
+
+	dirname string
+	// 当前的MANIFEST，为nil时不记录version edit
+	manifestNum     uint64
+	manifestFile    *os.File
+	manifest        *record.Writer
+	manifestSize    uint64
+	maxManifestSize uint64
+}
+
+func newVersionSet() *versionSet {
+	vs := &versionSet{
+		families:      make(map[uint32]*ColumnFamily),
+		old:           make(map[*version]bool),
+		obsolete:      make(map[uint64]bool),
+		obsoleteBlobs: make(map[uint64]bool),
+		nextFileNum:   1,
+	}
+	vs.families[defaultColumnFamilyID] = newColumnFamily(defaultColumnFamilyID, DefaultColumnFamilyName)
+	return vs
+}
+
+func (vs *versionSet) newFileNum() uint64 {
+	n := vs.nextFileNum
+	vs.nextFileNum++
+	return n
+}
+
+// markFileNumUsed 之后分配的文件编号都大于num
+func (vs *versionSet) markFileNumUsed(num uint64) {
+	if vs.nextFileNum <= num {
+		vs.nextFileNum = num + 1
+	}
+}
+
+// applyEdit 应用edit，生成列族新的当前version，被删除的文件等到没有version引用时再删除
+// 列族被删除时它的所有文件都被删除
+func (vs *versionSet) applyEdit(edit *versionEdit) error {
+	if edit.newFamily != "" {
+		if vs.families[edit.cf] != nil {
+			return errBrokenManifest
+		}
+		vs.families[edit.cf] = newColumnFamily(edit.cf, edit.newFamily)
+		if edit.cf > vs.maxColumnFamily {
+			vs.maxColumnFamily = edit.cf
+		}
+	}
+	if edit.hasMaxColumnFamily && edit.maxColumnFamily > vs.maxColumnFamily {
+		vs.maxColumnFamily = edit.maxColumnFamily
+	}
+	cf := vs.families[edit.cf]
+	if cf == nil {
+		return errBrokenManifest
+	}
+	if cf.current.refs > 0 {
+		vs.old[cf.current] = true
+	}
+	if edit.dropFamily {
+		for _, files := range cf.current.levels {
+			for _, f := range files {
+				vs.markObsolete(f)
+			}
+		}
+		cf.dropped, cf.current = true, &version{}
+		delete(vs.families, cf.id)
+		return nil
+	}
+	for level, files := range cf.current.levels {
+		for _, f := range files {
+			if edit.deleted[deletedFile{level, f.fileNum}] {
+				vs.markObsolete(f)
+			}
+		}
+	}
+	cf.current = cf.current.apply(edit)
+	for _, nf := range edit.added {
+		// 文件被移动到其他层时不删除
+		delete(vs.obsolete, nf.meta.fileNum)
+	}
+	if edit.hasLogNum {
+		cf.logNum = edit.logNum
+	}
+	return nil
+}
+
+// markObsolete 标记被删除的文件以及它引用的blob文件，等到没有version引用时再删除
+func (vs *versionSet) markObsolete(f *fileMetadata) {
+	vs.obsolete[f.fileNum] = true
+	for blobNum := range f.blobRefs {
+		vs.obsoleteBlobs[blobNum] = true
+	}
+}
+
+func (vs *versionSet) ref(v *version) {
+	v.refs++
+}
+
+func (vs *versionSet) unref(v *version) {
+	v.refs--
+	if v.refs == 0 {
+		delete(vs.old, v)
+	}
+}
+
+// forEachLiveFile 对所有仍被引用的version中的文件调用fn，同一个文件可能被调用多次
+func (vs *versionSet) forEachLiveFile(fn func(f *fileMetadata)) {
+	add := func(v *version) {
+		for _, files := range v.levels {
+			for _, f := range files {
+				fn(f)
+			}
+		}
+	}
+	for _, cf := range vs.families {
+		add(cf.current)
+	}
+	for v := range vs.old {
+		add(v)
+	}
+}
+
+// liveFiles 所有仍被引用的version中的文件
+func (vs *versionSet) liveFiles() map[uint64]bool {
+	live := make(map[uint64]bool)
+	vs.forEachLiveFile(func(f *fileMetadata) {
+		live[f.fileNum] = true
+	})
+	return live
+}
+
+// liveBlobFiles 所有仍被引用的version中的文件引用的blob文件
+func (vs *versionSet) liveBlobFiles() map[uint64]bool {
+	live := make(map[uint64]bool)
+	vs.forEachLiveFile(func(f *fileMetadata) {
+		for blobNum := range f.blobRefs {
+			live[blobNum] = true
+		}
+	})
+	return live
+}
+
+// levelSize level中所有文件的总大小
+func (v *version) levelSize(level int) uint64 {
+	var size uint64
+	for _, f := range v.levels[level] {
+		size += f.size
+	}
+	return size
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/InsZVA/saver/table"
+)
+
+func testMeta(fileNum uint64, smallest, largest string, seq uint64) *fileMetadata {
+	return &fileMetadata{
+		fileNum:  fileNum,
+		smallest: table.NewKey([]byte(smallest)),
+		largest:  table.NewKey([]byte(largest)),
+		minSeq:   seq,
+		maxSeq:   seq,
+	}
+}
+
+func TestVersionApply(t *testing.T) {
+	v := &version{}
+	edit := &versionEdit{}
+	edit.addFile(0, testMeta(1, "a", "m", 10))
+	edit.addFile(0, testMeta(2, "c", "z", 20))
+	edit.addFile(1, testMeta(3, "n", "p", 5))
+	edit.addFile(1, testMeta(4, "a", "c", 5))
+	v1 := v.apply(edit)
+	if len(v.levels[0]) != 0 {
+		t.Error("apply不应该修改原来的version")
+	}
+	// L0按序列号从新到旧，其他层按key排列
+	if v1.levels[0][0].fileNum != 2 || v1.levels[0][1].fileNum != 1 {
+		t.Error("L0顺序错误")
+	}
+	if v1.levels[1][0].fileNum != 4 || v1.levels[1][1].fileNum != 3 {
+		t.Error("L1顺序错误")
+	}
+	if f := v1.find(1, []byte("o")); f == nil || f.fileNum != 3 {
+		t.Error("find错误")
+	}
+	if f := v1.find(1, []byte("d")); f != nil {
+		t.Error("find错误")
+	}
+	if n := len(v1.overlaps(0, []byte("n"), []byte("o"))); n != 1 {
+		t.Error("overlaps错误", n)
+	}
+	if n := len(v1.overlaps(1, nil, nil)); n != 2 {
+		t.Error("overlaps错误", n)
+	}
+
+	edit = &versionEdit{}
+	edit.deleteFile(0, 2)
+	edit.deleteFile(1, 2)
+	v2 := v1.apply(edit)
+	if len(v2.levels[0]) != 1 || len(v2.levels[1]) != 2 || len(v1.levels[0]) != 2 {
+		t.Error("删除文件错误")
+	}
+}
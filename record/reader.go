@@ -3,7 +3,6 @@ package record
 import (
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"hash/crc32"
 	"io"
 )
@@ -25,11 +24,22 @@ type BaseReader struct {
 	start bool
 	// 读取过程中存在的错误
 	err error
+	// 当前块相对于reader开头的偏移
+	blockOffset int64
+	// 最近读取的一条记录相对于reader开头的偏移
+	recordOffset int64
 }
 
 func (reader *BaseReader) nextBlock() error {
-	fmt.Println("next block:")
-	n, err := reader.reader.Read(reader.buf[:])
+	n, err := io.ReadFull(reader.reader, reader.buf[:])
+	if err == io.ErrUnexpectedEOF {
+		// 文件的最后一个块可能不完整
+		err = nil
+	}
+	if reader.start {
+		reader.blockOffset += blockSize
+	}
+	reader.start = true
 	reader.n = n
 	reader.err = err
 	reader.s = 0
@@ -44,30 +54,36 @@ func (reader *BaseReader) Recover() error {
 
 // expectNum为期望这个chunk的内容大小，expectNum>=blockSize表示尽可能多的读取（在读取full和mid时候）
 func (reader *BaseReader) NextChunk(expectNum int) error {
-	if reader.j+chunkHeaderSize > blockSize {
-		// 跳到下一个Block继续读
-		err := reader.nextBlock()
-		if err != nil && err != io.EOF {
+	if !reader.start {
+		if err := reader.nextBlock(); err != nil {
+			return err
+		}
+	}
+	// 剩余空间放不下header，或者遇到了flush时补齐的0，跳到下一个Block继续读
+	for reader.j+chunkHeaderSize > reader.n || reader.buf[reader.j+6] == chunkPadding {
+		if reader.n < blockSize {
+			// 不完整的块只可能是文件的最后一个块
+			return io.EOF
+		}
+		if err := reader.nextBlock(); err != nil {
 			return err
 		}
-		return reader.NextChunk(expectNum)
 	}
-	fmt.Println(reader.j, reader.buf)
 	checkSum := uint32(binary.LittleEndian.Uint32(reader.buf[reader.j:]))
 	length := int(binary.LittleEndian.Uint16(reader.buf[reader.j+4:]))
-
-	fmt.Println("find chunk: length", length)
-
 	chunkType := reader.buf[reader.j+6]
-	// TODO: blockSize -> n
 
 	reader.s = reader.j + chunkHeaderSize
 	if length < expectNum {
 		expectNum = length
 	}
+	if reader.n < blockSize && reader.s+expectNum > reader.n {
+		// 写到一半时崩溃，文件的最后一个chunk不完整
+		return io.ErrUnexpectedEOF
+	}
 	reader.j = reader.s + expectNum
-	if reader.j > blockSize {
-		reader.j = blockSize
+	if reader.j > reader.n {
+		reader.j = reader.n
 	}
 	reader.header.checkSum = checkSum
 	reader.header.chunkType = chunkType
@@ -76,12 +92,15 @@ func (reader *BaseReader) NextChunk(expectNum int) error {
 	return nil
 }
 
+// ReadRecord 读取下一条记录，没有更多记录时返回io.EOF
 func (reader *BaseReader) ReadRecord() ([]byte, error) {
 	cur_data := make([]byte, 0)
 	err := reader.NextChunk(blockSize)
 	if err != nil {
 		return nil, err
 	}
+	reader.recordOffset = reader.blockOffset + int64(reader.s-chunkHeaderSize)
+
 	cur_data = append(cur_data, reader.buf[reader.s:reader.j]...)
 	if reader.header.chunkType == chunkFull {
 	} else if reader.header.chunkType == chunkFirst {
@@ -90,7 +109,7 @@ func (reader *BaseReader) ReadRecord() ([]byte, error) {
 		}
 		err = reader.NextChunk(int(reader.header.length) - len(cur_data))
 		if err != nil {
-			return nil, err
+			return nil, unexpectedEOF(err)
 		}
 		cur_data = append(cur_data, reader.buf[reader.s:reader.j]...)
 		if reader.header.chunkType == chunkMid {
@@ -99,7 +118,7 @@ func (reader *BaseReader) ReadRecord() ([]byte, error) {
 			}
 			err = reader.NextChunk(int(reader.header.length) - len(cur_data))
 			if err != nil {
-				return nil, err
+				return nil, unexpectedEOF(err)
 			}
 			cur_data = append(cur_data, reader.buf[reader.s:reader.j]...)
 			if reader.header.chunkType != chunkLast {
@@ -121,3 +140,11 @@ func (reader *BaseReader) ReadRecord() ([]byte, error) {
 	}
 	return cur_data, nil
 }
+
+// 记录读到一半时文件结束
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package record
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+)
+
+// BaseWriter一次能写入的最大长度
+const maxRecordSize = 2*blockSize - 2*chunkHeaderSize
+
+// 分片的第一个字节
+const (
+	fragmentLast = 0
+	fragmentMore = 1
+)
+
+var errBrokenFragment = errors.New("记录分片错误")
+
+// Writer 在BaseWriter之上支持任意长度的记录
+// 超过maxRecordSize的记录被拆分成多个分片依次写入，每个分片的第一个字节标记后面是否还有分片
+type Writer struct {
+	base BaseWriter
+}
+
+// NewWriter 从file的开头开始写入
+func NewWriter(file *os.File) *Writer {
+	return &Writer{base: BaseWriter{curFile: file}}
+}
+
+// Write 写入一条记录，返回记录在文件中的偏移，可以用NewReaderAt从这个偏移读取
+func (writer *Writer) Write(b []byte) (int64, error) {
+	offset := writer.base.offset()
+	size := len(b)
+	if size > maxRecordSize-1 {
+		size = maxRecordSize - 1
+	}
+	frag := make([]byte, 0, size+1)
+	for first := true; first || len(b) > 0; first = false {
+		n, flag := len(b), byte(fragmentLast)
+		if n > maxRecordSize-1 {
+			n, flag = maxRecordSize-1, fragmentMore
+		}
+		frag = append(append(frag[:0], flag), b[:n]...)
+		if _, err := writer.base.write(frag); err != nil {
+			return offset, err
+		}
+		b = b[n:]
+	}
+	return offset, nil
+}
+
+// Flush 将未写满的块补齐后写入磁盘，之后的记录从新的块开始
+func (writer *Writer) Flush() error {
+	if writer.base.j == 0 {
+		return nil
+	}
+	return writer.base.flush()
+}
+
+// Push 把缓冲中的记录写入文件但不等待同步到磁盘，进程崩溃时不会丢失，不补齐当前块
+func (writer *Writer) Push() error {
+	return writer.base.push()
+}
+
+// Sync 把已经写入的记录同步到磁盘，与Flush不同，不补齐当前块
+func (writer *Writer) Sync() error {
+	return writer.base.sync()
+}
+
+func (writer *Writer) Close() error {
+	if err := writer.Flush(); err != nil {
+		writer.base.curFile.Close()
+		return err
+	}
+	return writer.base.curFile.Close()
+}
+
+// Reader 读取Writer写入的记录
+type Reader struct {
+	base BaseReader
+	// 第一个块在文件中的偏移
+	start int64
+	// 第一个块中开始读取的位置
+	skip int
+	// 最近读取的一条记录在文件中的偏移
+	offset int64
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{base: BaseReader{reader: r}}
+}
+
+// NewReaderAt 从offset处开始读取，offset必须是Writer.Write返回的偏移
+func NewReaderAt(r io.ReaderAt, offset int64) *Reader {
+	start := offset - offset%blockSize
+	return &Reader{
+		base:  BaseReader{reader: io.NewSectionReader(r, start, math.MaxInt64-start)},
+		start: start,
+		skip:  int(offset - start),
+	}
+}
+
+// Read 读取下一条记录，没有更多记录时返回io.EOF
+func (reader *Reader) Read() ([]byte, error) {
+	if !reader.base.start {
+		if err := reader.base.nextBlock(); err != nil {
+			return nil, err
+		}
+		reader.base.j = reader.skip
+	}
+	var data []byte
+	for {
+		frag, err := reader.base.ReadRecord()
+		if err != nil {
+			if data != nil {
+				err = unexpectedEOF(err)
+			}
+			return nil, err
+		}
+		if len(frag) == 0 {
+			return nil, errBrokenFragment
+		}
+		if data == nil {
+			reader.offset = reader.start + reader.base.recordOffset
+			data = make([]byte, 0, len(frag)-1)
+		}
+		data = append(data, frag[1:]...)
+		switch frag[0] {
+		case fragmentLast:
+			return data, nil
+		case fragmentMore:
+		default:
+			return nil, errBrokenFragment
+		}
+	}
+}
+
+// Offset 最近一次Read返回的记录在文件中的偏移
+func (reader *Reader) Offset() int64 {
+	return reader.offset
+}
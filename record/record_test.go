@@ -0,0 +1,216 @@
+package record
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/InsZVA/saver/util"
+)
+
+func TestWriterReader(t *testing.T) {
+	f, err := os.Create("/tmp/record_large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := NewWriter(f)
+	datas := [][]byte{
+		[]byte("Hello, world"),
+		{},
+		util.RandomSlice(maxRecordSize - 1),
+		util.RandomSlice(maxRecordSize),
+		util.RandomSlice(100 * 1024),
+		util.RandomSlice(blockSize - chunkHeaderSize*2),
+		util.RandomSlice(3*maxRecordSize + 17),
+		[]byte("end"),
+	}
+	offsets := []int64{}
+	for _, data := range datas {
+		offset, err := writer.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, offset)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = os.Open("/tmp/record_large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// 顺序读取
+	reader := NewReader(f)
+	for i, data := range datas {
+		d, err := reader.Read()
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if !bytes.Equal(d, data) {
+			t.Error(i, "顺序读取的记录错误")
+		}
+		if reader.Offset() != offsets[i] {
+			t.Error(i, "记录的偏移错误", reader.Offset(), offsets[i])
+		}
+	}
+	if _, err = reader.Read(); err != io.EOF {
+		t.Error("读完之后没有返回EOF", err)
+	}
+	// 随机读取
+	for i := len(datas) - 1; i >= 0; i-- {
+		d, err := NewReaderAt(f, offsets[i]).Read()
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if !bytes.Equal(d, datas[i]) {
+			t.Error(i, "随机读取的记录错误")
+		}
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	f, err := os.Create("/tmp/record_truncated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := NewWriter(f)
+	first := []byte("first")
+	writer.Write(first)
+	writer.Write(util.RandomSlice(3 * blockSize))
+	writer.Close()
+	// 模拟写到一半时崩溃
+	if err = os.Truncate("/tmp/record_truncated", 2*blockSize+100); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = os.Open("/tmp/record_truncated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader := NewReader(f)
+	d, err := reader.Read()
+	if err != nil || !bytes.Equal(d, first) {
+		t.Error("第一条记录读取错误", err)
+	}
+	if _, err = reader.Read(); err != io.ErrUnexpectedEOF {
+		t.Error("不完整的记录没有返回ErrUnexpectedEOF", err)
+	}
+}
+
+func TestWriterSync(t *testing.T) {
+	path := "/tmp/record_sync"
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := NewWriter(f)
+	var datas [][]byte
+	expectRecords := func() {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		reader := NewReader(f)
+		for i, data := range datas {
+			d, err := reader.Read()
+			if err != nil {
+				t.Fatal(i, err)
+			}
+			if !bytes.Equal(d, data) {
+				t.Error(i, "Sync之后读取的记录错误")
+			}
+		}
+		if _, err := reader.Read(); err != io.EOF {
+			t.Error("读完之后没有返回EOF", err)
+		}
+	}
+	write := func(data []byte) {
+		if _, err := writer.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		datas = append(datas, data)
+	}
+
+	write([]byte("a"))
+	write([]byte("b"))
+	if err = writer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); info.Size() >= blockSize {
+		t.Error("Sync不应该补齐块", info.Size())
+	}
+	expectRecords()
+	// 跨越块的记录
+	write(util.RandomSlice(blockSize))
+	write([]byte("c"))
+	if err = writer.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	expectRecords()
+	write([]byte("d"))
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectRecords()
+}
+
+func TestReaderTornChunk(t *testing.T) {
+	path := "/tmp/record_torn"
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := NewWriter(f)
+	datas := [][]byte{util.RandomSlice(blockSize + 100)}
+	for i := 0; i < 20; i++ {
+		datas = append(datas, util.RandomSlice(100+i))
+	}
+	var ends []int64
+	for _, data := range datas {
+		writer.Write(data)
+		if err = writer.Push(); err != nil {
+			t.Fatal(err)
+		}
+		info, _ := f.Stat()
+		ends = append(ends, info.Size())
+	}
+	f.Close()
+	full, _ := ioutil.ReadFile(path)
+
+	// 模拟在最后一个块中写到一半时进程被杀死
+	for size := ends[0]; size <= ends[len(ends)-1]; size += 7 {
+		ioutil.WriteFile(path, full[:size], 0644)
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := NewReader(f)
+		n := 0
+		for ; ; n++ {
+			d, err := reader.Read()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(size, err)
+			}
+			if !bytes.Equal(d, datas[n]) {
+				t.Fatal(size, n, "记录错误")
+			}
+		}
+		f.Close()
+		expect := 0
+		for expect < len(ends) && ends[expect] <= size {
+			expect++
+		}
+		if n != expect {
+			t.Error(size, "完整的记录数错误", n, expect)
+		}
+	}
+}
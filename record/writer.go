@@ -10,11 +10,12 @@ import (
 const (
 	chunkHeaderSize = 7
 	blockSize       = 128
-	// chunk的类型
-	chunkFull  = 1
-	chunkFirst = 2
-	chunkMid   = 3
-	chunkLast  = 4
+	// chunk的类型，0为flush时补齐块的填充
+	chunkPadding = 0
+	chunkFull    = 1
+	chunkFirst   = 2
+	chunkMid     = 3
+	chunkLast    = 4
 )
 
 var (
@@ -27,6 +28,10 @@ type BaseWriter struct {
 	curFile *os.File
 	buf     [blockSize]byte
 	j       int
+	// 当前块中已经通过push写入文件的长度
+	written int
+	// 当前块在文件中的偏移
+	blockOffset int64
 }
 
 type chunkHeader struct {
@@ -100,14 +105,49 @@ func (writer *BaseWriter) write(b []byte) (n int, err error) {
 
 // 将buff中的数据写入磁盘
 func (writer *BaseWriter) flush() error {
-	n, err := writer.curFile.Write(writer.buf[:])
+	n, err := writer.curFile.Write(writer.buf[writer.written:])
 	if err != nil {
 		return err
 	}
-	if n != blockSize {
+	if n != blockSize-writer.written {
 		return errWriteLoss
 	}
 	writer.curFile.Sync()
+	// 清空buf，未写满的块剩余部分必须是0
+	writer.buf = [blockSize]byte{}
 	writer.j = 0
+	writer.written = 0
+	writer.blockOffset += blockSize
 	return nil
 }
+
+// push 把当前块中还没有写入的部分写入文件，不补齐块，之后的记录继续写在这个块中
+func (writer *BaseWriter) push() error {
+	if writer.j > writer.written {
+		n, err := writer.curFile.Write(writer.buf[writer.written:writer.j])
+		if err != nil {
+			return err
+		}
+		if n != writer.j-writer.written {
+			return errWriteLoss
+		}
+		writer.written = writer.j
+	}
+	return nil
+}
+
+// sync 在push之后把文件同步到磁盘
+func (writer *BaseWriter) sync() error {
+	if err := writer.push(); err != nil {
+		return err
+	}
+	return writer.curFile.Sync()
+}
+
+// offset 下一条记录在文件中的偏移
+func (writer *BaseWriter) offset() int64 {
+	if writer.j+chunkHeaderSize > blockSize {
+		return writer.blockOffset + blockSize
+	}
+	return writer.blockOffset + int64(writer.j)
+}
@@ -0,0 +1,345 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/InsZVA/saver/table"
+)
+
+// blockHandle 指向文件中的一个块
+type blockHandle struct {
+	offset uint64
+	length uint64
+}
+
+const blockHandleSize = 16
+
+func (h blockHandle) encode(b []byte) {
+	binary.LittleEndian.PutUint64(b, h.offset)
+	binary.LittleEndian.PutUint64(b[8:], h.length)
+}
+
+func decodeBlockHandle(b []byte) blockHandle {
+	return blockHandle{
+		offset: binary.LittleEndian.Uint64(b),
+		length: binary.LittleEndian.Uint64(b[8:]),
+	}
+}
+
+/*
+data block:
+[KeyLength32, keyValue..., trailer64]
+[ValLength32, valValue...]
+...
+[offset32, offset32...] 每条记录在块内的偏移，用于块内二分查找
+[bucket16, bucket16...] 可选的hash索引，key的hash对numBuckets取模得到桶，桶中为这个key在块中第一个版本的下标
+[numBuckets32]          只有num32的最高位为1时才有hash索引
+[num32]
+*/
+type block struct {
+	data    []byte
+	offsets []byte
+	num     int
+	// hash索引，没有时为nil
+	buckets []byte
+}
+
+const (
+	// num32的最高位表示块中有hash索引
+	blockHashIndexFlag = 1 << 31
+	// 桶中的特殊值，空桶和多个key冲突的桶
+	bucketEmpty     = 0xffff
+	bucketCollision = 0xfffe
+	// 记录数超过这个值时桶中无法表示下标，不生成hash索引
+	maxHashIndexEntries = 0xfffd
+)
+
+// hashBuckets n条记录的hash索引使用的桶数，负载因子为0.75
+func hashBuckets(n int) int {
+	return n*4/3 + 1
+}
+
+func newBlock(data []byte) (*block, error) {
+	if len(data) < 4 {
+		return nil, brokenFileErr
+	}
+	num := binary.LittleEndian.Uint32(data[len(data)-4:])
+	end := len(data) - 4
+	var buckets []byte
+	if num&blockHashIndexFlag != 0 {
+		num &^= blockHashIndexFlag
+		if end < 4 {
+			return nil, brokenFileErr
+		}
+		n := int(binary.LittleEndian.Uint32(data[end-4:]))
+		end -= 4
+		if n <= 0 || 2*n > end {
+			return nil, brokenFileErr
+		}
+		buckets = data[end-2*n : end]
+		end -= 2 * n
+	}
+	start := end - 4*int(num)
+	if start < 0 {
+		return nil, brokenFileErr
+	}
+	return &block{
+		data:    data[:start],
+		offsets: data[start:end],
+		num:     int(num),
+		buckets: buckets,
+	}, nil
+}
+
+// entry 解码第i条记录，返回的切片直接引用块中的数据，不能被修改
+func (b *block) entry(i int, withVal bool) (table.Key, []byte, error) {
+	off := int(binary.LittleEndian.Uint32(b.offsets[i*4:]))
+	key, n, err := decodeSlice(b.data[off:])
+	if err != nil {
+		return table.Key{}, nil, err
+	}
+	k, err := unpackKey(key)
+	if err != nil || !withVal {
+		return k, nil, err
+	}
+	val, _, err := decodeSlice(b.data[off+n:])
+	return k, val, err
+}
+
+// search 按InternalCmp返回块内第一个大于等于key的下标，不存在时返回num
+func (b *block) search(key table.Key) (int, error) {
+	var err error
+	found := sort.Search(b.num, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var k table.Key
+		k, _, err = b.entry(i, false)
+		if err != nil {
+			return true
+		}
+		return k.InternalCmp(key) >= 0
+	})
+	return found, err
+}
+
+// lookup 查找user key等于key、序列号不大于key.Seq()的最新版本，返回记录的下标以及是否存在
+// 有hash索引时直接定位到这个key在块中的第一个版本，再向后跳过更新的版本，桶中有冲突时退回到二分查找
+func (b *block) lookup(key table.Key) (int, bool, error) {
+	i := -1
+	if b.buckets != nil {
+		n := uint32(len(b.buckets) / 2)
+		bucket := hashKey(key.Key()) % n
+		switch j := binary.LittleEndian.Uint16(b.buckets[bucket*2:]); j {
+		case bucketEmpty:
+			return b.num, false, nil
+		case bucketCollision:
+		default:
+			if int(j) >= b.num {
+				return 0, false, brokenFileErr
+			}
+			i = int(j)
+		}
+	}
+	if i < 0 {
+		var err error
+		if i, err = b.search(key); err != nil {
+			return 0, false, err
+		}
+	}
+	for ; i < b.num; i++ {
+		k, _, err := b.entry(i, false)
+		if err != nil {
+			return 0, false, err
+		}
+		if !bytes.Equal(k.Key(), key.Key()) {
+			return i, false, nil
+		}
+		if k.Seq() <= key.Seq() {
+			return i, true, nil
+		}
+	}
+	return i, false, nil
+}
+
+// decodeSlice 解码[Length32, value...]，返回value以及占用的总长度
+func decodeSlice(b []byte) ([]byte, int, error) {
+	if len(b) < 4 {
+		return nil, 0, brokenFileErr
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	if n < 0 || 4+n > len(b) {
+		return nil, 0, brokenFileErr
+	}
+	return b[4 : 4+n], 4 + n, nil
+}
+
+// blockBuilder 按block的格式构造一个块，data block和index block都使用这个格式
+type blockBuilder struct {
+	buf     []byte
+	offsets []uint32
+	// 是否生成hash索引，只用于data block
+	hashIndex bool
+	// 块中每个user key的hash以及它第一个版本的下标
+	hashes  []uint32
+	hashed  []int
+	lastKey []byte
+}
+
+func (bb *blockBuilder) add(key table.Key, val []byte) {
+	var tmp [trailerSize]byte
+	if bb.hashIndex && (len(bb.offsets) == 0 || !bytes.Equal(key.Key(), bb.lastKey)) {
+		bb.hashes = append(bb.hashes, hashKey(key.Key()))
+		bb.hashed = append(bb.hashed, len(bb.offsets))
+		bb.lastKey = append(bb.lastKey[:0], key.Key()...)
+	}
+	bb.offsets = append(bb.offsets, uint32(len(bb.buf)))
+	binary.LittleEndian.PutUint32(tmp[:], uint32(len(key.Key())+trailerSize))
+	bb.buf = append(bb.buf, tmp[:4]...)
+	bb.buf = append(bb.buf, key.Key()...)
+	binary.LittleEndian.PutUint64(tmp[:], packTrailer(key))
+	bb.buf = append(bb.buf, tmp[:]...)
+	binary.LittleEndian.PutUint32(tmp[:], uint32(len(val)))
+	bb.buf = append(bb.buf, tmp[:4]...)
+	bb.buf = append(bb.buf, val...)
+}
+
+// entrySize 一条记录在块中占用的大小，包括块尾的偏移
+func entrySize(key table.Key, val []byte) int {
+	return 4 + len(key.Key()) + trailerSize + 4 + len(val) + 4
+}
+
+// estimatedSize 完成之后块的大小
+func (bb *blockBuilder) estimatedSize() int {
+	size := len(bb.buf) + 4*len(bb.offsets) + 4
+	if bb.withHashIndex() {
+		size += 2*hashBuckets(len(bb.offsets)) + 4
+	}
+	return size
+}
+
+// withHashIndex 完成时是否会写入hash索引
+func (bb *blockBuilder) withHashIndex() bool {
+	return bb.hashIndex && len(bb.offsets) > 0 && len(bb.offsets) <= maxHashIndexEntries
+}
+
+func (bb *blockBuilder) empty() bool {
+	return len(bb.offsets) == 0
+}
+
+// finish 写入块尾的偏移数组，返回完整的块，在reset之前有效
+func (bb *blockBuilder) finish() []byte {
+	var tmp [4]byte
+	for _, offset := range bb.offsets {
+		binary.LittleEndian.PutUint32(tmp[:], offset)
+		bb.buf = append(bb.buf, tmp[:]...)
+	}
+	num := uint32(len(bb.offsets))
+	if bb.withHashIndex() {
+		bb.finishHashIndex()
+		num |= blockHashIndexFlag
+	}
+	binary.LittleEndian.PutUint32(tmp[:], num)
+	bb.buf = append(bb.buf, tmp[:]...)
+	return bb.buf
+}
+
+func (bb *blockBuilder) finishHashIndex() {
+	n := hashBuckets(len(bb.offsets))
+	buckets := make([]uint16, n)
+	for i := range buckets {
+		buckets[i] = bucketEmpty
+	}
+	for i, h := range bb.hashes {
+		b := h % uint32(n)
+		if buckets[b] == bucketEmpty {
+			buckets[b] = uint16(bb.hashed[i])
+		} else {
+			buckets[b] = bucketCollision
+		}
+	}
+	var tmp [4]byte
+	for _, b := range buckets {
+		binary.LittleEndian.PutUint16(tmp[:], b)
+		bb.buf = append(bb.buf, tmp[:2]...)
+	}
+	binary.LittleEndian.PutUint32(tmp[:], uint32(n))
+	bb.buf = append(bb.buf, tmp[:]...)
+}
+
+func (bb *blockBuilder) reset() {
+	bb.buf = bb.buf[:0]
+	bb.offsets = bb.offsets[:0]
+	bb.hashes = bb.hashes[:0]
+	bb.hashed = bb.hashed[:0]
+}
+
+func copySlice(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// blockState 每个迭代器（或者每次查找）私有的块状态，保存最近读取的一个data block和一个index partition
+type blockState struct {
+	offset          uint64
+	block           *block
+	partitionOffset uint64
+	partition       *block
+}
+
+// readBlock 读取一个块，优先从共享的块缓存中读取
+func (reader *SSTReader) readBlock(bs *blockState, h blockHandle) (*block, error) {
+	if bs.block != nil && bs.offset == h.offset {
+		return bs.block, nil
+	}
+	data, err := reader.readRaw(h)
+	if err != nil {
+		return nil, err
+	}
+	b, err := newBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	bs.offset, bs.block = h.offset, b
+	return b, nil
+}
+
+// readRaw 读取h指向的原始数据，返回的切片会被共享，不能被修改
+func (reader *SSTReader) readRaw(h blockHandle) ([]byte, error) {
+	if m := reader.sst.mapped; m != nil {
+		if h.offset+h.length > uint64(len(m)) {
+			return nil, brokenFileErr
+		}
+		return m[h.offset : h.offset+h.length : h.offset+h.length], nil
+	}
+	c := reader.sst.opts.Cache
+	if c != nil {
+		if b, ok := c.Get(reader.sst.opts.FileNum, h.offset); ok {
+			return b, nil
+		}
+	}
+	data := make([]byte, h.length)
+	if err := readFull(reader.sst.file, data, int64(h.offset)); err != nil {
+		return nil, err
+	}
+	if c != nil {
+		c.Set(reader.sst.opts.FileNum, h.offset, data)
+	}
+	return data, nil
+}
+
+func readFull(r io.ReaderAt, data []byte, offset int64) error {
+	n, err := r.ReadAt(data, offset)
+	if n == len(data) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = brokenFileErr
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package sstable
+
+import (
+	"bytes"
+
+	"github.com/InsZVA/saver/table"
+)
+
+// Bounds 表中key的范围，Smallest和Largest都包含在内
+// 保存在properties block中，打开表时即可得到，不需要读取data block
+type Bounds struct {
+	Smallest table.Key
+	Largest  table.Key
+}
+
+// Contains 表中是否可能存在这个key
+func (b Bounds) Contains(key []byte) bool {
+	return bytes.Compare(key, b.Smallest.Key()) >= 0 && bytes.Compare(key, b.Largest.Key()) <= 0
+}
+
+// Overlaps 范围[start, end)是否与表的范围有交集，start或end为nil表示这一侧不限制
+func (b Bounds) Overlaps(start, end []byte) bool {
+	if start != nil && bytes.Compare(start, b.Largest.Key()) > 0 {
+		return false
+	}
+	if end != nil && bytes.Compare(end, b.Smallest.Key()) <= 0 {
+		return false
+	}
+	return true
+}
+
+// Bounds 返回表中key的范围，包括范围删除标记覆盖的范围，空表返回false
+// 范围删除标记的End不包含在标记内，作为Largest时范围会比实际大一点，不影响裁剪的正确性
+func (reader *SSTReader) Bounds() (Bounds, bool) {
+	var b Bounds
+	ok := reader.props.NumEntries > 0
+	if ok {
+		b = Bounds{reader.props.SmallestKey, reader.props.LargestKey}
+	}
+	if n := len(reader.rangeDels); n > 0 {
+		// fragment按Start排序，并且End是递增的
+		first, last := reader.rangeDels[0], reader.rangeDels[n-1]
+		if !ok || bytes.Compare(first.Start, b.Smallest.Key()) < 0 {
+			b.Smallest = table.NewInternalKey(first.Start, first.Seq, table.KindRangeDelete)
+		}
+		if !ok || bytes.Compare(last.End, b.Largest.Key()) > 0 {
+			b.Largest = table.NewInternalKey(last.End, table.MaxSeq, table.KindRangeDelete)
+		}
+		ok = true
+	}
+	return b, ok
+}
+
+// mayContain 根据范围判断是否需要查找，不在范围内的key不必读取索引
+func (reader *SSTReader) mayContain(key []byte) bool {
+	b, ok := reader.Bounds()
+	return ok && b.Contains(key)
+}
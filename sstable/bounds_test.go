@@ -0,0 +1,63 @@
+package sstable
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBounds(t *testing.T) {
+	sst, reader := newTestReader(t, "/tmp/sst_bounds", 100)
+	defer sst.Close()
+	b, ok := reader.Bounds()
+	if !ok {
+		t.Fatal("非空表应该有范围")
+	}
+	if !bytes.Equal(b.Smallest.Key(), k(0).Key()) || !bytes.Equal(b.Largest.Key(), k(198).Key()) {
+		t.Fatal("范围错误", string(b.Smallest.Key()), string(b.Largest.Key()))
+	}
+	for _, c := range []struct {
+		key string
+		ok  bool
+	}{
+		{"", false}, {"0000", true}, {"0101", true}, {"0198", true}, {"0199", false}, {"1", false},
+	} {
+		if b.Contains([]byte(c.key)) != c.ok {
+			t.Error("Contains错误", c.key)
+		}
+	}
+	for _, c := range []struct {
+		start, end []byte
+		ok         bool
+	}{
+		{nil, nil, true},
+		{nil, []byte("0000"), false},
+		{nil, []byte("00000"), true},
+		{[]byte("0198"), nil, true},
+		{[]byte("01980"), nil, false},
+		{[]byte("0050"), []byte("0060"), true},
+		{[]byte("0"), []byte("1"), true},
+		{[]byte("1"), []byte("2"), false},
+	} {
+		if b.Overlaps(c.start, c.end) != c.ok {
+			t.Error("Overlaps错误", string(c.start), string(c.end))
+		}
+	}
+	// 范围之外的key直接返回不存在
+	if _, ok, err := reader.Get(k(199)); ok || err != nil {
+		t.Error("范围之外的key不应该存在", err)
+	}
+	if val, ok, err := reader.Get(k(198)); !ok || err != nil || string(val) != "v198" {
+		t.Error("最大的key应该存在", err)
+	}
+}
+
+func TestBoundsEmpty(t *testing.T) {
+	sst, reader := newTestReader(t, "/tmp/sst_bounds_empty", 0)
+	defer sst.Close()
+	if _, ok := reader.Bounds(); ok {
+		t.Error("空表没有范围")
+	}
+	if _, ok, err := reader.Get(k(0)); ok || err != nil {
+		t.Error("空表中不应该有key", err)
+	}
+}
@@ -0,0 +1,75 @@
+package sstable
+
+/*
+filter block（布隆过滤器）:
+[bits...][k8]  k为每个key的探测次数
+每个index partition对应一个filter block，包含这个partition中所有data block的key
+*/
+
+// hashKey 32位的FNV-1a
+func hashKey(b []byte) uint32 {
+	h := uint32(2166136261)
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return h
+}
+
+// filterSize n个key生成的filter block的大小
+func filterSize(n, bitsPerKey int) int {
+	bits := n * bitsPerKey
+	// key很少时误判率会很高，设置一个下限
+	if bits < 64 {
+		bits = 64
+	}
+	return (bits+7)/8 + 1
+}
+
+// buildFilter 根据key的hash生成filter block
+func buildFilter(hashes []uint32, bitsPerKey int) []byte {
+	// k = ln2 * bitsPerKey 时误判率最低
+	k := bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	filter := make([]byte, filterSize(len(hashes), bitsPerKey))
+	bits := uint32(len(filter)-1) * 8
+	for _, h := range hashes {
+		// 双重hash，用h的旋转作为步长生成k个位置
+		delta := h>>17 | h<<15
+		for j := 0; j < k; j++ {
+			pos := h % bits
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	filter[len(filter)-1] = byte(k)
+	return filter
+}
+
+// filterMayContain key是否可能在filter中，返回false时一定不存在
+func filterMayContain(filter []byte, key []byte) bool {
+	if len(filter) < 2 {
+		return true
+	}
+	k := int(filter[len(filter)-1])
+	if k > 30 {
+		// 保留给以后的格式，不能判断时视为可能存在
+		return true
+	}
+	bits := uint32(len(filter)-1) * 8
+	h := hashKey(key)
+	delta := h>>17 | h<<15
+	for j := 0; j < k; j++ {
+		pos := h % bits
+		if filter[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
@@ -0,0 +1,36 @@
+package sstable
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	n := 10000
+	hashes := make([]uint32, n)
+	for i := 0; i < n; i++ {
+		hashes[i] = hashKey([]byte(fmt.Sprintf("key%d", i)))
+	}
+	filter := buildFilter(hashes, 10)
+	if len(filter) != filterSize(n, 10) {
+		t.Error("filter大小错误", len(filter))
+	}
+	for i := 0; i < n; i++ {
+		if !filterMayContain(filter, []byte(fmt.Sprintf("key%d", i))) {
+			t.Fatal("filter中的key被判断为不存在", i)
+		}
+	}
+	fp := 0
+	for i := 0; i < n; i++ {
+		if filterMayContain(filter, []byte(fmt.Sprintf("other%d", i))) {
+			fp++
+		}
+	}
+	// 每个key 10位时误判率约为1%
+	if fp > n/50 {
+		t.Error("误判率过高", fp)
+	}
+	if !filterMayContain(nil, []byte("a")) {
+		t.Error("空的filter应该总是返回可能存在")
+	}
+}
@@ -0,0 +1,280 @@
+package sstable
+
+import (
+	"bytes"
+
+	"github.com/InsZVA/saver/table"
+)
+
+// IterOptions 迭代器的选项
+type IterOptions struct {
+	// 下界（包含），为nil时不限制
+	LowerBound []byte
+	// 上界（不包含），为nil时不限制
+	UpperBound []byte
+	// 不跳过被本表的范围删除标记覆盖的记录，用于需要保留旧版本的compaction和快照读取
+	KeepCovered bool
+}
+
+// Iterator SSTable上的双向迭代器，按table.Key.InternalCmp排列，同一个user key的多个版本从新到旧排列
+// 被本表的范围删除标记覆盖的记录默认会被跳过
+// 新建的迭代器位于第一个元素之前，可以直接调用Next，也可以先调用First/Last/SeekGE/SeekLT定位
+// 文件被映射时，Key、Value和RawValue返回的切片直接引用映射的内存，不能被修改，只在Close之前有效，
+// 否则它们在下一次移动迭代器之前有效
+// 迭代器使用完之后必须调用Close，映射的文件在所有迭代器关闭之后才会解除映射
+type Iterator struct {
+	reader *SSTReader
+	opts   IterOptions
+	// 迭代器私有的块状态，顺序扫描时不需要重复读取同一个块
+	bs blockState
+	// 当前位于第blk个块的第ent条记录
+	// blk为-1表示位于第一个元素之前，blk为numBlocks表示越过了最后一个元素
+	blk, ent int
+	valid    bool
+	key      table.Key
+	val      []byte
+	// 记录中实际保存的数据，对于普通的记录与val相同
+	raw []byte
+	// val是否已经从blob文件中读取
+	resolved bool
+	err      error
+	// 是否持有映射内存的引用，持有时读取的数据不复制
+	mapped bool
+	// Find定位之后还没有调用Next，下一次Next停留在当前位置
+	pending bool
+}
+
+func (reader *SSTReader) NewIterator(opts *IterOptions) *Iterator {
+	it := &Iterator{reader: reader, blk: -1}
+	if opts != nil {
+		it.opts = *opts
+	}
+	it.mapped = reader.sst.ref()
+	return it
+}
+
+// 加载第blk个块的第ent条记录，ent为-1表示块的最后一条
+// 越界或者超出上下界时迭代器失效
+func (i *Iterator) load(blk, ent int) bool {
+	i.valid = false
+	i.pending = false
+	i.val, i.raw = nil, nil
+	if i.err != nil {
+		return false
+	}
+	if blk < 0 {
+		i.blk = -1
+		return false
+	}
+	if blk >= i.reader.numBlocks {
+		i.blk = i.reader.numBlocks
+		return false
+	}
+	b, err := i.reader.readDataBlock(&i.bs, blk)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	if ent < 0 {
+		ent = b.num - 1
+	}
+	i.blk, i.ent = blk, ent
+	if ent >= b.num {
+		return i.load(blk+1, 0)
+	}
+	key, val, err := b.entry(ent, true)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	// 超出上下界时视为位于两端之外，之后的Next/Prev会重新从边界定位
+	if i.opts.LowerBound != nil && bytes.Compare(key.Key(), i.opts.LowerBound) < 0 {
+		i.blk = -1
+		return false
+	}
+	if i.opts.UpperBound != nil && bytes.Compare(key.Key(), i.opts.UpperBound) >= 0 {
+		i.blk = i.reader.numBlocks
+		return false
+	}
+	key = i.reader.withGlobalSeq(key)
+	if i.mapped {
+		i.key, i.raw = key, val
+	} else {
+		i.key = table.NewInternalKey(copySlice(key.Key()), key.Seq(), key.Kind())
+		i.raw = copySlice(val)
+	}
+	i.val = nil
+	i.resolved = key.Kind() != table.KindBlobIndex
+	if i.resolved {
+		i.val = i.raw
+	}
+	i.valid = true
+	return true
+}
+
+// 按InternalCmp定位到第一个大于等于key的位置，只确定blk和ent，不加载记录
+func (i *Iterator) seek(key table.Key) bool {
+	i.valid = false
+	blk, err := i.reader.searchIndex(&i.bs, key)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	if blk == i.reader.numBlocks {
+		i.blk = blk
+		return true
+	}
+	b, err := i.reader.readDataBlock(&i.bs, blk)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	ent, err := b.search(key)
+	if err != nil {
+		i.err = err
+		return false
+	}
+	i.blk, i.ent = blk, ent
+	return true
+}
+
+// SeekGE 按InternalCmp定位到第一个大于等于key的位置，用table.NewSearchKey定位到一个user key的最新版本
+// 导入的表中保存的不是实际的序列号，只能用table.NewSearchKey定位
+func (i *Iterator) SeekGE(key table.Key) bool {
+	if i.opts.LowerBound != nil && bytes.Compare(key.Key(), i.opts.LowerBound) < 0 {
+		key = table.NewSearchKey(i.opts.LowerBound)
+	}
+	if !i.seek(key) {
+		return false
+	}
+	i.load(i.blk, i.ent)
+	return i.skipForward()
+}
+
+// SeekLT 按InternalCmp定位到最后一个小于key的位置
+func (i *Iterator) SeekLT(key table.Key) bool {
+	if i.opts.UpperBound != nil && bytes.Compare(key.Key(), i.opts.UpperBound) > 0 {
+		key = table.NewSearchKey(i.opts.UpperBound)
+	}
+	if !i.seek(key) {
+		return false
+	}
+	i.prev()
+	return i.skipBackward()
+}
+
+func (i *Iterator) First() bool {
+	if i.opts.LowerBound != nil {
+		return i.SeekGE(table.NewSearchKey(i.opts.LowerBound))
+	}
+	i.load(0, 0)
+	return i.skipForward()
+}
+
+func (i *Iterator) Last() bool {
+	if i.opts.UpperBound != nil {
+		return i.SeekLT(table.NewSearchKey(i.opts.UpperBound))
+	}
+	i.load(i.reader.numBlocks-1, -1)
+	return i.skipBackward()
+}
+
+// Next 移动到下一个元素，位于第一个元素之前时移动到First
+func (i *Iterator) Next() bool {
+	if i.pending {
+		i.pending = false
+		return i.valid
+	}
+	if i.blk < 0 {
+		return i.First()
+	}
+	if i.blk >= i.reader.numBlocks {
+		return false
+	}
+	i.load(i.blk, i.ent+1)
+	return i.skipForward()
+}
+
+// Prev 移动到上一个元素，越过最后一个元素时移动到Last
+func (i *Iterator) Prev() bool {
+	if i.blk >= i.reader.numBlocks {
+		return i.Last()
+	}
+	if i.blk < 0 {
+		return false
+	}
+	i.prev()
+	return i.skipBackward()
+}
+
+// 从(blk, ent)移动到上一条记录，blk可以为numBlocks
+func (i *Iterator) prev() bool {
+	if i.blk >= i.reader.numBlocks || i.ent <= 0 {
+		return i.load(i.blk-1, -1)
+	}
+	return i.load(i.blk, i.ent-1)
+}
+
+// covered 当前记录是否被本表的范围删除标记覆盖，设置了KeepCovered时总是返回false
+func (i *Iterator) covered() bool {
+	return i.valid && !i.opts.KeepCovered && len(i.reader.rangeDels) > 0 && i.reader.rangeDels.Covers(i.key, table.MaxSeq)
+}
+
+// skipForward 向后跳过被覆盖的记录
+func (i *Iterator) skipForward() bool {
+	for i.covered() {
+		i.load(i.blk, i.ent+1)
+	}
+	return i.valid
+}
+
+// skipBackward 向前跳过被覆盖的记录
+func (i *Iterator) skipBackward() bool {
+	for i.covered() {
+		i.prev()
+	}
+	return i.valid
+}
+
+func (i *Iterator) Valid() bool {
+	return i.valid && !i.pending
+}
+
+func (i *Iterator) Key() table.Key {
+	return i.key
+}
+
+// Value 返回当前记录的value，value被分离到blob文件中时在第一次调用时读取
+func (i *Iterator) Value() []byte {
+	if !i.resolved && i.valid {
+		val, err := i.reader.resolveBlob(i.raw)
+		if err != nil {
+			i.err = err
+			return nil
+		}
+		i.val, i.resolved = val, true
+	}
+	return i.val
+}
+
+// RawValue 返回记录中实际保存的数据，对于KindBlobIndex的记录是编码后的blob指针
+func (i *Iterator) RawValue() []byte {
+	return i.raw
+}
+
+func (i *Iterator) Error() error {
+	return i.err
+}
+
+func (i *Iterator) Close() error {
+	i.valid = false
+	i.bs = blockState{}
+	i.key, i.val, i.raw = table.Key{}, nil, nil
+	if i.mapped {
+		i.mapped = false
+		if err := i.reader.sst.unref(); err != nil && i.err == nil {
+			i.err = err
+		}
+	}
+	return i.err
+}
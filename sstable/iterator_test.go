@@ -0,0 +1,140 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/InsZVA/saver/table"
+)
+
+func newTestReader(t *testing.T, path string, n int) (*SSTable, *SSTReader) {
+	list := table.NewSkipList()
+	for i := 0; i < n; i++ {
+		list.Set(table.NewKey([]byte(fmt.Sprintf("%04d", i*2))), []byte(fmt.Sprintf("v%d", i*2)))
+	}
+	sst, err := CreateSSTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sst.FromMemTable(list); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+	sst, err = OpenSSTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sst, reader
+}
+
+func k(i int) table.Key {
+	return table.NewKey([]byte(fmt.Sprintf("%04d", i)))
+}
+
+func expectAt(t *testing.T, it *Iterator, ok bool, i int) {
+	if !ok || !it.Valid() {
+		t.Fatalf("迭代器应该位于%04d, err: %v", i, it.Error())
+	}
+	if !bytes.Equal(it.Key().Key(), k(i).Key()) || !bytes.Equal(it.Value(), []byte(fmt.Sprintf("v%d", i))) {
+		t.Fatalf("迭代器应该位于%04d, 实际位于%s", i, it.Key().Key())
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	sst, reader := newTestReader(t, "/tmp/sst_iter", 1000)
+	defer sst.Close()
+	it := reader.NewIterator(nil)
+	defer it.Close()
+
+	expectAt(t, it, it.First(), 0)
+	expectAt(t, it, it.Last(), 1998)
+	if it.Next() || it.Valid() {
+		t.Error("Last之后还有Next")
+	}
+	expectAt(t, it, it.Prev(), 1998)
+
+	expectAt(t, it, it.SeekGE(k(500)), 500)
+	expectAt(t, it, it.SeekGE(k(501)), 502)
+	expectAt(t, it, it.SeekLT(k(500)), 498)
+	expectAt(t, it, it.SeekLT(k(501)), 500)
+	if it.SeekGE(k(1999)) {
+		t.Error("SeekGE越过末尾")
+	}
+	expectAt(t, it, it.Prev(), 1998)
+	if it.SeekLT(k(0)) {
+		t.Error("SeekLT越过开头")
+	}
+	expectAt(t, it, it.Next(), 0)
+	if it.Prev() {
+		t.Error("First之前还有Prev")
+	}
+
+	// 正向和反向遍历
+	n := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		expectAt(t, it, true, n*2)
+		n++
+	}
+	if n != 1000 || it.Error() != nil {
+		t.Error("正向遍历数量错误", n, it.Error())
+	}
+	for ok := it.Last(); ok; ok = it.Prev() {
+		n--
+		expectAt(t, it, true, n*2)
+	}
+	if n != 0 {
+		t.Error("反向遍历数量错误", n)
+	}
+}
+
+func TestIteratorBounds(t *testing.T) {
+	sst, reader := newTestReader(t, "/tmp/sst_iter_bounds", 100)
+	defer sst.Close()
+	it := reader.NewIterator(&IterOptions{
+		LowerBound: k(11).Key(),
+		UpperBound: k(20).Key(),
+	})
+	defer it.Close()
+
+	expectAt(t, it, it.First(), 12)
+	expectAt(t, it, it.Last(), 18)
+	expectAt(t, it, it.SeekGE(k(0)), 12)
+	expectAt(t, it, it.SeekLT(k(100)), 18)
+	if it.SeekGE(k(19)) {
+		t.Error("SeekGE越过了上界")
+	}
+	expectAt(t, it, it.Prev(), 18)
+	if it.SeekLT(k(12)) {
+		t.Error("SeekLT越过了下界")
+	}
+	expectAt(t, it, it.Next(), 12)
+
+	n := 0
+	for it.First(); it.Valid(); it.Next() {
+		n++
+	}
+	if n != 4 {
+		t.Error("上下界内的元素数量错误", n)
+	}
+
+	// 没有调用定位方法时直接Next
+	it = reader.NewIterator(&IterOptions{LowerBound: k(11).Key()})
+	expectAt(t, it, it.Next(), 12)
+}
+
+func TestIteratorEmpty(t *testing.T) {
+	sst, reader := newTestReader(t, "/tmp/sst_iter_empty", 0)
+	defer sst.Close()
+	it := reader.NewIterator(nil)
+	if it.First() || it.Last() || it.Next() || it.Prev() || it.SeekGE(k(0)) || it.SeekLT(k(0)) {
+		t.Error("空表上的迭代器不应该有效")
+	}
+	if it.Close() != nil {
+		t.Error(it.Error())
+	}
+}
@@ -0,0 +1,318 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sort"
+
+	"github.com/InsZVA/saver/blob"
+	"github.com/InsZVA/saver/table"
+)
+
+const (
+	// CompressionNone 目前数据块不压缩
+	CompressionNone = "none"
+	// BytewiseComparator 按字节序比较key
+	BytewiseComparator = "saver.BytewiseComparator"
+)
+
+// Properties SSTable的统计信息，在写入时生成，保存在properties block中
+type Properties struct {
+	// 记录数，包括删除标记
+	NumEntries   uint64
+	NumDeletions uint64
+	// 切分后的范围删除标记数
+	NumRangeDeletions uint64
+	// key（包括trailer）和value的原始总长度
+	RawKeySize   uint64
+	RawValueSize uint64
+	// 所有data block、index block（包括顶层索引和所有index partition）以及filter block的大小
+	DataSize   uint64
+	IndexSize  uint64
+	FilterSize uint64
+	// index partition的数量
+	IndexPartitions uint64
+	// 表中最小和最大的key，NumEntries为0时没有意义
+	SmallestKey table.Key
+	LargestKey  table.Key
+	MinSeq      uint64
+	MaxSeq      uint64
+	// 不为0时表中所有记录的序列号都视为GlobalSeq，导入外部文件时通过SetGlobalSeq设置
+	GlobalSeq uint64
+	// 创建时间，unix秒
+	CreationTime    int64
+	CompressionType string
+	ComparatorName  string
+	// 表中的blob指针引用的每个blob文件，以及引用的value总长度，没有blob指针时为nil
+	BlobRefs map[uint64]uint64
+}
+
+/*
+properties block使用block的格式，key为属性名，按名字排序:
+[saver.blob.refs][fileNum64, length64]... 只在有blob指针时写入
+[saver.comparator][name]
+[saver.compression][name]
+[saver.creation.time][unix64]
+...
+*/
+const (
+	propBlobRefs     = "saver.blob.refs"
+	propComparator   = "saver.comparator"
+	propCompression  = "saver.compression"
+	propCreationTime = "saver.creation.time"
+	propDataSize     = "saver.data.size"
+	propFilterSize   = "saver.filter.size"
+	propGlobalSeq    = "saver.global.seqno"
+	propIndexParts   = "saver.index.partitions"
+	propIndexSize    = "saver.index.size"
+	propLargestKey   = "saver.largest.key"
+	propMaxSeq       = "saver.max.seq"
+	propMinSeq       = "saver.min.seq"
+	propNumDeletions = "saver.num.deletions"
+	propNumEntries   = "saver.num.entries"
+	propNumRangeDels = "saver.num.range.deletions"
+	propRawKeySize   = "saver.raw.key.size"
+	propRawValueSize = "saver.raw.value.size"
+	propSmallestKey  = "saver.smallest.key"
+)
+
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
+
+func keyBytes(key table.Key) []byte {
+	b := make([]byte, len(key.Key())+trailerSize)
+	copy(b, key.Key())
+	binary.LittleEndian.PutUint64(b[len(key.Key()):], packTrailer(key))
+	return b
+}
+
+func (p *Properties) encode() []byte {
+	props := map[string][]byte{
+		propComparator:   []byte(p.ComparatorName),
+		propCompression:  []byte(p.CompressionType),
+		propCreationTime: uint64Bytes(uint64(p.CreationTime)),
+		propDataSize:     uint64Bytes(p.DataSize),
+		propFilterSize:   uint64Bytes(p.FilterSize),
+		propGlobalSeq:    uint64Bytes(p.GlobalSeq),
+		propIndexParts:   uint64Bytes(p.IndexPartitions),
+		propIndexSize:    uint64Bytes(p.IndexSize),
+		propLargestKey:   keyBytes(p.LargestKey),
+		propMaxSeq:       uint64Bytes(p.MaxSeq),
+		propMinSeq:       uint64Bytes(p.MinSeq),
+		propNumDeletions: uint64Bytes(p.NumDeletions),
+		propNumEntries:   uint64Bytes(p.NumEntries),
+		propNumRangeDels: uint64Bytes(p.NumRangeDeletions),
+		propRawKeySize:   uint64Bytes(p.RawKeySize),
+		propRawValueSize: uint64Bytes(p.RawValueSize),
+		propSmallestKey:  keyBytes(p.SmallestKey),
+	}
+	if len(p.BlobRefs) > 0 {
+		props[propBlobRefs] = encodeBlobRefs(p.BlobRefs)
+	}
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var bb blockBuilder
+	for _, name := range names {
+		bb.add(table.NewKey([]byte(name)), props[name])
+	}
+	return bb.finish()
+}
+
+// encodeBlobRefs 按blob文件编号排列
+func encodeBlobRefs(refs map[uint64]uint64) []byte {
+	nums := make([]uint64, 0, len(refs))
+	for num := range refs {
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool {
+		return nums[i] < nums[j]
+	})
+	b := make([]byte, 0, 16*len(nums))
+	for _, num := range nums {
+		b = append(b, uint64Bytes(num)...)
+		b = append(b, uint64Bytes(refs[num])...)
+	}
+	return b
+}
+
+// 只有key、字符串和blob引用的长度会影响properties block的大小
+var emptyPropertiesSize = len((&Properties{}).encode())
+
+func (p *Properties) encodedSize() int {
+	size := emptyPropertiesSize + len(p.SmallestKey.Key()) + len(p.LargestKey.Key()) +
+		len(p.CompressionType) + len(p.ComparatorName)
+	if len(p.BlobRefs) > 0 {
+		size += entrySize(table.NewKey([]byte(propBlobRefs)), nil) + 16*len(p.BlobRefs)
+	}
+	return size
+}
+
+func decodeProperties(data []byte) (*Properties, error) {
+	b, err := newBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	p := &Properties{}
+	for i := 0; i < b.num; i++ {
+		name, val, err := b.entry(i, true)
+		if err != nil {
+			return nil, err
+		}
+		var u *uint64
+		switch string(name.Key()) {
+		case propComparator:
+			p.ComparatorName = string(val)
+		case propCompression:
+			p.CompressionType = string(val)
+		case propBlobRefs:
+			if len(val) == 0 || len(val)%16 != 0 {
+				return nil, brokenFileErr
+			}
+			p.BlobRefs = make(map[uint64]uint64)
+			for ; len(val) > 0; val = val[16:] {
+				p.BlobRefs[binary.LittleEndian.Uint64(val)] += binary.LittleEndian.Uint64(val[8:])
+			}
+		case propLargestKey:
+			p.LargestKey, err = unpackKey(copySlice(val))
+		case propSmallestKey:
+			p.SmallestKey, err = unpackKey(copySlice(val))
+		case propCreationTime:
+			if len(val) != 8 {
+				return nil, brokenFileErr
+			}
+			p.CreationTime = int64(binary.LittleEndian.Uint64(val))
+		case propDataSize:
+			u = &p.DataSize
+		case propIndexSize:
+			u = &p.IndexSize
+		case propFilterSize:
+			u = &p.FilterSize
+		case propGlobalSeq:
+			u = &p.GlobalSeq
+		case propIndexParts:
+			u = &p.IndexPartitions
+		case propMaxSeq:
+			u = &p.MaxSeq
+		case propMinSeq:
+			u = &p.MinSeq
+		case propNumDeletions:
+			u = &p.NumDeletions
+		case propNumEntries:
+			u = &p.NumEntries
+		case propNumRangeDels:
+			u = &p.NumRangeDeletions
+		case propRawKeySize:
+			u = &p.RawKeySize
+		case propRawValueSize:
+			u = &p.RawValueSize
+		}
+		// 不认识的属性直接忽略
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			if len(val) != 8 {
+				return nil, brokenFileErr
+			}
+			*u = binary.LittleEndian.Uint64(val)
+		}
+	}
+	return p, nil
+}
+
+// update 写入一条记录时更新统计信息
+func (p *Properties) update(key table.Key, val []byte) {
+	if p.NumEntries == 0 {
+		p.SmallestKey = table.NewInternalKey(copySlice(key.Key()), key.Seq(), key.Kind())
+		p.MinSeq, p.MaxSeq = key.Seq(), key.Seq()
+	}
+	if key.Seq() < p.MinSeq {
+		p.MinSeq = key.Seq()
+	}
+	if key.Seq() > p.MaxSeq {
+		p.MaxSeq = key.Seq()
+	}
+	p.NumEntries++
+	if key.Kind() == table.KindDelete {
+		p.NumDeletions++
+	}
+	p.RawKeySize += uint64(len(key.Key()) + trailerSize)
+	p.RawValueSize += uint64(len(val))
+}
+
+// addBlobRef 写入一个blob指针时记录它引用的blob文件
+func (p *Properties) addBlobRef(ptr blob.Pointer) {
+	if p.BlobRefs == nil {
+		p.BlobRefs = make(map[uint64]uint64)
+	}
+	p.BlobRefs[ptr.FileNum] += ptr.Length
+}
+
+var (
+	errNoGlobalSeq = errors.New("SSTable中没有全局序列号属性")
+	errSeqTooLarge = errors.New("序列号超过了MaxSeq")
+)
+
+// SetGlobalSeq 修改文件中的全局序列号，属性的长度固定，直接覆盖写入，不需要重写整个文件
+func SetGlobalSeq(path string, seq uint64) error {
+	if seq > table.MaxSeq {
+		return errSeqTooLarge
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < footerSize {
+		return brokenFileErr
+	}
+	footer := make([]byte, footerSize)
+	if err = readFull(file, footer, info.Size()-footerSize); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(footer[3*blockHandleSize:]) != tableMagic {
+		return brokenFileErr
+	}
+	h := decodeBlockHandle(footer[blockHandleSize:])
+	if h.offset+h.length > uint64(info.Size()-footerSize) {
+		return brokenFileErr
+	}
+	data := make([]byte, h.length)
+	if err = readFull(file, data, int64(h.offset)); err != nil {
+		return err
+	}
+	b, err := newBlock(data)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < b.num; i++ {
+		name, val, err := b.entry(i, true)
+		if err != nil {
+			return err
+		}
+		if string(name.Key()) != propGlobalSeq {
+			continue
+		}
+		if len(val) != 8 {
+			return brokenFileErr
+		}
+		// val引用data中的数据，据此算出它在文件中的位置
+		off := int64(h.offset) + int64(cap(data)-cap(val))
+		if _, err = file.WriteAt(uint64Bytes(seq), off); err != nil {
+			return err
+		}
+		return file.Sync()
+	}
+	return errNoGlobalSeq
+}
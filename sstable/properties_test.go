@@ -0,0 +1,148 @@
+package sstable
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/InsZVA/saver/table"
+)
+
+func TestProperties(t *testing.T) {
+	start := time.Now().Unix()
+	sst, err := CreateSSTable("/tmp/sst_props")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := sst.NewWriter()
+	entries := []struct {
+		key  string
+		seq  uint64
+		kind table.Kind
+		val  string
+	}{
+		{"a", 5, table.KindSet, "1"},
+		{"bb", 3, table.KindDelete, ""},
+		{"c", 9, table.KindSet, "333"},
+		{"dddd", 7, table.KindDelete, ""},
+		{"e", 4, table.KindSet, "55555"},
+	}
+	for _, e := range entries {
+		if err = writer.Write(table.NewInternalKey([]byte(e.key), e.seq, e.kind), []byte(e.val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.Done(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	sst, err = OpenSSTable("/tmp/sst_props")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := reader.Properties()
+	if props.NumEntries != 5 || props.NumDeletions != 2 {
+		t.Error("记录数错误", props.NumEntries, props.NumDeletions)
+	}
+	if props.RawKeySize != 9+5*trailerSize || props.RawValueSize != 9 {
+		t.Error("原始大小错误", props.RawKeySize, props.RawValueSize)
+	}
+	if props.MinSeq != 3 || props.MaxSeq != 9 {
+		t.Error("序列号范围错误", props.MinSeq, props.MaxSeq)
+	}
+	if !bytes.Equal(props.SmallestKey.Key(), []byte("a")) || props.SmallestKey.Seq() != 5 ||
+		!bytes.Equal(props.LargestKey.Key(), []byte("e")) || props.LargestKey.Seq() != 4 {
+		t.Error("最小最大key错误", props.SmallestKey, props.LargestKey)
+	}
+	if props.DataSize == 0 || props.IndexSize == 0 || props.DataSize+props.IndexSize >= uint64(sst.file.Size()) {
+		t.Error("数据大小错误", props.DataSize, props.IndexSize)
+	}
+	if props.CreationTime < start || props.CreationTime > time.Now().Unix() {
+		t.Error("创建时间错误", props.CreationTime)
+	}
+	if props.CompressionType != CompressionNone || props.ComparatorName != BytewiseComparator {
+		t.Error("压缩类型或比较器错误", props.CompressionType, props.ComparatorName)
+	}
+	// 返回的是副本，修改不影响reader
+	props.NumEntries = 0
+	if reader.Properties().NumEntries != 5 {
+		t.Error("Properties被外部修改")
+	}
+}
+
+func TestPropertiesEmpty(t *testing.T) {
+	sst, reader := newTestReader(t, "/tmp/sst_props_empty", 0)
+	defer sst.Close()
+	props := reader.Properties()
+	if props.NumEntries != 0 || props.DataSize != 0 || props.ComparatorName != BytewiseComparator {
+		t.Error("空表的统计信息错误", props)
+	}
+}
+
+func TestSetGlobalSeq(t *testing.T) {
+	sst, err := CreateSSTable("/tmp/sst_global_seq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := sst.NewWriter()
+	writer.Write(table.NewInternalKey([]byte("a"), 1, table.KindSet), []byte("1"))
+	writer.Write(table.NewInternalKey([]byte("b"), 2, table.KindDelete), nil)
+	writer.AddRangeTombstone(table.RangeTombstone{Start: []byte("x"), End: []byte("z"), Seq: 3})
+	if err = writer.Done(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+	if err = SetGlobalSeq("/tmp/sst_global_seq", table.MaxSeq+1); err != errSeqTooLarge {
+		t.Error("序列号过大时应该返回错误", err)
+	}
+	if err = SetGlobalSeq("/tmp/sst_global_seq", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	sst, err = OpenSSTable("/tmp/sst_global_seq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.Properties().GlobalSeq != 100 || reader.Properties().NumEntries != 2 {
+		t.Error("全局序列号错误", reader.Properties())
+	}
+	k, val, ok, err := reader.Lookup(table.NewSearchKey([]byte("a")))
+	if err != nil || !ok || k.Seq() != 100 || k.Kind() != table.KindSet || string(val) != "1" {
+		t.Error("Lookup错误", k, string(val), ok, err)
+	}
+	k, _, ok, err = reader.Lookup(table.NewSearchKey([]byte("b")))
+	if err != nil || !ok || k.Seq() != 100 || k.Kind() != table.KindDelete {
+		t.Error("Lookup应该返回删除标记", k, ok, err)
+	}
+	if _, _, ok, _ = reader.Lookup(table.NewSearchKey([]byte("c"))); ok {
+		t.Error("不存在的key")
+	}
+	if _, _, ok, _ = reader.Lookup(table.NewInternalKey([]byte("a"), 99, table.KindSet)); ok {
+		t.Error("全局序列号大于查找的序列号时不可见")
+	}
+	it := reader.NewIterator(nil)
+	for it.First(); it.Valid(); it.Next() {
+		if it.Key().Seq() != 100 {
+			t.Error("迭代器返回的序列号错误", it.Key().Seq())
+		}
+	}
+	it.Close()
+	if rd := reader.RangeTombstones(); len(rd) != 1 || rd[0].Seq != 100 {
+		t.Error("范围删除标记的序列号错误", rd)
+	}
+
+	if err = SetGlobalSeq("/tmp/sst_global_seq_not_exist", 1); err == nil {
+		t.Error("不存在的文件应该返回错误")
+	}
+}
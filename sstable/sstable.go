@@ -1,13 +1,18 @@
 package sstable
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
-	"log"
+	"math"
 	"os"
 	"sort"
+	"sync"
+	"time"
 
+	"github.com/InsZVA/saver/blob"
+	"github.com/InsZVA/saver/cache"
 	"github.com/InsZVA/saver/table"
 )
 
@@ -18,6 +23,7 @@ type SeqFile interface {
 	io.WriterAt
 	io.Seeker
 	Size() int64
+	Sync() error
 }
 
 type BaseFile struct {
@@ -31,11 +37,51 @@ var (
 
 const (
 	blockSize = 64 * 1024
-	l0MaxSize = 128 * 1024 * 1024
+	// 默认的index partition大小
+	defaultIndexPartitionSize = 4 * 1024
 )
 
+// Options 打开SSTable时的选项
+type Options struct {
+	// 多个SSTable共享的块缓存，为nil时每个reader只缓存最近读取的一个块
+	Cache *cache.Cache
+	// 文件编号，作为块缓存的键，在同一个Cache中必须唯一，并且不能被其他文件重复使用
+	FileNum uint64
+	// 用于读取分离到blob文件中的value
+	Blobs *blob.Reader
+	// 只读映射整个文件，读取时不再复制，映射的文件不使用块缓存
+	// 迭代器返回的切片直接引用映射的内存，只在迭代器Close之前有效
+	Mmap bool
+	// Get判断KindSetWithTTL记录是否过期时使用的时钟，为nil时使用time.Now
+	Now func() time.Time
+}
+
+// WriterOptions 写入SSTable时的选项
+type WriterOptions struct {
+	// 不为nil时，长度大于等于BlobThreshold的value写入blob文件，SSTable中只保存指针
+	BlobWriter    *blob.Writer
+	BlobThreshold int
+	// index partition达到这个大小时落盘，为0时使用defaultIndexPartitionSize
+	IndexPartitionSize int
+	// 布隆过滤器中每个key占用的位数，为0时不生成filter block
+	FilterBitsPerKey int
+	// 在每个data block中生成hash索引，点查询时不需要在块内二分查找
+	BlockHashIndex bool
+	// data block的目标大小，为0时使用blockSize
+	BlockSize int
+}
+
 type SSTable struct {
 	file SeqFile
+	opts Options
+	// 设置了Mmap时为映射的文件内容
+	mapped []byte
+	// 引用映射内存的迭代器数，Close之后最后一个迭代器关闭时才解除映射
+	mu     sync.Mutex
+	refs   int
+	closed bool
+	// reader在块缓存中固定的块的偏移，Close时取消固定
+	pinned []uint64
 }
 
 func CreateSSTable(filepath string) (*SSTable, error) {
@@ -56,6 +102,10 @@ func CreateSSTable(filepath string) (*SSTable, error) {
 }
 
 func OpenSSTable(filepath string) (*SSTable, error) {
+	return OpenSSTableWithOptions(filepath, nil)
+}
+
+func OpenSSTableWithOptions(filepath string, opts *Options) (*SSTable, error) {
 	file, err := os.Open(filepath)
 	if err != nil {
 		return nil, err
@@ -67,230 +117,771 @@ func OpenSSTable(filepath string) (*SSTable, error) {
 	bf := BaseFile{}
 	bf.File = file
 	bf.FileInfo = fileInfo
-	return &SSTable{
+	sst := &SSTable{
 		file: bf,
-	}, nil
+	}
+	if opts != nil {
+		sst.opts = *opts
+	}
+	if sst.opts.Mmap && fileInfo.Size() > 0 {
+		if sst.mapped, err = mmapFile(file, fileInfo.Size()); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return sst, nil
 }
 
+// Sync 把写入的内容同步到磁盘
+func (sst *SSTable) Sync() error {
+	return sst.file.Sync()
+}
+
+// Close 关闭文件，还有迭代器或者查找引用映射的内存时，在最后一个引用释放之后才解除映射
+// 块缓存中的块在关闭之后仍然保留，固定的块取消固定
 func (sst *SSTable) Close() error {
+	sst.mu.Lock()
+	sst.closed = true
+	mapped := sst.takeMapped()
+	pinned := sst.pinned
+	sst.pinned = nil
+	sst.mu.Unlock()
+	for _, offset := range pinned {
+		sst.opts.Cache.Unpin(sst.opts.FileNum, offset)
+	}
+	if err := unmap(mapped); err != nil {
+		sst.file.Close()
+		return err
+	}
 	return sst.file.Close()
 }
 
+// ref 增加对映射内存的引用，引用期间不会解除映射，文件没有被映射或者已经解除映射时返回false
+func (sst *SSTable) ref() bool {
+	sst.mu.Lock()
+	defer sst.mu.Unlock()
+	if sst.mapped == nil {
+		return false
+	}
+	sst.refs++
+	return true
+}
+
+// unref 释放对映射内存的引用，已经Close并且没有其他引用时解除映射
+func (sst *SSTable) unref() error {
+	sst.mu.Lock()
+	sst.refs--
+	mapped := sst.takeMapped()
+	sst.mu.Unlock()
+	return unmap(mapped)
+}
+
+// takeMapped 已经Close并且没有引用时取出映射的内存，之后由调用方解除映射，调用时必须持有sst.mu
+func (sst *SSTable) takeMapped() []byte {
+	if !sst.closed || sst.refs > 0 {
+		return nil
+	}
+	b := sst.mapped
+	sst.mapped = nil
+	return b
+}
+
+func unmap(b []byte) error {
+	if b == nil {
+		return nil
+	}
+	return munmap(b)
+}
+
+// key之后紧跟8字节的trailer：seq<<8|kind
+const trailerSize = 8
+
+func packTrailer(key table.Key) uint64 {
+	return key.Seq()<<8 | uint64(key.Kind())
+}
+
+func unpackKey(b []byte) (table.Key, error) {
+	if len(b) < trailerSize {
+		return table.Key{}, brokenFileErr
+	}
+	n := len(b) - trailerSize
+	trailer := binary.LittleEndian.Uint64(b[n:])
+	return table.NewInternalKey(b[:n], trailer>>8, table.Kind(trailer&0xff)), nil
+}
+
 /*
-[KeyLength32, keyValue...]
-[ValLength32, valValue...] blockSize对齐
-[KeyLength32, keyValue...]
-[ValLength32, valValue...]
-...
-[keyIdx, keyIdx, keyIdx..] block的第一个Key，idx为block的idx，key直接32KB-8字节
-[metalength64..]
-...
+SSTable文件:
+[data block][data block]...  每个块不超过WriterOptions.BlockSize，格式见block，超过的大记录独占一个块
+[index partition]            每个data block一项，key为块内最后一个key，value为块的[offset64][length64]
+[filter block]               index partition中所有key的布隆过滤器，见filter.go，没有设置FilterBitsPerKey时为空
+[data block]...              index partition达到IndexPartitionSize时与filter block一起落盘，之后继续写data block
+[index block]                顶层索引，每个index partition一项，key为partition中最后一个key，value见topIndexValueSize
+[properties block]           统计信息，见Properties
+[range-del block]            切分后的范围删除标记，key为Start（trailer中为Seq和KindRangeDelete），value为End
+[footer]                     index block、properties block、range-del block的[offset64][length64]，以及[magic64]
 */
+const (
+	footerSize = 3*blockHandleSize + 8
+	tableMagic = 0x7473737265766173 // "saversst"
+)
+
+var (
+	errEntryTooLarge = errors.New("key或者value的长度超过了4GB，无法写入")
+	errKeyOrder      = errors.New("写入的key必须按InternalCmp严格递增")
+	errNoBlobReader  = errors.New("没有设置Blobs，无法读取分离的value")
+	errEmptyRange    = errors.New("范围删除标记的Start必须小于End")
+)
+
+// 顶层索引中每一项的value：[partition handle][filter handle][end64]，end为下一个partition的第一个data block的编号
+const topIndexValueSize = 2*blockHandleSize + 8
+
+// Writer 流式写入SSTable，每个块写满时立即落盘并记录一条索引
+// 内存中只保留当前块、当前的index partition以及每个partition一条的顶层索引
 type Writer struct {
-	sst     *SSTable
-	md      []uint64
-	idx     uint64
-	buff    [blockSize]byte
+	sst       *SSTable
+	opts      WriterOptions
+	block     blockBuilder
+	partition blockBuilder
+	index     blockBuilder
+	// 当前partition中所有key的hash，用于生成filter block
+	hashes []uint32
+	// 已经落盘的data block数
+	numBlocks uint64
+	// 当前块的最后一个key，用作索引
+	lastKey table.Key
 	written uint64
+	props   Properties
+	// 范围删除标记在Done时切分并写入range-del block
+	rangeDels []table.RangeTombstone
 }
 
 func (sst *SSTable) NewWriter() *Writer {
+	return sst.NewWriterWithOptions(nil)
+}
+
+func (sst *SSTable) NewWriterWithOptions(opts *WriterOptions) *Writer {
 	sst.file.Seek(0, io.SeekStart)
-	return &Writer{
+	writer := &Writer{
 		sst: sst,
-		md:  make([]uint64, 0),
 	}
+	if opts != nil {
+		writer.opts = *opts
+	}
+	if writer.opts.IndexPartitionSize <= 0 {
+		writer.opts.IndexPartitionSize = defaultIndexPartitionSize
+	}
+	if writer.opts.BlockSize <= 0 {
+		writer.opts.BlockSize = blockSize
+	}
+	writer.block.buf = make([]byte, 0, writer.opts.BlockSize)
+	writer.block.hashIndex = writer.opts.BlockHashIndex
+	return writer
 }
 
+// Flush 结束当前块并落盘
 func (writer *Writer) Flush() error {
-	_, err := writer.sst.file.Write(writer.buff[:])
+	if writer.block.empty() {
+		return nil
+	}
+	h, err := writer.writeBlock(writer.block.finish())
+	if err != nil {
+		return err
+	}
+	var handle [blockHandleSize]byte
+	h.encode(handle[:])
+	writer.partition.add(writer.lastKey, handle[:])
+	writer.numBlocks++
+	writer.props.DataSize += h.length
+	writer.block.reset()
+	if cap(writer.block.buf) > writer.opts.BlockSize {
+		// 不保留大记录占用的内存
+		writer.block.buf = make([]byte, 0, writer.opts.BlockSize)
+	}
+	if writer.partition.estimatedSize() >= writer.opts.IndexPartitionSize {
+		return writer.finishPartition()
+	}
+	return nil
+}
+
+// finishPartition 当前的index partition以及对应的filter block落盘，并记录一条顶层索引
+func (writer *Writer) finishPartition() error {
+	if writer.partition.empty() {
+		return nil
+	}
+	h, err := writer.writeBlock(writer.partition.finish())
+	if err != nil {
+		return err
+	}
+	writer.props.IndexSize += h.length
+	writer.props.IndexPartitions++
+	var filter []byte
+	if writer.opts.FilterBitsPerKey > 0 {
+		filter = buildFilter(writer.hashes, writer.opts.FilterBitsPerKey)
+	}
+	fh, err := writer.writeBlock(filter)
 	if err != nil {
 		return err
 	}
-	writer.written += blockSize
-	writer.idx = 0
+	writer.props.FilterSize += fh.length
+	var val [topIndexValueSize]byte
+	h.encode(val[:])
+	fh.encode(val[blockHandleSize:])
+	binary.LittleEndian.PutUint64(val[2*blockHandleSize:], writer.numBlocks)
+	writer.index.add(writer.lastKey, val[:])
+	writer.partition.reset()
+	writer.hashes = writer.hashes[:0]
 	return nil
 }
 
+func (writer *Writer) writeBlock(data []byte) (blockHandle, error) {
+	h := blockHandle{writer.written, uint64(len(data))}
+	if _, err := writer.sst.file.Write(data); err != nil {
+		return h, err
+	}
+	writer.written += h.length
+	return h, nil
+}
+
+// checkEntry 长度使用32位编码，超过的记录无法表示
+func checkEntry(keyLength, valLength uint64) error {
+	if keyLength+trailerSize > math.MaxUint32 || valLength > math.MaxUint32 {
+		return errEntryTooLarge
+	}
+	return nil
+}
+
+// Write 写入一条记录，放不进一个块的大记录会独占一个超过BlockSize的块
+// 记录按table.Key.InternalCmp排列，同一个user key可以写入多个版本，新的版本在前
 func (writer *Writer) Write(key table.Key, val []byte) error {
-	if int(writer.idx)+len(key.Key())+len(val) >= blockSize {
+	if err := checkEntry(uint64(len(key.Key())), uint64(len(val))); err != nil {
+		return err
+	}
+	if writer.props.NumEntries > 0 && key.InternalCmp(writer.lastKey) <= 0 {
+		return errKeyOrder
+	}
+	// 同一个user key的多个版本在filter中只记录一次，落在新的partition中时需要重新记录
+	newKey := writer.props.NumEntries == 0 || !bytes.Equal(key.Key(), writer.lastKey.Key())
+	writer.props.update(key, val)
+	if writer.opts.BlobWriter != nil && key.Kind() == table.KindSet && len(val) >= writer.opts.BlobThreshold {
+		p, err := writer.opts.BlobWriter.Add(key.Key(), val)
+		if err != nil {
+			return err
+		}
+		key = table.NewInternalKey(key.Key(), key.Seq(), table.KindBlobIndex)
+		val = p.Encode()
+	}
+	// 新分离的value以及从其他表中原样复制的指针都记录到BlobRefs中
+	if key.Kind() == table.KindBlobIndex {
+		p, err := blob.DecodePointer(val)
+		if err != nil {
+			return err
+		}
+		writer.props.addBlobRef(p)
+	}
+	if writer.block.estimatedSize()+entrySize(key, val) > writer.opts.BlockSize {
 		if err := writer.Flush(); err != nil {
 			return err
 		}
 	}
-	writer.md = append(writer.md, writer.written+writer.idx)
-	binary.LittleEndian.PutUint32(writer.buff[writer.idx:], uint32(len(key.Key())))
-	writer.idx += 4
-	writer.idx += uint64(copy(writer.buff[writer.idx:], key.Key()))
-	binary.LittleEndian.PutUint32(writer.buff[writer.idx:], uint32(len(val)))
-	writer.idx += 4
-	writer.idx += uint64(copy(writer.buff[writer.idx:], val))
+	// 必须在Flush之后记录，Flush可能结束当前的partition
+	if writer.opts.FilterBitsPerKey > 0 && (newKey || len(writer.hashes) == 0) {
+		writer.hashes = append(writer.hashes, hashKey(key.Key()))
+	}
+	writer.block.add(key, val)
+	writer.lastKey = table.NewInternalKey(copySlice(key.Key()), key.Seq(), key.Kind())
+	if writer.block.estimatedSize() > writer.opts.BlockSize {
+		return writer.Flush()
+	}
 	return nil
 }
 
-func (writer *Writer) Done() error {
-	metaLength := uint64(len(writer.md)*8 + 8)
-	if writer.idx+metaLength >= blockSize {
-		if err := writer.Flush(); err != nil {
-			return err
+// AddRangeTombstone 写入一个范围删除标记，与Write的顺序无关
+func (writer *Writer) AddRangeTombstone(t table.RangeTombstone) error {
+	if bytes.Compare(t.Start, t.End) >= 0 {
+		return errEmptyRange
+	}
+	if err := checkEntry(uint64(len(t.Start)), uint64(len(t.End))); err != nil {
+		return err
+	}
+	writer.rangeDels = append(writer.rangeDels, table.RangeTombstone{
+		Start: copySlice(t.Start),
+		End:   copySlice(t.End),
+		Seq:   t.Seq,
+	})
+	return nil
+}
+
+// EstimatedSize 如果现在调用Done，文件大概的大小
+// 范围删除标记按切分之前计算，互相重叠时实际会更大
+func (writer *Writer) EstimatedSize() uint64 {
+	props := Properties{
+		SmallestKey:     writer.props.SmallestKey,
+		LargestKey:      writer.lastKey,
+		CompressionType: CompressionNone,
+		ComparatorName:  BytewiseComparator,
+		BlobRefs:        writer.props.BlobRefs,
+	}
+	size := writer.written + uint64(props.encodedSize()) + footerSize
+	index, partition := writer.index.estimatedSize(), writer.partition.estimatedSize()
+	if !writer.block.empty() {
+		// 当前块以及它将要产生的索引项
+		size += uint64(writer.block.estimatedSize())
+		partition += entrySize(writer.lastKey, nil) + blockHandleSize
+	}
+	if !writer.block.empty() || !writer.partition.empty() {
+		// 当前的partition、filter block以及它们将要产生的顶层索引项
+		size += uint64(partition)
+		if writer.opts.FilterBitsPerKey > 0 {
+			size += uint64(filterSize(len(writer.hashes), writer.opts.FilterBitsPerKey))
 		}
+		index += entrySize(writer.lastKey, nil) + topIndexValueSize
+	}
+	size += uint64(index)
+	// range-del block
+	size += 4
+	for _, t := range writer.rangeDels {
+		size += uint64(entrySize(table.NewKey(t.Start), t.End))
+	}
+	return size
+}
+
+// NumEntries 已经写入的记录数
+func (writer *Writer) NumEntries() int {
+	return int(writer.props.NumEntries)
+}
+
+func (writer *Writer) Done() error {
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := writer.finishPartition(); err != nil {
+		return err
+	}
+	indexHandle, err := writer.writeBlock(writer.index.finish())
+	if err != nil {
+		return err
+	}
+	writer.props.IndexSize += indexHandle.length
+	writer.props.LargestKey = writer.lastKey
+	writer.props.CreationTime = time.Now().Unix()
+	writer.props.CompressionType = CompressionNone
+	writer.props.ComparatorName = BytewiseComparator
+	frags := table.FragmentRangeTombstones(writer.rangeDels)
+	writer.props.NumRangeDeletions = uint64(len(frags))
+	propsHandle, err := writer.writeBlock(writer.props.encode())
+	if err != nil {
+		return err
 	}
-	// 写入metadata
-	writer.idx = blockSize - metaLength
-	for _, offset := range writer.md {
-		binary.LittleEndian.PutUint64(writer.buff[writer.idx:], offset)
-		writer.idx += 8
+	var rangeDel blockBuilder
+	for _, t := range frags {
+		rangeDel.add(table.NewInternalKey(t.Start, t.Seq, table.KindRangeDelete), t.End)
 	}
-	// 写入metadata长度
-	binary.LittleEndian.PutUint64(writer.buff[blockSize-8:], uint64(len(writer.md)*8)+8)
-	_, err := writer.sst.file.Write(writer.buff[:])
+	rangeDelHandle, err := writer.writeBlock(rangeDel.finish())
 	if err != nil {
 		return err
 	}
+	// 写入footer
+	var footer [footerSize]byte
+	indexHandle.encode(footer[:])
+	propsHandle.encode(footer[blockHandleSize:])
+	rangeDelHandle.encode(footer[2*blockHandleSize:])
+	binary.LittleEndian.PutUint64(footer[3*blockHandleSize:], tableMagic)
+	if _, err := writer.sst.file.Write(footer[:]); err != nil {
+		return err
+	}
+	writer.written += footerSize
 	return nil
 }
 
-// 从一个内存表直接写入SSTable（L0）
+// 从一个内存表直接写入SSTable（L0），每个key只写入最新的版本
+// 被内存表中的范围删除标记覆盖的记录直接丢弃，范围删除标记本身保留，用于遮盖更老的SSTable
 func (sst *SSTable) FromMemTable(list *table.SkipList) error {
-	writer := sst.NewWriter()
+	return sst.FromMemTableWithOptions(list, nil)
+}
+
+func (sst *SSTable) FromMemTableWithOptions(list *table.SkipList, opts *WriterOptions) error {
+	writer := sst.NewWriterWithOptions(opts)
+	rangeDels := list.RangeTombstones()
 	for p := list.First().Next(); p != list.End(); p = p.Next() {
+		// 同一个key的版本从新到旧排列，更老的版本被最新的版本遮盖
+		if p.Prev() != list.First() && p.Prev().Key().Cmp(p.Key()) == 0 {
+			continue
+		}
+		if rangeDels.Covers(p.Key(), table.MaxSeq) {
+			continue
+		}
 		if err := writer.Write(p.Key(), p.Val()); err != nil {
 			return err
 		}
 	}
+	for _, t := range rangeDels {
+		if err := writer.AddRangeTombstone(t); err != nil {
+			return err
+		}
+	}
 	return writer.Done()
 }
 
+// SSTReader 可以被多个goroutine同时使用，读取过程中的块状态保存在各自的blockState中
 type SSTReader struct {
-	sst  *SSTable
-	buff [blockSize]byte
-	// buff的开始位置和长度
-	start, length uint64
-	meta          MetaData
+	sst *SSTable
+	// 顶层索引，常驻内存，index partition和filter block按需通过块缓存读取
+	index      *block
+	partitions []partition
+	numBlocks  int
+	props      *Properties
+	rangeDels  table.RangeTombstones
 }
 
-func (reader *SSTReader) ReadAt(data []byte, offset int64) (int, error) {
-	//log.Printf("ReadAt: offset %d, reader.start: %d, reader.length: %d\n", offset, reader.start, reader.length)
-	if reader.start <= uint64(offset) && uint64(offset)+uint64(len(data)) <= reader.start+reader.length {
-		return copy(data, reader.buff[offset-int64(reader.start):int(offset)-int(reader.start)+len(data)]), nil
+// partition 顶层索引中的一项
+type partition struct {
+	index  blockHandle
+	filter blockHandle
+	// 下一个partition的第一个data block的编号
+	end int
+}
+
+func (reader *SSTReader) readIndex() error {
+	size := reader.sst.file.Size()
+	if size < footerSize {
+		return brokenFileErr
+	}
+	footer := make([]byte, footerSize)
+	if err := readFull(reader.sst.file, footer, size-footerSize); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(footer[3*blockHandleSize:]) != tableMagic {
+		return brokenFileErr
+	}
+	h := decodeBlockHandle(footer)
+	propsHandle := decodeBlockHandle(footer[blockHandleSize:])
+	rangeDelHandle := decodeBlockHandle(footer[2*blockHandleSize:])
+	for _, bh := range []blockHandle{h, propsHandle, rangeDelHandle} {
+		if bh.offset+bh.length > uint64(size-footerSize) {
+			return brokenFileErr
+		}
+	}
+	propsData := make([]byte, propsHandle.length)
+	if err := readFull(reader.sst.file, propsData, int64(propsHandle.offset)); err != nil {
+		return err
+	}
+	props, err := decodeProperties(propsData)
+	if err != nil {
+		return err
+	}
+	reader.props = props
+	if err := reader.readRangeDels(rangeDelHandle); err != nil {
+		return err
 	}
+	data, err := reader.readRaw(h)
+	if err != nil {
+		return err
+	}
+	if reader.sst.mapped != nil {
+		// 顶层索引常驻内存，解除映射之后仍然会被读取，不能引用映射的内存
+		data = copySlice(data)
+	} else if c := reader.sst.opts.Cache; c != nil {
+		// 索引常驻在块缓存中，直到文件关闭
+		c.SetPinned(reader.sst.opts.FileNum, h.offset, data)
+		reader.sst.mu.Lock()
+		reader.sst.pinned = append(reader.sst.pinned, h.offset)
+		reader.sst.mu.Unlock()
+	}
+	if reader.index, err = newBlock(data); err != nil {
+		return err
+	}
+	reader.partitions = make([]partition, reader.index.num)
+	for i := range reader.partitions {
+		_, val, err := reader.index.entry(i, true)
+		if err != nil {
+			return err
+		}
+		if len(val) != topIndexValueSize {
+			return brokenFileErr
+		}
+		p := partition{
+			index:  decodeBlockHandle(val),
+			filter: decodeBlockHandle(val[blockHandleSize:]),
+			end:    int(binary.LittleEndian.Uint64(val[2*blockHandleSize:])),
+		}
+		if p.end <= reader.numBlocks {
+			return brokenFileErr
+		}
+		reader.partitions[i], reader.numBlocks = p, p.end
+	}
+	return nil
+}
 
-	if reader.start <= uint64(offset) && uint64(offset) < reader.start+reader.length && uint64(offset)+uint64(len(data)) > reader.start+reader.length {
-		n := copy(data, reader.buff[offset-int64(reader.start):offset-int64(reader.start)+int64(reader.length)])
-		data = data[n:]
-		offset += int64(n)
+// readRangeDels 读取range-del block，范围删除标记一般很少，全部解码后常驻内存
+func (reader *SSTReader) readRangeDels(h blockHandle) error {
+	data := make([]byte, h.length)
+	if err := readFull(reader.sst.file, data, int64(h.offset)); err != nil {
+		return err
 	}
-	n, err := reader.sst.file.ReadAt(reader.buff[:], int64(offset-offset%blockSize))
+	b, err := newBlock(data)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	for i := 0; i < b.num; i++ {
+		start, end, err := b.entry(i, true)
+		if err != nil {
+			return err
+		}
+		if start.Kind() != table.KindRangeDelete {
+			return brokenFileErr
+		}
+		reader.rangeDels = append(reader.rangeDels, table.RangeTombstone{
+			Start: start.Key(),
+			End:   end,
+			Seq:   reader.withGlobalSeq(start).Seq(),
+		})
 	}
-	reader.start = uint64(offset - offset%blockSize)
-	reader.length = uint64(n)
-	return reader.ReadAt(data, offset)
+	return nil
 }
 
-type Iterator struct {
-	key *table.Key
-	val []byte
-	err error
-	// TODO
-	end    bool
-	offset uint64
-	reader *SSTReader
+// partitionStart 第p个partition的第一个data block的编号
+func (reader *SSTReader) partitionStart(p int) int {
+	if p == 0 {
+		return 0
+	}
+	return reader.partitions[p-1].end
 }
 
-func (i *Iterator) Next() bool {
-	if i.offset > i.reader.meta.KeyIdx[len(i.reader.meta.KeyIdx)-1] {
-		return false
+// readPartition 读取第p个index partition
+func (reader *SSTReader) readPartition(bs *blockState, p int) (*block, error) {
+	h := reader.partitions[p].index
+	if bs.partition != nil && bs.partitionOffset == h.offset {
+		return bs.partition, nil
 	}
-	keyLength := make([]byte, 4)
-	n, err := i.reader.ReadAt(keyLength, int64(i.offset))
+	data, err := reader.readRaw(h)
 	if err != nil {
-		i.err = err
-		return false
+		return nil, err
 	}
-	i.offset += uint64(n)
-	keySlice := make([]byte, binary.LittleEndian.Uint32(keyLength))
-	n, err = i.reader.ReadAt(keySlice, int64(i.offset))
+	b, err := newBlock(data)
 	if err != nil {
-		i.err = err
-		return false
+		return nil, err
 	}
-	i.offset += uint64(n)
-	valLength := make([]byte, 4)
-	n, err = i.reader.ReadAt(valLength, int64(i.offset))
+	bs.partitionOffset, bs.partition = h.offset, b
+	return b, nil
+}
+
+// filterMayContain 第p个partition中是否可能存在key，没有filter block时总是返回true
+func (reader *SSTReader) filterMayContain(p int, key []byte) (bool, error) {
+	h := reader.partitions[p].filter
+	if h.length == 0 {
+		return true, nil
+	}
+	filter, err := reader.readRaw(h)
 	if err != nil {
-		i.err = err
-		return false
+		return false, err
 	}
-	i.offset += uint64(n)
-	valSlice := make([]byte, binary.LittleEndian.Uint32(valLength))
-	n, err = i.reader.ReadAt(valSlice, int64(i.offset))
+	return filterMayContain(filter, key), nil
+}
+
+// searchIndex 返回第一个最后一个key大于等于key的data block的编号，不存在时返回numBlocks
+// 先在顶层索引中找到partition，再在partition中查找
+func (reader *SSTReader) searchIndex(bs *blockState, key table.Key) (int, error) {
+	p, err := reader.index.search(key)
+	if err != nil || p == reader.index.num {
+		return reader.numBlocks, err
+	}
+	return reader.searchPartition(bs, p, key)
+}
+
+func (reader *SSTReader) searchPartition(bs *blockState, p int, key table.Key) (int, error) {
+	b, err := reader.readPartition(bs, p)
 	if err != nil {
-		i.err = err
-		return false
+		return 0, err
 	}
-	i.offset += uint64(n)
-	k := table.NewKey(keySlice)
-	i.key = &k
-	i.val = valSlice
-	return true
+	j, err := b.search(key)
+	if err != nil {
+		return 0, err
+	}
+	// partition的最后一个key大于等于key，一定能在partition中找到
+	if j == b.num {
+		return 0, brokenFileErr
+	}
+	return reader.partitionStart(p) + j, nil
+}
+
+// dataHandle 返回第i个data block的位置
+func (reader *SSTReader) dataHandle(bs *blockState, i int) (blockHandle, error) {
+	p := sort.Search(len(reader.partitions), func(p int) bool {
+		return reader.partitions[p].end > i
+	})
+	if p == len(reader.partitions) {
+		return blockHandle{}, brokenFileErr
+	}
+	b, err := reader.readPartition(bs, p)
+	if err != nil {
+		return blockHandle{}, err
+	}
+	j := i - reader.partitionStart(p)
+	if j >= b.num {
+		return blockHandle{}, brokenFileErr
+	}
+	_, val, err := b.entry(j, true)
+	if err != nil {
+		return blockHandle{}, err
+	}
+	if len(val) != blockHandleSize {
+		return blockHandle{}, brokenFileErr
+	}
+	return decodeBlockHandle(val), nil
+}
+
+// readDataBlock 读取第i个data block
+func (reader *SSTReader) readDataBlock(bs *blockState, i int) (*block, error) {
+	h, err := reader.dataHandle(bs, i)
+	if err != nil {
+		return nil, err
+	}
+	return reader.readBlock(bs, h)
+}
+
+// Find 返回的迭代器调用Next后位于按InternalCmp第一个大于等于key的位置，调用Prev后位于它之前的位置
+func (reader *SSTReader) Find(key table.Key) (*Iterator, error) {
+	it := reader.NewIterator(nil)
+	it.SeekGE(key)
+	it.pending = true
+	return it, it.err
 }
 
-func (reader *SSTReader) ReadItem(offset uint64) *Iterator {
-	return &Iterator{reader: reader, offset: offset}
+// Get 查找key最新的版本，第二个返回值表示是否存在，被删除、已经过期或者被本表的范围删除标记覆盖的key视为不存在
+// 返回的value不包含过期时间，更新的表中的范围删除标记需要调用方通过RangeTombstones处理
+func (reader *SSTReader) Get(key table.Key) ([]byte, bool, error) {
+	k, val, ok, err := reader.Lookup(table.NewSearchKey(key.Key()))
+	if !ok || k.Kind() == table.KindDelete || reader.rangeDels.Covers(k, table.MaxSeq) ||
+		table.Expired(k.Kind(), val, reader.now().UnixNano()) {
+		return nil, false, err
+	}
+	return table.UserValue(k.Kind(), val), true, nil
 }
 
-type MetaData struct {
-	MetaStart uint64
-	KeyNum    int
-	KeyIdx    []uint64
+func (reader *SSTReader) now() time.Time {
+	if reader.sst.opts.Now != nil {
+		return reader.sst.opts.Now()
+	}
+	return time.Now()
 }
 
-func (reader *SSTReader) readMeta() error {
-	metaLength := make([]byte, 8)
-	n, err := reader.ReadAt(metaLength, reader.sst.file.Size()-8)
+// Lookup 查找key序列号不大于key.Seq()的最新版本，包括删除标记，不处理范围删除标记
+// 用table.NewSearchKey查找时得到最新的版本
+// 返回的key带有记录的序列号和类型，分离到blob文件中的value会被读取，类型返回KindSet
+// KindSetWithTTL的value是原始编码，包含过期时间，不判断是否过期，调用方用table.Expired和table.UserValue解码
+func (reader *SSTReader) Lookup(key table.Key) (table.Key, []byte, bool, error) {
+	// 查找期间持有映射内存的引用，并发的Close不会解除映射，返回的value是复制的
+	if reader.sst.ref() {
+		defer reader.sst.unref()
+	}
+	if !reader.mayContain(key.Key()) {
+		return table.Key{}, nil, false, nil
+	}
+	seq := key.Seq()
+	if reader.props.GlobalSeq != 0 {
+		// 导入的表中每个key只有一个版本，文件中保存的序列号不是实际的序列号，找到之后再判断是否可见
+		if reader.props.GlobalSeq > seq {
+			return table.Key{}, nil, false, nil
+		}
+		key = table.NewSearchKey(key.Key())
+	}
+	p, err := reader.index.search(key)
+	if err != nil || p == reader.index.num {
+		return table.Key{}, nil, false, err
+	}
+	if ok, err := reader.filterMayContain(p, key.Key()); !ok {
+		return table.Key{}, nil, false, err
+	}
+	bs := &blockState{}
+	i, err := reader.searchPartition(bs, p, key)
 	if err != nil {
-		return err
+		return table.Key{}, nil, false, err
 	}
-	if n != 8 {
-		return brokenFileErr
+	b, err := reader.readDataBlock(bs, i)
+	if err != nil {
+		return table.Key{}, nil, false, err
 	}
-	length := binary.LittleEndian.Uint64(metaLength)
-	log.Printf("metalength: %d\n", length)
-	num := int((length - 8) / 8)
-	metaStart := reader.sst.file.Size() - int64(length)
-	md := make([]uint64, 0, num)
-	buff := make([]byte, 8)
-	for i := 0; i < num; i++ {
-		_, err = reader.ReadAt(buff, int64(int64(i*8)+metaStart))
-		if err != nil {
-			return err
+	j, ok, err := b.lookup(key)
+	if !ok {
+		return table.Key{}, nil, false, err
+	}
+	k, val, err := b.entry(j, true)
+	if err != nil {
+		return table.Key{}, nil, false, err
+	}
+	k = reader.withGlobalSeq(table.NewInternalKey(key.Key(), k.Seq(), k.Kind()))
+	if k.Kind() == table.KindBlobIndex {
+		if val, err = reader.resolveBlob(val); err != nil {
+			return table.Key{}, nil, false, err
 		}
-		md = append(md, binary.LittleEndian.Uint64(buff))
+		return table.NewInternalKey(k.Key(), k.Seq(), table.KindSet), val, true, nil
 	}
-	reader.meta.KeyIdx = md
-	reader.meta.KeyNum = num
-	reader.meta.MetaStart = uint64(metaStart)
-	return nil
+	return k, copySlice(val), true, nil
 }
 
-func (reader *SSTReader) Find(key table.Key) (*Iterator, error) {
-	num, md := reader.meta.KeyNum, reader.meta.KeyIdx
+// withGlobalSeq 导入的表中所有记录使用同一个全局序列号
+func (reader *SSTReader) withGlobalSeq(k table.Key) table.Key {
+	if reader.props.GlobalSeq == 0 {
+		return k
+	}
+	return table.NewInternalKey(k.Key(), reader.props.GlobalSeq, k.Kind())
+}
+
+// resolveBlob 读取blob指针指向的value
+func (reader *SSTReader) resolveBlob(ptr []byte) ([]byte, error) {
+	if reader.sst.opts.Blobs == nil {
+		return nil, errNoBlobReader
+	}
+	p, err := blob.DecodePointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	return reader.sst.opts.Blobs.Get(p)
+}
 
-	found := sort.Search(num, func(i int) bool {
-		it := reader.ReadItem(md[i])
-		if !it.Next() {
-			return false
+// RewriteBlobPointers 把所有记录复制到writer中，并按照remap替换blob指针，用于blob GC之后更新SSTable
+func (reader *SSTReader) RewriteBlobPointers(writer *Writer, remap map[blob.Pointer]blob.Pointer) error {
+	it := reader.NewIterator(&IterOptions{KeepCovered: true})
+	for it.First(); it.Valid(); it.Next() {
+		val := it.RawValue()
+		if it.Key().Kind() == table.KindBlobIndex {
+			p, err := blob.DecodePointer(val)
+			if err != nil {
+				return err
+			}
+			if newP, ok := remap[p]; ok {
+				val = newP.Encode()
+			}
 		}
-		return it.key.Cmp(key) >= 0
-	})
-	return reader.ReadItem(md[found]), nil
+		if err := writer.Write(it.Key(), val); err != nil {
+			return err
+		}
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+	for _, t := range reader.rangeDels {
+		if err := writer.AddRangeTombstone(t); err != nil {
+			return err
+		}
+	}
+	return writer.Done()
+}
+
+// RangeTombstones 返回表中切分后的范围删除标记，返回值被共享，不能被修改
+func (reader *SSTReader) RangeTombstones() table.RangeTombstones {
+	return reader.rangeDels
+}
+
+// Properties 返回表的统计信息
+func (reader *SSTReader) Properties() *Properties {
+	props := *reader.props
+	return &props
 }
 
 func (sst *SSTable) NewReader() (*SSTReader, error) {
 	reader := &SSTReader{
 		sst: sst,
 	}
-	return reader, reader.readMeta()
+	return reader, reader.readIndex()
 }
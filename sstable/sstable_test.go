@@ -2,9 +2,19 @@ package sstable
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"os"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/InsZVA/saver/blob"
+	"github.com/InsZVA/saver/cache"
 	"github.com/InsZVA/saver/table"
 	"github.com/InsZVA/saver/util"
 )
@@ -104,3 +114,1068 @@ func TestSSTable(t *testing.T) {
 		}
 	}
 }
+
+func TestSSTReaderGet(t *testing.T) {
+	list := NewTestSkipList()
+	list.Delete(table.NewKey([]byte("b")))
+	sst, err := CreateSSTable("/tmp/sst_get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sst.FromMemTable(list); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	sst, err = OpenSSTable("/tmp/sst_get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, found, err := reader.Get(table.NewKey([]byte("a")))
+	if err != nil || !found || !bytes.Equal(val, []byte{1}) {
+		t.Error("a查找错误", val, found, err)
+	}
+	if _, found, err = reader.Get(table.NewKey([]byte("b"))); err != nil || found {
+		t.Error("被删除的b不应该被找到", found, err)
+	}
+	if _, found, err = reader.Get(table.NewKey([]byte("bb"))); err != nil || found {
+		t.Error("不存在的bb不应该被找到", found, err)
+	}
+	if _, found, err = reader.Get(table.NewKey([]byte("d"))); err != nil || found {
+		t.Error("越过末尾的d不应该被找到", found, err)
+	}
+	i, err := reader.Find(table.NewKey([]byte("d")))
+	if err != nil {
+		t.Error(err)
+	}
+	if i.Next() {
+		t.Error("越过末尾后还有next")
+	}
+	// Find之后调用Next之前迭代器无效，Prev移动到key之前的记录
+	i, err = reader.Find(table.NewSearchKey([]byte("c")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Valid() {
+		t.Error("Find之后调用Next之前迭代器应该无效")
+	}
+	if !i.Prev() || string(i.Key().Key()) != "b" {
+		t.Error("Find之后Prev应该位于b", i.Key())
+	}
+	if !i.Next() || string(i.Key().Key()) != "c" {
+		t.Error("Prev之后Next应该位于c", i.Key())
+	}
+}
+
+func TestSSTReaderGetEmpty(t *testing.T) {
+	sst, err := CreateSSTable("/tmp/sst_empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sst.FromMemTable(table.NewSkipList()); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	sst, err = OpenSSTable("/tmp/sst_empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := reader.Get(table.NewKey([]byte("a"))); err != nil || found {
+		t.Error("空表中不应该找到a", found, err)
+	}
+	i, err := reader.Find(table.NewKey([]byte("a")))
+	if err != nil {
+		t.Error(err)
+	}
+	if i.Next() {
+		t.Error("空表有next")
+	}
+}
+
+func TestSSTReaderGetTTL(t *testing.T) {
+	now := time.Unix(1000, 0)
+	sst, err := CreateSSTable("/tmp/sst_ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := sst.NewWriter()
+	writer.Write(table.NewInternalKey([]byte("a"), 2, table.KindSetWithTTL), table.EncodeExpiry([]byte("a1"), now.Add(-time.Second)))
+	writer.Write(table.NewInternalKey([]byte("b"), 2, table.KindSetWithTTL), table.EncodeExpiry([]byte("b1"), now.Add(time.Second)))
+	if err = writer.Done(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	sst, err = OpenSSTableWithOptions("/tmp/sst_ttl", &Options{Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := reader.Get(table.NewKey([]byte("a"))); err != nil || found {
+		t.Error("过期的a不应该被找到", found, err)
+	}
+	val, found, err := reader.Get(table.NewKey([]byte("b")))
+	if err != nil || !found || string(val) != "b1" {
+		t.Error("b查找错误", string(val), found, err)
+	}
+	// Lookup返回原始编码的value
+	k, val, found, err := reader.Lookup(table.NewSearchKey([]byte("a")))
+	if err != nil || !found || k.Kind() != table.KindSetWithTTL || !table.Expired(k.Kind(), val, now.UnixNano()) ||
+		string(table.UserValue(k.Kind(), val)) != "a1" {
+		t.Error("a的Lookup错误", k, val, found, err)
+	}
+}
+
+func TestSSTableBlockCache(t *testing.T) {
+	list := table.NewSkipList()
+	keys := []table.Key{}
+	vals := [][]byte{}
+	for i := 0; i < 2000; i++ {
+		keys = append(keys, table.NewKey(util.RandomSlice(64)))
+		vals = append(vals, util.RandomSlice(128))
+		list.Set(keys[i], vals[i])
+	}
+	sst, err := CreateSSTable("/tmp/sst_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sst.FromMemTable(list); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	c := cache.New(4 * blockSize)
+	tables := []*SSTable{}
+	readers := []*SSTReader{}
+	for i := 1; i <= 2; i++ {
+		sst, err := OpenSSTableWithOptions("/tmp/sst_cache", &Options{Cache: c, FileNum: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := sst.NewReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, sst)
+		readers = append(readers, reader)
+	}
+	pinned := c.Stats().Count
+	if pinned == 0 {
+		t.Error("metadata没有被固定在缓存中")
+	}
+
+	for j := 0; j < 1000; j++ {
+		idx := rand.Intn(len(keys))
+		val, found, err := readers[j%2].Get(keys[idx])
+		if err != nil || !found || !bytes.Equal(val, vals[idx]) {
+			t.Error(keys[idx].Key(), "查找错误", err)
+		}
+	}
+	stats := c.Stats()
+	if stats.Hits == 0 || stats.Misses == 0 {
+		t.Error("缓存统计错误", stats)
+	}
+	if stats.Size > stats.Capacity {
+		t.Error("缓存超出容量", stats)
+	}
+
+	// 两个reader打开的是同一个文件，关闭其中一个不影响另一个缓存的块
+	tables[0].Close()
+	if c.Stats().Count == 0 {
+		t.Error("关闭一个reader删除了另一个reader缓存的块")
+	}
+	hits := c.Stats().Hits
+	if _, _, err := readers[1].Get(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if c.Stats().Hits == hits {
+		t.Error("关闭一个reader之后另一个reader的索引不在缓存中")
+	}
+	tables[1].Close()
+
+	// 关闭之后块仍然保留，重新打开时不需要再读取
+	count := c.Stats().Count
+	if count == 0 {
+		t.Error("关闭文件时不应该删除缓存的块")
+	}
+	misses := c.Stats().Misses
+	sst, err = OpenSSTableWithOptions("/tmp/sst_cache", &Options{Cache: c, FileNum: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sst.NewReader(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Stats().Misses != misses {
+		t.Error("重新打开之后索引不在缓存中", c.Stats())
+	}
+	sst.Close()
+	// 文件被删除时才删除它的所有块
+	c.EvictFile(1)
+	if c.Stats().Count != 0 {
+		t.Error("EvictFile之后缓存中仍有块", c.Stats())
+	}
+}
+
+func TestSSTReaderConcurrent(t *testing.T) {
+	list := table.NewSkipList()
+	keys := []table.Key{}
+	vals := [][]byte{}
+	for i := 0; i < 2000; i++ {
+		keys = append(keys, table.NewKey(util.RandomSlice(64)))
+		vals = append(vals, util.RandomSlice(128))
+		list.Set(keys[i], vals[i])
+	}
+	sst, err := CreateSSTable("/tmp/sst_concurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sst.FromMemTable(list); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+	total := 0
+	for p := list.First().Next(); p != list.End(); p = p.Next() {
+		total++
+	}
+
+	for _, opts := range []*Options{nil, {Cache: cache.New(8 * blockSize)}} {
+		sst, err := OpenSSTableWithOptions("/tmp/sst_concurrent", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := sst.NewReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				if g%2 == 0 {
+					// 并发的点查询
+					for j := 0; j < 200; j++ {
+						idx := (g*200 + j) % len(keys)
+						val, found, err := reader.Get(keys[idx])
+						if err != nil || !found || !bytes.Equal(val, vals[idx]) {
+							t.Error(keys[idx].Key(), "查找错误", err)
+						}
+					}
+					return
+				}
+				// 并发的全表扫描
+				it := reader.NewIterator(nil)
+				defer it.Close()
+				n := 0
+				var last table.Key
+				for it.First(); it.Valid(); it.Next() {
+					if n > 0 && it.Key().Cmp(last) <= 0 {
+						t.Error("扫描顺序错误")
+					}
+					last = it.Key()
+					n++
+				}
+				if n != total || it.Error() != nil {
+					t.Error("扫描数量错误", n, it.Error())
+				}
+			}(g)
+		}
+		wg.Wait()
+		sst.Close()
+	}
+}
+
+func TestWriterStreaming(t *testing.T) {
+	sst, err := CreateSSTable("/tmp/sst_stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := sst.NewWriter()
+	// 旧格式中每个key占用8字节的metadata，这里的metadata会远大于一个块
+	num := 200000
+	var lastSize uint64
+	for i := 0; i < num; i++ {
+		if err := writer.Write(table.NewKey([]byte(fmt.Sprintf("%08d", i))), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if writer.EstimatedSize() < lastSize {
+			t.Fatal("EstimatedSize变小了")
+		}
+		lastSize = writer.EstimatedSize()
+	}
+	if writer.NumEntries() != num {
+		t.Error("NumEntries错误", writer.NumEntries())
+	}
+	if err = writer.Write(table.NewKey([]byte("00000000")), nil); err != errKeyOrder {
+		t.Error("乱序写入没有返回错误", err)
+	}
+	if err = writer.Done(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	info, err := os.Stat("/tmp/sst_stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(info.Size()) != lastSize {
+		t.Error("EstimatedSize与实际大小不一致", lastSize, info.Size())
+	}
+
+	sst, err = OpenSSTable("/tmp/sst_stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j := 0; j < 1000; j++ {
+		i := rand.Intn(num)
+		val, found, err := reader.Get(table.NewKey([]byte(fmt.Sprintf("%08d", i))))
+		if err != nil || !found || !bytes.Equal(val, []byte("value")) {
+			t.Error(i, "查找错误", err)
+		}
+	}
+	it := reader.NewIterator(nil)
+	n := 0
+	for it.First(); it.Valid(); it.Next() {
+		n++
+	}
+	if n != num || it.Error() != nil {
+		t.Error("扫描数量错误", n, it.Error())
+	}
+}
+
+func TestSSTableBroken(t *testing.T) {
+	if err := ioutil.WriteFile("/tmp/sst_broken", []byte("not a sstable at all, definitely"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sst, err := OpenSSTable("/tmp/sst_broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	if _, err = sst.NewReader(); err != brokenFileErr {
+		t.Error("损坏的文件没有返回错误", err)
+	}
+}
+
+func TestWriterLargeEntry(t *testing.T) {
+	if checkEntry(math.MaxUint32, 0) != errEntryTooLarge || checkEntry(0, math.MaxUint32+1) != errEntryTooLarge {
+		t.Error("无法表示的记录没有返回错误")
+	}
+	if checkEntry(math.MaxUint32-trailerSize, math.MaxUint32) != nil {
+		t.Error("可以表示的记录返回了错误")
+	}
+
+	sst, err := CreateSSTable("/tmp/sst_large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []table.Key{}
+	vals := [][]byte{}
+	writer := sst.NewWriter()
+	for i := 0; i < 20; i++ {
+		keys = append(keys, table.NewKey([]byte(fmt.Sprintf("%04d", i))))
+		switch i % 4 {
+		case 0:
+			vals = append(vals, util.RandomSlice(blockSize*3+rand.Intn(blockSize)))
+		case 1:
+			// 刚好放不进一个空块
+			vals = append(vals, util.RandomSlice(blockSize-entrySize(keys[i], nil)-3))
+		case 2:
+			keys[i] = table.NewKey(append([]byte(fmt.Sprintf("%04d", i)), util.RandomSlice(blockSize)...))
+			vals = append(vals, util.RandomSlice(10))
+		default:
+			vals = append(vals, util.RandomSlice(100))
+		}
+		if err := writer.Write(keys[i], vals[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.Done(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	sst, err = OpenSSTableWithOptions("/tmp/sst_large", &Options{Cache: cache.New(blockSize * 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range keys {
+		val, found, err := reader.Get(keys[i])
+		if err != nil || !found || !bytes.Equal(val, vals[i]) {
+			t.Error(i, "大记录读取错误", len(val), found, err)
+		}
+	}
+	it := reader.NewIterator(nil)
+	i := len(keys)
+	for it.Last(); it.Valid(); it.Prev() {
+		i--
+		if it.Key().Cmp(keys[i]) != 0 || !bytes.Equal(it.Value(), vals[i]) {
+			t.Error(i, "大记录反向扫描错误")
+		}
+	}
+	if i != 0 || it.Error() != nil {
+		t.Error("大记录扫描数量错误", i, it.Error())
+	}
+}
+
+func TestSSTableBlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "saver_sst_blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bw, err := blob.Create(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sst, err := CreateSSTable(TableFileName(dir, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := sst.NewWriterWithOptions(&WriterOptions{BlobWriter: bw, BlobThreshold: 1024})
+	keys := []table.Key{}
+	vals := [][]byte{}
+	for i := 0; i < 50; i++ {
+		keys = append(keys, table.NewKey([]byte(fmt.Sprintf("%04d", i))))
+		if i%2 == 0 {
+			vals = append(vals, util.RandomSlice(10*1024+i*1024))
+		} else {
+			vals = append(vals, util.RandomSlice(100))
+		}
+		if err = writer.Write(keys[i], vals[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.Done(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+	if err = bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(TableFileName(dir, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 32*1024 {
+		t.Error("大value没有被分离", info.Size())
+	}
+
+	blobs := blob.NewReader(dir, 10)
+	defer blobs.Close()
+	check := func(fileNum uint64) *SSTReader {
+		sst, err := OpenSSTableWithOptions(TableFileName(dir, fileNum), &Options{Blobs: blobs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := sst.NewReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range keys {
+			val, found, err := reader.Get(keys[i])
+			if err != nil || !found || !bytes.Equal(val, vals[i]) {
+				t.Error(i, "读取错误", err)
+			}
+		}
+		it := reader.NewIterator(nil)
+		n := 0
+		for it.First(); it.Valid(); it.Next() {
+			if !bytes.Equal(it.Value(), vals[n]) {
+				t.Error(n, "扫描读取错误")
+			}
+			if (it.Key().Kind() == table.KindBlobIndex) != (n%2 == 0) {
+				t.Error(n, "记录的类型错误")
+			}
+			n++
+		}
+		if n != len(keys) || it.Error() != nil {
+			t.Error("扫描数量错误", n, it.Error())
+		}
+		return reader
+	}
+	reader := check(2)
+	var blobSize uint64
+	for i := 0; i < len(vals); i += 2 {
+		blobSize += uint64(len(vals[i]))
+	}
+	if refs := reader.Properties().BlobRefs; !reflect.DeepEqual(refs, map[uint64]uint64{1: blobSize}) {
+		t.Error("BlobRefs错误", refs)
+	}
+
+	// GC：所有的blob都存活，复制到新的blob文件并更新指针
+	dst, err := blob.Create(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remap, err := blobs.Collect(1, dst, func(key []byte, p blob.Pointer) (bool, error) {
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sst, err = CreateSSTable(TableFileName(dir, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = reader.RewriteBlobPointers(sst.NewWriter(), remap); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+	reader.sst.Close()
+	if err = blobs.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	reader = check(4)
+	if refs := reader.Properties().BlobRefs; !reflect.DeepEqual(refs, map[uint64]uint64{3: blobSize}) {
+		t.Error("更新指针之后BlobRefs错误", refs)
+	}
+	reader.sst.Close()
+
+	// 没有设置Blobs时无法读取
+	sst, err = OpenSSTable(TableFileName(dir, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	if reader, err = sst.NewReader(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = reader.Get(keys[0]); err != errNoBlobReader {
+		t.Error("没有设置Blobs时没有返回错误", err)
+	}
+}
+
+func TestSSTableRangeDelete(t *testing.T) {
+	sst, err := CreateSSTable("/tmp/sst_rangedel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := sst.NewWriter()
+	for i := 0; i < 100; i++ {
+		if err = writer.Write(table.NewInternalKey(k(i).Key(), uint64(i+10), table.KindSet), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// [0020, 0040)中序列号小于50的被删除，即0020到0039
+	// [0030, 0060)中序列号小于45的被删除，即0030到0034，与上一个重叠
+	// [0200, 0300)不覆盖任何记录，但扩大了表的范围
+	for _, rd := range []table.RangeTombstone{
+		{Start: k(20).Key(), End: k(40).Key(), Seq: 50},
+		{Start: k(30).Key(), End: k(60).Key(), Seq: 45},
+		{Start: k(200).Key(), End: k(300).Key(), Seq: 1},
+	} {
+		if err = writer.AddRangeTombstone(rd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.AddRangeTombstone(table.RangeTombstone{Start: k(5).Key(), End: k(5).Key()}); err != errEmptyRange {
+		t.Error("空范围应该返回错误", err)
+	}
+	if err = writer.Done(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+
+	sst, err = OpenSSTable("/tmp/sst_rangedel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := reader.Properties().NumRangeDeletions; n != 5 || len(reader.RangeTombstones()) != 5 {
+		t.Error("范围删除标记数错误", n, reader.RangeTombstones())
+	}
+	deleted := func(i int) bool {
+		return i >= 20 && i < 40
+	}
+	for i := 0; i < 100; i++ {
+		val, ok, err := reader.Get(k(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok == deleted(i) || (ok && string(val) != fmt.Sprintf("v%d", i)) {
+			t.Error("Get错误", i, ok, string(val))
+		}
+	}
+	var keys []string
+	it := reader.NewIterator(nil)
+	for it.First(); it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key().Key()))
+	}
+	if len(keys) != 80 || keys[19] != "0019" || keys[20] != "0040" {
+		t.Error("迭代器没有跳过被范围删除的记录", len(keys))
+	}
+	if !it.SeekGE(k(25)) || string(it.Key().Key()) != "0040" {
+		t.Error("SeekGE没有跳过被范围删除的记录")
+	}
+	if !it.SeekLT(k(38)) || string(it.Key().Key()) != "0019" {
+		t.Error("SeekLT没有跳过被范围删除的记录")
+	}
+	if !it.SeekGE(table.NewSearchKey(k(40).Key())) || !it.Prev() || string(it.Key().Key()) != "0019" {
+		t.Error("Prev没有跳过被范围删除的记录")
+	}
+	it.Close()
+	b, ok := reader.Bounds()
+	if !ok || string(b.Smallest.Key()) != "0000" || string(b.Largest.Key()) != "0300" {
+		t.Error("范围应该包括范围删除标记", string(b.Smallest.Key()), string(b.Largest.Key()))
+	}
+}
+
+func TestFromMemTableRangeDelete(t *testing.T) {
+	list := table.NewSkipList()
+	for i := 0; i < 10; i++ {
+		list.Set(table.NewInternalKey(k(i).Key(), uint64(i), table.KindSet), []byte(fmt.Sprintf("v%d", i)))
+	}
+	list.DeleteRange(k(2).Key(), k(5).Key(), 100)
+	sst, err := CreateSSTable("/tmp/sst_rangedel_mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sst.FromMemTable(list); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+	sst, err = OpenSSTable("/tmp/sst_rangedel_mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 被覆盖的记录在落盘时丢弃，范围删除标记保留下来遮盖更老的表
+	props := reader.Properties()
+	if props.NumEntries != 7 || props.NumRangeDeletions != 1 {
+		t.Error("落盘时没有丢弃被覆盖的记录", props.NumEntries, props.NumRangeDeletions)
+	}
+	rd := reader.RangeTombstones()
+	if len(rd) != 1 || !rd.Covers(table.NewInternalKey(k(3).Key(), 99, table.KindSet), table.MaxSeq) {
+		t.Error("范围删除标记错误", rd)
+	}
+}
+
+func TestPartitionedIndex(t *testing.T) {
+	sst, err := CreateSSTable("/tmp/sst_partitioned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := sst.NewWriterWithOptions(&WriterOptions{IndexPartitionSize: 256, FilterBitsPerKey: 10})
+	num := 50000
+	for i := 0; i < num; i++ {
+		if err = writer.Write(table.NewKey([]byte(fmt.Sprintf("%08d", i*2))), []byte(fmt.Sprintf("value%d", i*2))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := writer.EstimatedSize()
+	if err = writer.Done(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+	if info, err := os.Stat("/tmp/sst_partitioned"); err != nil || uint64(info.Size()) != size {
+		t.Error("EstimatedSize与实际大小不一致", size, err)
+	}
+
+	c := cache.New(64 * blockSize)
+	sst, err = OpenSSTableWithOptions("/tmp/sst_partitioned", &Options{Cache: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := reader.Properties()
+	if props.IndexPartitions < 2 || props.IndexPartitions != uint64(len(reader.partitions)) || props.FilterSize == 0 {
+		t.Fatal("没有生成多个partition", props.IndexPartitions, props.FilterSize)
+	}
+	if reader.numBlocks < int(props.IndexPartitions) {
+		t.Error("data block数错误", reader.numBlocks)
+	}
+
+	// 不存在的key大部分被filter过滤，只需要读取filter block
+	before := c.Stats()
+	for i := 0; i < 1000; i++ {
+		if _, found, err := reader.Get(table.NewKey([]byte(fmt.Sprintf("%08d", i*2+1)))); found || err != nil {
+			t.Error("不存在的key被找到", i*2+1, err)
+		}
+	}
+	if misses := c.Stats().Misses - before.Misses; misses > 20 {
+		t.Error("filter没有过滤不存在的key", misses)
+	}
+	// 每个partition边界上的key都要检查，filter中不能漏掉任何key
+	for j := 0; j < num; j++ {
+		i := j * 2
+		val, found, err := reader.Get(table.NewKey([]byte(fmt.Sprintf("%08d", i))))
+		if err != nil || !found || string(val) != fmt.Sprintf("value%d", i) {
+			t.Error(i, "查找错误", err)
+		}
+	}
+
+	it := reader.NewIterator(nil)
+	n := 0
+	for it.First(); it.Valid(); it.Next() {
+		if string(it.Key().Key()) != fmt.Sprintf("%08d", n*2) {
+			t.Fatal("扫描顺序错误", string(it.Key().Key()))
+		}
+		n++
+	}
+	if n != num || it.Error() != nil {
+		t.Error("扫描数量错误", n, it.Error())
+	}
+	n = 0
+	for it.Last(); it.Valid(); it.Prev() {
+		n++
+	}
+	if n != num || it.Error() != nil {
+		t.Error("反向扫描数量错误", n, it.Error())
+	}
+	for j := 0; j < 100; j++ {
+		i := rand.Intn(num*2 - 1)
+		if !it.SeekGE(table.NewKey([]byte(fmt.Sprintf("%08d", i)))) || string(it.Key().Key()) != fmt.Sprintf("%08d", (i+1)/2*2) {
+			t.Error("SeekGE错误", i, string(it.Key().Key()))
+		}
+	}
+	it.Close()
+}
+
+func TestWriterBlockSize(t *testing.T) {
+	write := func(path string, opts *WriterOptions) *SSTReader {
+		sst, err := CreateSSTable(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer := sst.NewWriterWithOptions(opts)
+		for i := 0; i < 1000; i++ {
+			if err = writer.Write(table.NewKey([]byte(fmt.Sprintf("%08d", i))), []byte(fmt.Sprintf("value%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = writer.Done(); err != nil {
+			t.Fatal(err)
+		}
+		sst.Close()
+		if sst, err = OpenSSTable(path); err != nil {
+			t.Fatal(err)
+		}
+		reader, err := sst.NewReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reader
+	}
+	small := write("/tmp/sst_block_size_small", &WriterOptions{BlockSize: 512})
+	large := write("/tmp/sst_block_size_default", nil)
+	defer small.sst.Close()
+	defer large.sst.Close()
+	if large.numBlocks != 1 || small.numBlocks < 20 {
+		t.Error("块大小没有生效", large.numBlocks, small.numBlocks)
+	}
+	for i := 0; i < 1000; i++ {
+		val, found, err := small.Get(table.NewKey([]byte(fmt.Sprintf("%08d", i))))
+		if err != nil || !found || string(val) != fmt.Sprintf("value%d", i) {
+			t.Error(i, "查找错误", err)
+		}
+	}
+}
+
+func TestBlockHashIndex(t *testing.T) {
+	bb := blockBuilder{hashIndex: true}
+	num := 1000
+	for i := 0; i < num; i++ {
+		bb.add(k(i*2), []byte(fmt.Sprintf("v%d", i*2)))
+	}
+	size := bb.estimatedSize()
+	data := bb.finish()
+	if len(data) != size {
+		t.Error("estimatedSize错误", size, len(data))
+	}
+	b, err := newBlock(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.num != num || b.buckets == nil {
+		t.Fatal("hash索引解码错误", b.num)
+	}
+	collisions := 0
+	for i := 0; i < len(b.buckets); i += 2 {
+		if b.buckets[i] == 0xfe && b.buckets[i+1] == 0xff {
+			collisions++
+		}
+	}
+	if collisions == 0 {
+		t.Error("测试需要覆盖冲突的桶")
+	}
+	for i := 0; i < num*2; i++ {
+		j, ok, err := b.lookup(k(i))
+		if err != nil || ok != (i%2 == 0) || (ok && j != i/2) {
+			t.Error("lookup错误", i, j, ok, err)
+		}
+	}
+
+	// 没有hash索引的块使用二分查找
+	bb = blockBuilder{}
+	bb.add(k(1), nil)
+	b, err = newBlock(bb.finish())
+	if err != nil || b.buckets != nil {
+		t.Fatal("不应该有hash索引", err)
+	}
+	if _, ok, _ := b.lookup(k(0)); ok {
+		t.Error("lookup错误")
+	}
+	if j, ok, _ := b.lookup(k(1)); !ok || j != 0 {
+		t.Error("lookup错误")
+	}
+}
+
+func TestSSTableBlockHashIndex(t *testing.T) {
+	sst, err := CreateSSTable("/tmp/sst_hash_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := sst.NewWriterWithOptions(&WriterOptions{BlockHashIndex: true})
+	num := 20000
+	for i := 0; i < num; i++ {
+		if err = writer.Write(table.NewKey([]byte(fmt.Sprintf("%08d", i*2))), []byte(fmt.Sprintf("value%d", i*2))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := writer.EstimatedSize()
+	if err = writer.Done(); err != nil {
+		t.Fatal(err)
+	}
+	sst.Close()
+	if info, err := os.Stat("/tmp/sst_hash_index"); err != nil || uint64(info.Size()) != size {
+		t.Error("EstimatedSize与实际大小不一致", size, err)
+	}
+	sst, err = OpenSSTable("/tmp/sst_hash_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sst.Close()
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < num*2; i++ {
+		val, found, err := reader.Get(table.NewKey([]byte(fmt.Sprintf("%08d", i))))
+		if err != nil || found != (i%2 == 0) || (found && string(val) != fmt.Sprintf("value%d", i)) {
+			t.Fatal(i, "查找错误", found, err)
+		}
+	}
+	it := reader.NewIterator(nil)
+	n := 0
+	for it.First(); it.Valid(); it.Next() {
+		n++
+	}
+	if n != num || it.Close() != nil {
+		t.Error("扫描数量错误", n)
+	}
+}
+
+func TestSSTableVersions(t *testing.T) {
+	for _, hashIndex := range []bool{false, true} {
+		sst, err := CreateSSTable("/tmp/sst_versions")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 块和partition都很小，同一个key的多个版本会跨越块和partition
+		writer := sst.NewWriterWithOptions(&WriterOptions{
+			BlockSize:          128,
+			IndexPartitionSize: 128,
+			FilterBitsPerKey:   10,
+			BlockHashIndex:     hashIndex,
+		})
+		num := 300
+		for i := 0; i < num; i++ {
+			key := k(i).Key()
+			seq := uint64(i*10 + 3)
+			writer.Write(table.NewInternalKey(key, seq, table.KindSet), []byte(fmt.Sprintf("new%d", i)))
+			writer.Write(table.NewInternalKey(key, seq-1, table.KindDelete), nil)
+			if err = writer.Write(table.NewInternalKey(key, seq-2, table.KindSet), []byte(fmt.Sprintf("old%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = writer.Write(table.NewInternalKey(k(num-1).Key(), 1000000, table.KindSet), nil); err != errKeyOrder {
+			t.Error("同一个key的新版本不能写在旧版本之后", err)
+		}
+		if err = writer.Done(); err != nil {
+			t.Fatal(err)
+		}
+		sst.Close()
+		sst, err = OpenSSTable("/tmp/sst_versions")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := sst.NewReader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < num; i++ {
+			key := k(i).Key()
+			for _, c := range []struct {
+				seq  uint64
+				kind table.Kind
+				val  string
+				ok   bool
+			}{
+				{table.MaxSeq, table.KindSet, fmt.Sprintf("new%d", i), true},
+				{uint64(i*10 + 3), table.KindSet, fmt.Sprintf("new%d", i), true},
+				{uint64(i*10 + 2), table.KindDelete, "", true},
+				{uint64(i*10 + 1), table.KindSet, fmt.Sprintf("old%d", i), true},
+				{uint64(i * 10), 0, "", false},
+			} {
+				got, val, ok, err := reader.Lookup(table.NewInternalKey(key, c.seq, table.KindSet))
+				if err != nil || ok != c.ok || (ok && (got.Kind() != c.kind || string(val) != c.val)) {
+					t.Fatal(hashIndex, i, c.seq, "查找错误", got, string(val), ok, err)
+				}
+			}
+		}
+		it := reader.NewIterator(nil)
+		n := 0
+		var last table.Key
+		for it.First(); it.Valid(); it.Next() {
+			if n > 0 && last.InternalCmp(it.Key()) >= 0 {
+				t.Fatal("迭代器顺序错误", n)
+			}
+			last = table.NewInternalKey(append([]byte(nil), it.Key().Key()...), it.Key().Seq(), it.Key().Kind())
+			n++
+		}
+		if n != num*3 || it.Close() != nil {
+			t.Error("扫描数量错误", n)
+		}
+		sst.Close()
+	}
+}
+
+func TestSSTableMmap(t *testing.T) {
+	sst, _ := newTestReader(t, "/tmp/sst_mmap", 5000)
+	sst.Close()
+	c := cache.New(4 * blockSize)
+	sst, err := OpenSSTableWithOptions("/tmp/sst_mmap", &Options{Cache: c, Mmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10000; i += 7 {
+		val, found, err := reader.Get(k(i))
+		if err != nil || found != (i%2 == 0) || (found && string(val) != fmt.Sprintf("v%d", i)) {
+			t.Error(i, "查找错误", found, err)
+		}
+	}
+	if c.Stats().Count != 0 {
+		t.Error("映射的文件不应该使用块缓存", c.Stats())
+	}
+
+	inMapped := func(b []byte) bool {
+		start := uintptr(unsafe.Pointer(&sst.mapped[0]))
+		p := uintptr(unsafe.Pointer(&b[0]))
+		return p >= start && p < start+uintptr(len(sst.mapped))
+	}
+	it := reader.NewIterator(nil)
+	it2 := reader.NewIterator(nil)
+	expectAt(t, it, it.SeekGE(k(100)), 100)
+	if !inMapped(it.Key().Key()) || !inMapped(it.Value()) {
+		t.Error("迭代器返回的切片应该直接引用映射的内存")
+	}
+
+	// 还有迭代器时关闭文件，映射在最后一个迭代器关闭之后才解除
+	if err = sst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sst.mapped == nil {
+		t.Fatal("还有迭代器时不应该解除映射")
+	}
+	n := 0
+	for it.First(); it.Valid(); it.Next() {
+		expectAt(t, it, true, n*2)
+		n++
+	}
+	if n != 5000 {
+		t.Error("扫描数量错误", n)
+	}
+	if err = it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if it.Close() != nil || sst.mapped == nil {
+		t.Fatal("重复关闭迭代器不应该释放其他迭代器的引用")
+	}
+	if err = it2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sst.mapped != nil {
+		t.Error("所有迭代器关闭之后应该解除映射")
+	}
+}
+
+func TestSSTableMmapConcurrentClose(t *testing.T) {
+	sst, _ := newTestReader(t, "/tmp/sst_mmap_close", 5000)
+	sst.Close()
+	sst, err := OpenSSTableWithOptions("/tmp/sst_mmap_close", &Options{Mmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := sst.NewReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 查找期间持有映射的引用，与Close并发时要么读到正确的值，要么因为文件已经关闭而返回错误
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g * 2; i < 10000; i += 8 {
+				val, found, err := reader.Get(k(i))
+				if err == nil && (!found || string(val) != fmt.Sprintf("v%d", i)) {
+					t.Error(i, "查找错误", found)
+				}
+			}
+		}(g)
+	}
+	if err := sst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if sst.mapped != nil {
+		t.Error("所有查找结束之后应该解除映射")
+	}
+}
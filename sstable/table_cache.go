@@ -0,0 +1,205 @@
+package sstable
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+var errTableCacheClosed = errors.New("TableCache已经关闭")
+
+// TableFileName 返回编号为fileNum的SSTable在dirname下的文件名
+func TableFileName(dirname string, fileNum uint64) string {
+	return filepath.Join(dirname, fmt.Sprintf("%06d.sst", fileNum))
+}
+
+// TableCache 按需打开SSTable并在多个使用者之间共享reader
+// 打开的文件数超过maxOpenFiles时按LRU淘汰，被淘汰的文件在最后一个使用者Release之后才会关闭
+type TableCache struct {
+	mu       sync.Mutex
+	dirname  string
+	opts     Options
+	maxOpen  int
+	lru      list.List
+	tables   map[uint64]*tableEntry
+	isClosed bool
+}
+
+type tableEntry struct {
+	fileNum uint64
+	sst     *SSTable
+	reader  *SSTReader
+	err     error
+	// 打开完成之后关闭，其他使用者在此等待
+	ready chan struct{}
+	// 在TableCache中时，TableCache自身持有一个引用
+	refs int
+	elem *list.Element
+}
+
+// TableHandle 对一个打开的SSTable的引用，使用完之后必须调用Release
+type TableHandle struct {
+	tc    *TableCache
+	entry *tableEntry
+}
+
+// NewTableCache opts中的Cache为所有表共享，FileNum会被替换为每个表的编号
+func NewTableCache(dirname string, maxOpenFiles int, opts *Options) *TableCache {
+	tc := &TableCache{
+		dirname: dirname,
+		maxOpen: maxOpenFiles,
+		tables:  make(map[uint64]*tableEntry),
+	}
+	if opts != nil {
+		tc.opts = *opts
+	}
+	if tc.maxOpen < 1 {
+		tc.maxOpen = 1
+	}
+	return tc
+}
+
+// Acquire 获取编号为fileNum的表，第一次获取时才打开文件
+func (tc *TableCache) Acquire(fileNum uint64) (*TableHandle, error) {
+	tc.mu.Lock()
+	if tc.isClosed {
+		tc.mu.Unlock()
+		return nil, errTableCacheClosed
+	}
+	e, ok := tc.tables[fileNum]
+	if ok {
+		e.refs++
+		tc.lru.MoveToFront(e.elem)
+		tc.mu.Unlock()
+		<-e.ready
+		if e.err != nil {
+			tc.release(e)
+			return nil, e.err
+		}
+		return &TableHandle{tc: tc, entry: e}, nil
+	}
+
+	e = &tableEntry{
+		fileNum: fileNum,
+		ready:   make(chan struct{}),
+		refs:    2,
+	}
+	e.elem = tc.lru.PushFront(e)
+	tc.tables[fileNum] = e
+	evicted := tc.evict()
+	tc.mu.Unlock()
+	for _, old := range evicted {
+		old.close()
+	}
+
+	e.sst, e.reader, e.err = tc.open(fileNum)
+	close(e.ready)
+	if e.err != nil {
+		// 打开失败的表不留在缓存中，下次Acquire时重试
+		tc.mu.Lock()
+		if tc.tables[fileNum] == e {
+			tc.remove(e)
+			e.refs--
+		}
+		tc.mu.Unlock()
+		tc.release(e)
+		return nil, e.err
+	}
+	return &TableHandle{tc: tc, entry: e}, nil
+}
+
+func (tc *TableCache) open(fileNum uint64) (*SSTable, *SSTReader, error) {
+	opts := tc.opts
+	opts.FileNum = fileNum
+	sst, err := OpenSSTableWithOptions(TableFileName(tc.dirname, fileNum), &opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := sst.NewReader()
+	if err != nil {
+		sst.Close()
+		return nil, nil, err
+	}
+	return sst, reader, nil
+}
+
+// Evict 将表从缓存中移除，同时删除它在块缓存中的块，在文件被删除之前调用
+func (tc *TableCache) Evict(fileNum uint64) {
+	if tc.opts.Cache != nil {
+		tc.opts.Cache.EvictFile(fileNum)
+	}
+	tc.mu.Lock()
+	e, ok := tc.tables[fileNum]
+	if ok {
+		tc.remove(e)
+	}
+	tc.mu.Unlock()
+	if ok {
+		tc.release(e)
+	}
+}
+
+// Close 关闭缓存，仍在使用中的表在Release之后关闭
+func (tc *TableCache) Close() error {
+	tc.mu.Lock()
+	tc.isClosed = true
+	entries := make([]*tableEntry, 0, len(tc.tables))
+	for _, e := range tc.tables {
+		tc.remove(e)
+		entries = append(entries, e)
+	}
+	tc.mu.Unlock()
+	for _, e := range entries {
+		tc.release(e)
+	}
+	return nil
+}
+
+// 超出限制时从最久未使用的表开始移出缓存，调用时需要持有锁
+// 返回已经没有使用者、需要在释放锁之后关闭的表
+func (tc *TableCache) evict() []*tableEntry {
+	var closing []*tableEntry
+	for len(tc.tables) > tc.maxOpen {
+		e := tc.lru.Back().Value.(*tableEntry)
+		tc.remove(e)
+		// 去掉TableCache自身的引用，仍在使用中的表由最后一个Release关闭
+		e.refs--
+		if e.refs == 0 {
+			closing = append(closing, e)
+		}
+	}
+	return closing
+}
+
+func (tc *TableCache) remove(e *tableEntry) {
+	tc.lru.Remove(e.elem)
+	delete(tc.tables, e.fileNum)
+}
+
+func (tc *TableCache) release(e *tableEntry) {
+	tc.mu.Lock()
+	e.refs--
+	last := e.refs == 0
+	tc.mu.Unlock()
+	if last {
+		e.close()
+	}
+}
+
+func (e *tableEntry) close() {
+	<-e.ready
+	if e.sst != nil {
+		e.sst.Close()
+	}
+}
+
+func (h *TableHandle) Reader() *SSTReader {
+	return h.entry.reader
+}
+
+// Release 释放引用，同一个TableHandle只能调用一次
+func (h *TableHandle) Release() {
+	h.tc.release(h.entry)
+}
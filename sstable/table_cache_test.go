@@ -0,0 +1,120 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/InsZVA/saver/cache"
+	"github.com/InsZVA/saver/table"
+)
+
+func newTestTables(t *testing.T, n int) string {
+	dir, err := ioutil.TempDir("", "saver_table_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		list := table.NewSkipList()
+		list.Set(table.NewKey([]byte("key")), []byte(fmt.Sprint(i)))
+		sst, err := CreateSSTable(TableFileName(dir, uint64(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = sst.FromMemTable(list); err != nil {
+			t.Fatal(err)
+		}
+		sst.Close()
+	}
+	return dir
+}
+
+func expectTableValue(t *testing.T, h *TableHandle, i int) {
+	val, found, err := h.Reader().Get(table.NewKey([]byte("key")))
+	if err != nil || !found || !bytes.Equal(val, []byte(fmt.Sprint(i))) {
+		t.Error("表", i, "读取错误", string(val), found, err)
+	}
+}
+
+func TestTableCacheEvict(t *testing.T) {
+	dir := newTestTables(t, 5)
+	defer os.RemoveAll(dir)
+	tc := NewTableCache(dir, 2, nil)
+
+	held, err := tc.Acquire(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 5; i++ {
+		h, err := tc.Acquire(uint64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectTableValue(t, h, i)
+		h.Release()
+		if len(tc.tables) > 2 {
+			t.Error("打开的表数量超过了限制", len(tc.tables))
+		}
+	}
+	if _, ok := tc.tables[1]; ok {
+		t.Error("表1没有被淘汰")
+	}
+	// 被淘汰但是仍在使用中的表不会被关闭
+	expectTableValue(t, held, 1)
+	sst := held.entry.sst
+	held.Release()
+	if _, err := sst.file.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Error("最后一个使用者释放之后表没有被关闭")
+	}
+
+	// 被淘汰的表可以重新打开
+	h, err := tc.Acquire(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTableValue(t, h, 1)
+	h.Release()
+
+	if _, err = tc.Acquire(100); err == nil {
+		t.Error("不存在的表打开成功")
+	}
+	if _, ok := tc.tables[100]; ok {
+		t.Error("打开失败的表留在了缓存中")
+	}
+	tc.Close()
+	if _, err = tc.Acquire(1); err == nil {
+		t.Error("关闭之后仍然可以Acquire")
+	}
+}
+
+func TestTableCacheConcurrent(t *testing.T) {
+	dir := newTestTables(t, 10)
+	defer os.RemoveAll(dir)
+	tc := NewTableCache(dir, 3, &Options{Cache: cache.New(1024 * 1024)})
+	defer tc.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				i := (g+j)%10 + 1
+				h, err := tc.Acquire(uint64(i))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				expectTableValue(t, h, i)
+				h.Release()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if len(tc.tables) > 3 {
+		t.Error("打开的表数量超过了限制", len(tc.tables))
+	}
+}
@@ -0,0 +1,89 @@
+package table
+
+import (
+	"bytes"
+	"sort"
+)
+
+// RangeTombstone 范围删除标记，删除[Start, End)内序列号小于Seq的所有记录
+type RangeTombstone struct {
+	Start []byte
+	End   []byte
+	Seq   uint64
+}
+
+// Contains key是否位于[Start, End)内
+func (t RangeTombstone) Contains(key []byte) bool {
+	return bytes.Compare(t.Start, key) <= 0 && bytes.Compare(key, t.End) < 0
+}
+
+// RangeTombstones 切分后的范围删除标记（fragment）
+// 按Start排序，不同的范围互不重叠，范围相同的fragment按Seq从大到小排列
+type RangeTombstones []RangeTombstone
+
+// FragmentRangeTombstones 把可能互相重叠的范围删除标记切分成互不重叠的fragment
+// 以所有的Start和End为切分点，每一段保留覆盖它的所有序列号，空范围被忽略
+// 把Start和End排序之后从左到右扫描一遍，扫描时维护覆盖当前位置的序列号
+func FragmentRangeTombstones(ts []RangeTombstone) RangeTombstones {
+	type point struct {
+		key   []byte
+		seq   uint64
+		start bool
+	}
+	points := make([]point, 0, 2*len(ts))
+	for _, t := range ts {
+		if bytes.Compare(t.Start, t.End) < 0 {
+			points = append(points, point{t.Start, t.Seq, true}, point{t.End, t.Seq, false})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return bytes.Compare(points[i].key, points[j].key) < 0
+	})
+	// 覆盖当前位置的每个序列号被多少个范围删除标记使用
+	active := make(map[uint64]int)
+	var seqs []uint64
+	var frags RangeTombstones
+	for i := 0; i < len(points); {
+		start := points[i].key
+		for ; i < len(points) && bytes.Equal(points[i].key, start); i++ {
+			if points[i].start {
+				active[points[i].seq]++
+			} else if active[points[i].seq]--; active[points[i].seq] == 0 {
+				delete(active, points[i].seq)
+			}
+		}
+		if i == len(points) || len(active) == 0 {
+			continue
+		}
+		seqs = seqs[:0]
+		for seq := range active {
+			seqs = append(seqs, seq)
+		}
+		sort.Slice(seqs, func(i, j int) bool {
+			return seqs[i] > seqs[j]
+		})
+		for _, seq := range seqs {
+			frags = append(frags, RangeTombstone{start, points[i].key, seq})
+		}
+	}
+	return frags
+}
+
+// MaxCoveringSeq 覆盖key并且序列号不超过snapshot的fragment中最大的序列号，没有时返回0
+func (ts RangeTombstones) MaxCoveringSeq(key []byte, snapshot uint64) uint64 {
+	// 各个范围的End是递增的，第一个End大于key的范围是唯一可能覆盖key的范围
+	i := sort.Search(len(ts), func(i int) bool {
+		return bytes.Compare(ts[i].End, key) > 0
+	})
+	for ; i < len(ts) && bytes.Compare(ts[i].Start, key) <= 0; i++ {
+		if ts[i].Seq <= snapshot {
+			return ts[i].Seq
+		}
+	}
+	return 0
+}
+
+// Covers key是否被某个序列号不超过snapshot的fragment删除
+func (ts RangeTombstones) Covers(key Key, snapshot uint64) bool {
+	return ts.MaxCoveringSeq(key.key, snapshot) > key.seq
+}
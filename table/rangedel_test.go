@@ -0,0 +1,128 @@
+package table
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestFragmentRangeTombstones(t *testing.T) {
+	frags := FragmentRangeTombstones([]RangeTombstone{
+		{[]byte("c"), []byte("g"), 5},
+		{[]byte("a"), []byte("e"), 3},
+		{[]byte("e"), []byte("e"), 9}, // 空范围被忽略
+		{[]byte("d"), []byte("f"), 5},
+	})
+	expect := []RangeTombstone{
+		{[]byte("a"), []byte("c"), 3},
+		{[]byte("c"), []byte("d"), 5},
+		{[]byte("c"), []byte("d"), 3},
+		{[]byte("d"), []byte("e"), 5},
+		{[]byte("d"), []byte("e"), 3},
+		{[]byte("e"), []byte("f"), 5},
+		{[]byte("f"), []byte("g"), 5},
+	}
+	if len(frags) != len(expect) {
+		t.Fatal("切分结果错误", frags)
+	}
+	for i, f := range frags {
+		if !bytes.Equal(f.Start, expect[i].Start) || !bytes.Equal(f.End, expect[i].End) || f.Seq != expect[i].Seq {
+			t.Error("切分结果错误", i, f)
+		}
+	}
+
+	for _, c := range []struct {
+		key      string
+		snapshot uint64
+		seq      uint64
+	}{
+		{"", MaxSeq, 0},
+		{"a", MaxSeq, 3},
+		{"b", 2, 0},
+		{"c", MaxSeq, 5},
+		{"c", 4, 3},
+		{"dd", MaxSeq, 5},
+		{"f", MaxSeq, 5},
+		{"g", MaxSeq, 0},
+	} {
+		if seq := frags.MaxCoveringSeq([]byte(c.key), c.snapshot); seq != c.seq {
+			t.Error("MaxCoveringSeq错误", c.key, c.snapshot, seq)
+		}
+	}
+	if !frags.Covers(NewInternalKey([]byte("b"), 2, KindSet), MaxSeq) ||
+		frags.Covers(NewInternalKey([]byte("b"), 3, KindSet), MaxSeq) ||
+		frags.Covers(NewInternalKey([]byte("h"), 0, KindSet), MaxSeq) {
+		t.Error("Covers错误")
+	}
+	if len(FragmentRangeTombstones(nil)) != 0 {
+		t.Error("没有范围删除标记时不应该有fragment")
+	}
+}
+
+func TestFragmentRangeTombstonesRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var ts []RangeTombstone
+	for i := 0; i < 200; i++ {
+		start, end := r.Intn(100), r.Intn(100)
+		ts = append(ts, RangeTombstone{[]byte{byte(start)}, []byte{byte(end)}, uint64(r.Intn(20))})
+	}
+	frags := FragmentRangeTombstones(ts)
+	for i := 1; i < len(frags); i++ {
+		prev, cur := frags[i-1], frags[i]
+		if c := bytes.Compare(prev.Start, cur.Start); c > 0 || (c == 0 && prev.Seq <= cur.Seq) ||
+			(c < 0 && bytes.Compare(prev.End, cur.Start) > 0) {
+			t.Fatal("fragment没有排序或者互相重叠", prev, cur)
+		}
+	}
+	// 每个位置上覆盖它的最大序列号与直接遍历所有范围删除标记的结果一致
+	for key := 0; key <= 100; key++ {
+		for _, snapshot := range []uint64{0, 5, 10, MaxSeq} {
+			expect := uint64(0)
+			for _, t := range ts {
+				if t.Contains([]byte{byte(key)}) && t.Seq <= snapshot && t.Seq > expect {
+					expect = t.Seq
+				}
+			}
+			if seq := frags.MaxCoveringSeq([]byte{byte(key)}, snapshot); seq != expect {
+				t.Fatal("MaxCoveringSeq错误", key, snapshot, seq, expect)
+			}
+		}
+	}
+}
+
+func TestSkipListDeleteRange(t *testing.T) {
+	l := NewSkipList()
+	l.Set(NewInternalKey([]byte("a"), 1, KindSet), []byte("1"))
+	l.Set(NewInternalKey([]byte("b"), 2, KindSet), []byte("2"))
+	l.Set(NewInternalKey([]byte("c"), 3, KindSet), []byte("3"))
+	l.DeleteRange([]byte("a"), []byte("c"), 4)
+	l.DeleteRange([]byte("z"), []byte("a"), 9)
+	// 范围删除之后写入的key不受影响
+	l.Set(NewInternalKey([]byte("b"), 5, KindSet), []byte("5"))
+	if len(l.RangeTombstones()) != 1 {
+		t.Fatal("范围删除标记错误", l.RangeTombstones())
+	}
+	for _, c := range []struct {
+		key string
+		val string
+		ok  bool
+	}{
+		{"a", "", false}, {"b", "5", true}, {"c", "3", true}, {"d", "", false},
+	} {
+		val, ok := l.Get(NewKey([]byte(c.key)))
+		if ok != c.ok || string(val) != c.val {
+			t.Error("Get错误", c.key, string(val), ok)
+		}
+	}
+	l.Delete(NewInternalKey([]byte("c"), 6, KindDelete))
+	if _, ok := l.Get(NewKey([]byte("c"))); ok {
+		t.Error("被删除的key不应该存在")
+	}
+	l.DeleteRange([]byte("b"), []byte("d"), 7)
+	if len(l.RangeTombstones()) != 4 {
+		t.Error("新的范围删除标记之后应该重新切分", l.RangeTombstones())
+	}
+	if _, ok := l.Get(NewKey([]byte("b"))); ok {
+		t.Error("被范围删除的key不应该存在")
+	}
+}
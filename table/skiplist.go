@@ -12,23 +12,78 @@ const (
 	maxLevel = 8
 )
 
+// Kind 表示一条记录的类型
+type Kind uint8
+
+const (
+	// KindDelete 删除标记（墓碑）
+	KindDelete Kind = 0
+	// KindSet 普通的写入
+	KindSet Kind = 1
+	// KindBlobIndex value被分离到了blob文件中，记录中保存的是指向blob的指针
+	KindBlobIndex Kind = 2
+	// KindRangeDelete 范围删除标记，只出现在SSTable的range-del block中
+	KindRangeDelete Kind = 3
+	// KindSetWithTTL 带过期时间的写入，value的前8个字节是过期时间，过期之后视为被删除
+	KindSetWithTTL Kind = 4
+)
+
+// MaxSeq 序列号与Kind一起编码为8字节，序列号只占用高56位
+const MaxSeq = 1<<56 - 1
+
 type Key struct {
 	key []byte
-	// TODO: MVCC支持
+	// 写入时的序列号，用于MVCC
+	seq  uint64
+	kind Kind
 }
 
 func (key Key) Key() []byte {
 	return key.key
 }
 
+func (key Key) Seq() uint64 {
+	return key.seq
+}
+
+func (key Key) Kind() Kind {
+	return key.kind
+}
+
 func NewKey(k []byte) Key {
-	return Key{k}
+	return Key{key: k, kind: KindSet}
 }
 
+// NewInternalKey 构造带有序列号和类型的Key
+func NewInternalKey(k []byte, seq uint64, kind Kind) Key {
+	return Key{key: k, seq: seq, kind: kind}
+}
+
+// NewSearchKey 构造用于查找的Key，按InternalCmp排在key所有版本之前
+func NewSearchKey(k []byte) Key {
+	return Key{key: k, seq: MaxSeq, kind: KindSet}
+}
+
+// Cmp 只比较user key
 func (key Key) Cmp(key2 Key) int {
 	return bytes.Compare(key.key, key2.key)
 }
 
+// InternalCmp 先按user key升序，相同的user key再按序列号降序比较，即同一个key的新版本排在前面
+// 序列号也相同时视为同一条记录
+func (key Key) InternalCmp(key2 Key) int {
+	if c := bytes.Compare(key.key, key2.key); c != 0 {
+		return c
+	}
+	switch {
+	case key.seq > key2.seq:
+		return -1
+	case key.seq < key2.seq:
+		return 1
+	}
+	return 0
+}
+
 type SkipListNode struct {
 	key  Key
 	val  []byte
@@ -60,9 +115,14 @@ func (node *SkipListNode) Next() *SkipListNode {
 	return node.next
 }
 
+// SkipList 内存表，按InternalCmp排列，同一个key的每次写入都是一个新的版本
 type SkipList struct {
 	start [maxLevel]*SkipListNode
 	end   [maxLevel]*SkipListNode
+	// 范围删除标记单独保存，不进入跳表
+	rangeDels []RangeTombstone
+	// rangeDels切分后的结果，每次DeleteRange时重新生成，读取时不修改
+	fragments RangeTombstones
 }
 
 func NewSkipList() *SkipList {
@@ -103,13 +163,13 @@ func (list *SkipList) String() string {
 	return strings.Join(ret, "\n")
 }
 
-// 返回每一层小于等于该Key的元素中最大的
+// Find 按InternalCmp返回每一层小于等于该Key的元素中最大的，第二个返回值表示user key和序列号都相同的记录是否存在
 func (list *SkipList) Find(key Key) ([maxLevel]*SkipListNode, bool) {
 	level := maxLevel - 1
 	p := list.start[level]
 	var ret [maxLevel]*SkipListNode
 	for p.next != nil {
-		cmp := p.next.key.Cmp(key)
+		cmp := p.next.key.InternalCmp(key)
 		// 虚拟结束结点大于一切结点
 		if p.next == list.end[level] {
 			cmp = 1
@@ -138,6 +198,16 @@ func (list *SkipList) Find(key Key) ([maxLevel]*SkipListNode, bool) {
 	return ret, false
 }
 
+// Seek 按InternalCmp返回第一个大于等于key的结点，不存在时返回End
+// 用NewInternalKey(k, seq, kind)查找时得到k的序列号不大于seq的最新版本（或者之后的key）
+func (list *SkipList) Seek(key Key) *SkipListNode {
+	nodes, found := list.Find(key)
+	if found {
+		return nodes[0]
+	}
+	return nodes[0].next
+}
+
 func (list *SkipList) randomLevel() int {
 	l := 1
 	for l < maxLevel {
@@ -150,11 +220,17 @@ func (list *SkipList) randomLevel() int {
 	return l
 }
 
+// insert 插入一个版本，user key和序列号都相同时覆盖原来的记录
 func (list *SkipList) insert(key Key, val []byte) {
 
 	nodes, found := list.Find(key)
 	if found {
-		for _, node := range nodes {
+		// 高于命中层的nodes是前驱结点，不能修改
+		for i, node := range nodes {
+			if node == list.start[i] || node.key.InternalCmp(key) != 0 {
+				continue
+			}
+			node.key = key
 			node.val = val
 		}
 		return
@@ -180,3 +256,32 @@ func (list *SkipList) insert(key Key, val []byte) {
 func (list *SkipList) Set(key Key, val []byte) {
 	list.insert(key, val)
 }
+
+// Delete 写入一个删除标记，而不是直接从内存表中移除，这样落盘后才能遮盖更老的SSTable
+func (list *SkipList) Delete(key Key) {
+	list.insert(NewInternalKey(key.key, key.seq, KindDelete), nil)
+}
+
+// DeleteRange 写入一个范围删除标记，删除[start, end)内序列号小于seq的记录，空范围被忽略
+func (list *SkipList) DeleteRange(start, end []byte, seq uint64) {
+	if bytes.Compare(start, end) >= 0 {
+		return
+	}
+	list.rangeDels = append(list.rangeDels, RangeTombstone{start, end, seq})
+	list.fragments = FragmentRangeTombstones(list.rangeDels)
+}
+
+// RangeTombstones 返回切分后的范围删除标记，不能被修改；之后的DeleteRange生成新的切片，不影响已经返回的结果
+func (list *SkipList) RangeTombstones() RangeTombstones {
+	return list.fragments
+}
+
+// Get 查找key最新的版本，被删除标记或者范围删除标记覆盖的key视为不存在
+func (list *SkipList) Get(key Key) ([]byte, bool) {
+	node := list.Seek(NewSearchKey(key.key))
+	if node == list.End() || !bytes.Equal(node.key.key, key.key) ||
+		node.key.kind == KindDelete || list.RangeTombstones().Covers(node.key, MaxSeq) {
+		return nil, false
+	}
+	return node.val, true
+}
@@ -2,7 +2,9 @@ package table
 
 import (
 	"bytes"
+	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
 
 	"github.com/InsZVA/saver/util"
@@ -107,3 +109,68 @@ func TestSkipList(t *testing.T) {
 		}
 	}
 }
+
+func TestSkipListDelete(t *testing.T) {
+	l := NewSkipList()
+	for i := 0; i < 100; i++ {
+		l.Set(NewKey([]byte{byte(i)}), []byte{byte(i)})
+	}
+	l.Delete(NewKey([]byte{50}))
+	nodes, found := l.Find(NewKey([]byte{50}))
+	if !found {
+		t.Fatal("删除标记没有写入")
+	}
+	if nodes[0].Key().Kind() != KindDelete || nodes[0].Val() != nil {
+		t.Error("删除标记错误")
+	}
+	// 其他结点不受影响
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			continue
+		}
+		nodes, found := l.Find(NewKey([]byte{byte(i)}))
+		if !found || nodes[0].Key().Kind() != KindSet || !bytes.Equal(nodes[0].Val(), []byte{byte(i)}) {
+			t.Error(i, "被错误修改")
+		}
+	}
+}
+
+func TestSkipListVersions(t *testing.T) {
+	l := NewSkipList()
+	l.Set(NewInternalKey([]byte("a"), 1, KindSet), []byte("1"))
+	l.Set(NewInternalKey([]byte("a"), 3, KindSet), []byte("3"))
+	l.Set(NewInternalKey([]byte("b"), 4, KindSet), []byte("4"))
+	l.Set(NewInternalKey([]byte("a"), 2, KindSet), []byte("2"))
+	// 同一个key的版本从新到旧排列
+	var got []string
+	for p := l.First().Next(); p != l.End(); p = p.Next() {
+		got = append(got, fmt.Sprintf("%s%d", p.Key().Key(), p.Key().Seq()))
+	}
+	if strings.Join(got, ",") != "a3,a2,a1,b4" {
+		t.Error("多个版本的顺序错误", got)
+	}
+	for _, c := range []struct {
+		seq  uint64
+		want string
+	}{
+		{MaxSeq, "a3"}, {3, "a3"}, {2, "a2"}, {1, "a1"}, {0, "b4"},
+	} {
+		p := l.Seek(NewInternalKey([]byte("a"), c.seq, KindSet))
+		if p == l.End() || fmt.Sprintf("%s%d", p.Key().Key(), p.Key().Seq()) != c.want {
+			t.Error("Seek错误", c.seq, p.Key())
+		}
+	}
+	if val, ok := l.Get(NewKey([]byte("a"))); !ok || string(val) != "3" {
+		t.Error("Get应该返回最新的版本", string(val), ok)
+	}
+	l.Delete(NewInternalKey([]byte("a"), 5, KindDelete))
+	if _, ok := l.Get(NewKey([]byte("a"))); ok {
+		t.Error("最新的版本是删除标记时不应该存在")
+	}
+	if p := l.Seek(NewInternalKey([]byte("a"), 4, KindSet)); string(p.Val()) != "3" {
+		t.Error("删除标记不应该覆盖更老的版本", string(p.Val()))
+	}
+	if l.Seek(NewSearchKey([]byte("c"))) != l.End() {
+		t.Error("越界的Seek应该返回End")
+	}
+}
@@ -0,0 +1,36 @@
+package table
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/*
+KindSetWithTTL的value的编码:
+[expiry64][val...]
+expiry为过期时间的unix纳秒，当前时间不小于expiry时记录过期，读取时视为不存在，compaction时删除
+*/
+const ExpirySize = 8
+
+// EncodeExpiry 在val之前加上过期时间，作为KindSetWithTTL记录的value
+func EncodeExpiry(val []byte, expiry time.Time) []byte {
+	buf := make([]byte, ExpirySize, ExpirySize+len(val))
+	binary.LittleEndian.PutUint64(buf, uint64(expiry.UnixNano()))
+	return append(buf, val...)
+}
+
+// Expired 记录在now（unix纳秒）时是否已经过期，不完整的value视为已经过期
+func Expired(kind Kind, val []byte, now int64) bool {
+	if kind != KindSetWithTTL {
+		return false
+	}
+	return len(val) < ExpirySize || int64(binary.LittleEndian.Uint64(val)) <= now
+}
+
+// UserValue 去掉记录中过期时间之后的value
+func UserValue(kind Kind, val []byte) []byte {
+	if kind != KindSetWithTTL || len(val) < ExpirySize {
+		return val
+	}
+	return val[ExpirySize:]
+}